@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// adminRouter serves the agent management API, mounted at /admin
+func adminRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(adminAuth, idempotent)
+
+	r.Get("/agents", adminListAgents)
+	r.Post("/agents", adminCreateAgent)
+	r.Get("/agents/{agentkey}", adminGetAgent)
+	r.Patch("/agents/{agentkey}", adminUpdateAgent)
+	r.Post("/agents/{agentkey}/secrets", adminIssueSecret)
+	r.Delete("/agents/{agentkey}/secrets/{secretID}", adminRevokeSecret)
+	r.Post("/agents/{agentkey}/keys", adminAddKeys)
+	r.Delete("/agents/{agentkey}/keys/{kid}", adminRevokeKey)
+	r.With(paginate).Get("/agents/{agentkey}/dids", adminAgentDIDs)
+	r.Get("/usage", adminUsage)
+	r.Get("/invites", adminListInvites)
+	r.Post("/invites", adminCreateInvite)
+	r.Delete("/invites/{inviteID}", adminRevokeInvite)
+	return r
+}
+
+// adminAuth requires one of the [admin] tokens from config.toml as a bearer token
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validAdminToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			writeProblem(w, http.StatusUnauthorized, codeUnauthorized, "admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validAdminToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	// compare hashes so the comparison takes the same time whatever the token's length
+	hashed := sha256.Sum256([]byte(token))
+	valid := false
+	for _, t := range Conf.Admin.Tokens {
+		h := sha256.Sum256([]byte(t))
+		if subtle.ConstantTimeCompare(hashed[:], h[:]) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// newAgentKey generates an agentkey in the form of the existing hex keys
+func newAgentKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	writeProblem(w, status, statusProblemCode(status), err.Error())
+}
+
+func adminAgentError(w http.ResponseWriter, err error) {
+	if err == errAgentNotFound {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	adminError(w, http.StatusInternalServerError, err)
+}
+
+func adminListAgents(w http.ResponseWriter, r *http.Request) {
+	agents, err := listAgents()
+	if err != nil {
+		adminAgentError(w, err)
+		return
+	}
+	jsn, _ := json.Marshal(agents)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"agents":%s}`, jsn)
+}
+
+// create an agent and issue its first secret
+func adminCreateAgent(w http.ResponseWriter, r *http.Request) {
+	type CreateRequest struct {
+		ID     string      `json:"id"`
+		Name   string      `json:"name"`
+		Scopes []string    `json:"scopes"`
+		Quotas agentQuotas `json:"quotas"`
+	}
+	var createRequest CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+	if createRequest.Scopes == nil {
+		createRequest.Scopes = []string{scopeRegister}
+	}
+	if err := validScopes(createRequest.Scopes); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	agentkey, err := newAgentID(createRequest.ID)
+	switch {
+	case err == errAgentIDReserved:
+		adminError(w, http.StatusBadRequest, err)
+		return
+	case err == errAgentConfigured:
+		adminError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	secretID, secret, err := createAgentWithSecret(agentkey, createRequest.Name, createRequest.Scopes, createRequest.Quotas)
+	switch {
+	case isUniqueViolation(err):
+		adminError(w, http.StatusConflict, fmt.Errorf("agent %s already exists", agentkey))
+		return
+	case err != nil:
+		log.Printf("admin: unable to create agent %s: %v", agentkey, err)
+		writeDatabaseProblem(w, "a")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%q, "secretID":%d, "secret":%q}`, agentkey, secretID, secret)
+}
+
+func adminGetAgent(w http.ResponseWriter, r *http.Request) {
+	a, err := getAgent(chi.URLParam(r, "agentkey"))
+	if err != nil {
+		adminAgentError(w, err)
+		return
+	}
+	jsn, _ := json.Marshal(a)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"agent":%s}`, jsn)
+}
+
+// change an agent's name, scopes, quotas or enabled flag
+func adminUpdateAgent(w http.ResponseWriter, r *http.Request) {
+	var update agentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+	if err := validScopes(update.Scopes); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	agentkey := chi.URLParam(r, "agentkey")
+	if err := updateAgent(agentkey, update); err != nil {
+		adminAgentError(w, err)
+		return
+	}
+	adminGetAgent(w, r)
+}
+
+func adminIssueSecret(w http.ResponseWriter, r *http.Request) {
+	agentkey := chi.URLParam(r, "agentkey")
+	if _, err := getAgent(agentkey); err != nil {
+		adminAgentError(w, err)
+		return
+	}
+	secretID, secret, err := issueAgentSecret(agentkey)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "secretID":%d, "secret":%q}`, secretID, secret)
+}
+
+func adminRevokeSecret(w http.ResponseWriter, r *http.Request) {
+	secretID, err := strconv.ParseInt(chi.URLParam(r, "secretID"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("secret id must be a number"))
+		return
+	}
+	if err = revokeAgentSecret(chi.URLParam(r, "agentkey"), secretID); err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "revoked":%d}`, secretID)
+}
+
+// register public keys for an agent, given as a JWK or a JWKS
+func adminAddKeys(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONProblem(w)
+		return
+	}
+	keys, err := parseKeys(body)
+	if err != nil {
+		writeJSONProblem(w)
+		return
+	}
+
+	agentkey := chi.URLParam(r, "agentkey")
+	if _, err = getAgent(agentkey); err != nil {
+		adminAgentError(w, err)
+		return
+	}
+	kids := []string{}
+	for _, k := range keys {
+		kid, err := addAgentKey(agentkey, k)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		kids = append(kids, kid)
+	}
+
+	jsn, _ := json.Marshal(kids)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "kids":%s}`, jsn)
+}
+
+func adminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	kid := chi.URLParam(r, "kid")
+	if err := revokeAgentKey(chi.URLParam(r, "agentkey"), kid); err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "revoked":%q}`, kid)
+}
+
+// list the DIDs an agent registered, from their agent_id
+func adminAgentDIDs(w http.ResponseWriter, r *http.Request) {
+	listDIDs(w, r, chi.URLParam(r, "agentkey"))
+}
+
+// report agent usage for a period, as JSON or as CSV for billing
+func adminUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to, err := usagePeriod(query.Get("from"), query.Get("to"))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	report, err := usageReport(query.Get("agent"), from, to)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`, from.Format("2006-01-02"), to.Format("2006-01-02")))
+		w.WriteHeader(http.StatusOK)
+		writeUsageCSV(w, report)
+		return
+	}
+
+	jsn, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"from":%q, "to":%q, "usage":%s}`, from.Format("2006-01-02"), to.Format("2006-01-02"), jsn)
+}
+
+// invites for invite-only registration, made by admins or agents
+func adminListInvites(w http.ResponseWriter, r *http.Request) {
+	listInvitesFor(w, r, "")
+}
+
+func adminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	createInviteFor(w, r, inviteCreatorAdmin)
+}
+
+func adminRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	revokeInviteFor(w, r, "")
+}
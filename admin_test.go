@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+)
+
+const testAdminToken = "an admin token"
+
+func adminRequest(t *testing.T, method string, path string, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rr := httptest.NewRecorder()
+	adminRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAuth(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+	Conf.Admin.Tokens = []string{testAdminToken}
+
+	for _, auth := range []string{"", "Bearer ", "Bearer not the token", testAdminToken + "x"} {
+		req, err := http.NewRequest("GET", "/agents", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", auth)
+		rr := httptest.NewRecorder()
+		adminRouter().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", auth, status, http.StatusUnauthorized)
+		}
+		expected := problemJSON(http.StatusUnauthorized, codeUnauthorized, "admin token required")
+		if rr.Body.String() != expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestAdminAgents(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	Conf.Admin.Tokens = []string{testAdminToken}
+
+	// create an agent, which issues its first secret
+	rr := adminRequest(t, "POST", "/agents", `{"name":"An Agent","scopes":["register","read"],"quotas":{"registrationsPerDay":10}}`)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusCreated, rr.Body.String())
+	}
+	var created struct {
+		ID       string `json:"id"`
+		SecretID int64  `json:"secretID"`
+		Secret   string `json:"secret"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if len(created.ID) != 64 || created.Secret == "" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	rr = adminRequest(t, "POST", "/agents", `{"scopes":["everything"]}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("agent with an unknown scope: got status %v want %v", status, http.StatusBadRequest)
+	}
+
+	// change its scopes and quotas and disable it
+	rr = adminRequest(t, "PATCH", "/agents/"+created.ID, `{"scopes":["register"],"enabled":false,"quotas":{"activeDIDs":5}}`)
+	var shown struct {
+		Agent agent `json:"agent"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &shown)
+	if rr.Code != http.StatusOK || shown.Agent.Enabled || len(shown.Agent.Scopes) != 1 || shown.Agent.Name != "An Agent" ||
+		shown.Agent.Quotas.ActiveDIDs != 5 || shown.Agent.Quotas.RegistrationsPerDay != 0 || shown.Agent.Quotas.SupersedePeriodHours != 24 {
+		t.Errorf("agent was not updated: got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = adminRequest(t, "PATCH", "/agents/unknown", `{"enabled":false}`); rr.Code != http.StatusNotFound {
+		t.Errorf("updating an unknown agent: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// issue a second secret and revoke the first
+	rr = adminRequest(t, "POST", "/agents/"+created.ID+"/secrets", "")
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("issuing a secret: got status %v want %v", status, http.StatusCreated)
+	}
+	rr = adminRequest(t, "DELETE", fmt.Sprintf("/agents/%s/secrets/%d", created.ID, created.SecretID), "")
+	if expected := fmt.Sprintf(`{"success":true, "revoked":%d}`, created.SecretID); rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+	rr = adminRequest(t, "DELETE", fmt.Sprintf("/agents/%s/secrets/%d", created.ID, created.SecretID), "")
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("revoking a revoked secret: got status %v want %v", status, http.StatusNotFound)
+	}
+
+	rr = adminRequest(t, "GET", "/agents/"+created.ID, "")
+	json.Unmarshal(rr.Body.Bytes(), &shown)
+	if len(shown.Agent.Secrets) != 2 || shown.Agent.Secrets[0].Revoked == nil || shown.Agent.Secrets[1].Revoked != nil {
+		t.Errorf("agent secrets not as expected: got %v", rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), created.Secret) {
+		t.Errorf("agent secret was shown")
+	}
+
+	// list the DIDs it registered
+	_, err = DB.Exec(`INSERT INTO didstore (id, root, agent_id, status) VALUES ('did:jlinc:agentDID', 'did:jlinc:agentDID', $1, 'verified')`, created.ID)
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+	rr = adminRequest(t, "GET", "/agents/"+created.ID+"/dids", "")
+	var listed struct {
+		DIDs []agentDID `json:"dids"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed.DIDs) != 1 || listed.DIDs[0].ID != "did:jlinc:agentDID" || listed.DIDs[0].Status != "verified" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+	stmt, _ = DB.Prepare("DELETE FROM agents")
+	stmt.Exec()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// didFilterFrom reads the status, createdAfter and createdBefore query parameters
+func didFilterFrom(r *http.Request) (didFilter, error) {
+	var f didFilter
+	query := r.URL.Query()
+	switch f.Status = query.Get("status"); f.Status {
+	case "", "init", "verified", "superseded", "revoked":
+	default:
+		return f, errors.New("status must be init, verified, superseded or revoked")
+	}
+
+	var err error
+	if after := query.Get("createdAfter"); after != "" {
+		if f.CreatedAfter, err = time.Parse(time.RFC3339, after); err != nil {
+			return f, errors.New("createdAfter must be in valid RFC3339 format")
+		}
+	}
+	if before := query.Get("createdBefore"); before != "" {
+		if f.CreatedBefore, err = time.Parse(time.RFC3339, before); err != nil {
+			return f, errors.New("createdBefore must be in valid RFC3339 format")
+		}
+	}
+	return f, nil
+}
+
+// List the DIDs registered by the authenticated agent, a page at a time
+func agentListDIDs(w http.ResponseWriter, r *http.Request) {
+	listDIDs(w, r, agentFrom(r.Context()))
+}
+
+func listDIDs(w http.ResponseWriter, r *http.Request, agentkey string) {
+	f, err := didFilterFrom(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	dids, cursor, err := agentDIDs(agentkey, f, pageFrom(r.Context()))
+	if err != nil {
+		writeDatabaseProblem(w, "q")
+		return
+	}
+
+	jsn, _ := json.Marshal(dids)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if cursor == "" {
+		fmt.Fprintf(w, `{"dids":%s}`, jsn)
+		return
+	}
+	fmt.Fprintf(w, `{"dids":%s, "nextCursor":%q}`, jsn, cursor)
+}
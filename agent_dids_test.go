@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+		page   page
+	}{
+		{"", http.StatusOK, page{After: 0, Limit: defaultPageLimit}},
+		{"?cursor=" + nextCursor(42) + "&limit=5", http.StatusOK, page{After: 42, Limit: 5}},
+		{"?limit=5000", http.StatusOK, page{After: 0, Limit: maxPageLimit}},
+		{"?cursor=notacursor", http.StatusBadRequest, page{}},
+		{"?cursor=" + nextCursor(-1), http.StatusBadRequest, page{}},
+		{"?limit=0", http.StatusBadRequest, page{}},
+	}
+
+	for _, test := range tests {
+		var got page
+		handler := paginate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = pageFrom(r.Context())
+		}))
+		req, err := http.NewRequest("GET", "/agent/dids"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.status || got != test.page {
+			t.Errorf("%q: got %v %+v want %v %+v", test.query, rr.Code, got, test.status, test.page)
+		}
+	}
+}
+
+func TestAgentListDIDs(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the token's iat
+
+	for _, id := range []string{"did:jlinc:first", "did:jlinc:second", "did:jlinc:third"} {
+		insertAgentDID(t, id, testAgentKey)
+	}
+	insertAgentDID(t, "did:jlinc:another", "another agent")
+	DB.Exec("UPDATE didstore SET status = 'revoked' WHERE id = 'did:jlinc:second'")
+
+	handler := agentAuth(scopeRead)(paginate(http.HandlerFunc(agentListDIDs)))
+	token := agentJWT(t, Conf.APIAuth[testAgentKey], jwt.MapClaims{"iss": testAgentKey})
+	list := func(query string, token string) (*httptest.ResponseRecorder, []agentDID, string) {
+		req, err := http.NewRequest("GET", "/agent/dids"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		var result struct {
+			DIDs       []agentDID `json:"dids"`
+			NextCursor string     `json:"nextCursor"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		return rr, result.DIDs, result.NextCursor
+	}
+
+	// the agent's DIDs come a page at a time
+	rr, dids, cursor := list("?limit=2", token)
+	if rr.Code != http.StatusOK || len(dids) != 2 || dids[0].ID != "did:jlinc:first" || dids[1].ID != "did:jlinc:second" || cursor == "" {
+		t.Errorf("first page not as expected: got %v %v", rr.Code, rr.Body.String())
+	}
+	rr, dids, cursor = list("?limit=2&cursor="+cursor, token)
+	if rr.Code != http.StatusOK || len(dids) != 1 || dids[0].ID != "did:jlinc:third" || cursor != "" {
+		t.Errorf("last page not as expected: got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// filtered by status
+	rr, dids, _ = list("?status=revoked", token)
+	if rr.Code != http.StatusOK || len(dids) != 1 || dids[0].ID != "did:jlinc:second" {
+		t.Errorf("revoked DIDs not as expected: got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr, _, _ = list("?status=unknown", token); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown status: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// and only for a signed request
+	otherToken := agentJWT(t, "not the secret", jwt.MapClaims{"iss": testAgentKey})
+	if rr, _, _ = list("", otherToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("badly signed request: got status %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// delete previous entries from the test database
+	stmt, err := DB.Prepare("DELETE FROM didstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt.Exec()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signingMethodEdDSA signs JWTs with ed25519 keys (RFC 8037), which jwt-go doesn't support itself
+type signingMethodEdDSA struct{}
+
+var edDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(edDSA.Alg(), func() jwt.SigningMethod {
+		return edDSA
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString string, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok || len(priv) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+// jwk is an ed25519 (RFC 8037) or P-256 (RFC 7518) public JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+// jwks is a JSON Web Key Set
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// credential returns the key for verifying JWTs, along with their alg
+func (k jwk) credential() (agentCredential, error) {
+	c := agentCredential{Kid: k.Kid}
+	x := b64Decode(k.X)
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return c, errors.New("Ed25519 key size incorrect")
+		}
+		c.Alg, c.Key = edDSA.Alg(), ed25519.PublicKey(x)
+	case k.Kty == "EC" && k.Crv == "P-256":
+		y := b64Decode(k.Y)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if len(x) != 32 || len(y) != 32 || !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return c, errors.New("P-256 key is not valid")
+		}
+		c.Alg, c.Key = jwt.SigningMethodES256.Alg(), pub
+	default:
+		return c, fmt.Errorf("key type %s %s is not supported, use OKP Ed25519 or EC P-256", k.Kty, k.Crv)
+	}
+	if k.Alg != "" && k.Alg != c.Alg {
+		return c, fmt.Errorf("alg %s does not match the key type", k.Alg)
+	}
+	return c, nil
+}
+
+// thumbprint is the RFC 7638 thumbprint of the key, used as its kid when it has none
+func (k jwk) thumbprint() string {
+	var members string
+	if k.Kty == "EC" {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, k.Crv, k.Kty, k.X, k.Y)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+	return b64Encode(getHash(members))
+}
+
+// parseKeys reads a single JWK or a JWKS document
+func parseKeys(data []byte) ([]jwk, error) {
+	var doc struct {
+		jwk
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Keys != nil {
+		return doc.Keys, nil
+	}
+	return []jwk{doc.jwk}, nil
+}
+
+// addAgentKey registers a public key for an agent, returning its kid
+func addAgentKey(agentkey string, k jwk) (string, error) {
+	if _, err := k.credential(); err != nil {
+		return "", err
+	}
+	if k.Kid == "" {
+		k.Kid = k.thumbprint()
+	}
+
+	// an agent's active kids are unique, by agent_keys_active_kid_idx
+	stored, _ := json.Marshal(k)
+	_, err := DB.Exec("INSERT INTO agent_keys (agent_id, kid, jwk) VALUES ($1, $2, $3)", agentkey, k.Kid, string(stored))
+	if isUniqueViolation(err) {
+		return "", fmt.Errorf("agent already has a key %s", k.Kid)
+	}
+	return k.Kid, err
+}
+
+// revokeAgentKey stops a public key from being accepted
+func revokeAgentKey(agentkey string, kid string) error {
+	result, err := DB.Exec("UPDATE agent_keys SET revoked = NOW() WHERE agent_id = $1 AND kid = $2 AND revoked IS NULL", agentkey, kid)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("active agent key not found")
+	}
+	return nil
+}
+
+// agentPublicKeys returns an agent's active registered keys, then those at its JWKS URL
+func agentPublicKeys(agentkey string, jwksURL string) ([]agentCredential, error) {
+	rows, err := DB.Query("SELECT id, jwk FROM agent_keys WHERE agent_id = $1 AND revoked IS NULL ORDER BY id DESC", agentkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []agentCredential
+	for rows.Next() {
+		var id int64
+		var stored string
+		if err = rows.Scan(&id, &stored); err != nil {
+			return nil, err
+		}
+		var k jwk
+		json.Unmarshal([]byte(stored), &k)
+		c, err := k.credential()
+		if err != nil {
+			log.Printf("agent %s key %d: %v", agentkey, id, err)
+			continue
+		}
+		c.ID = id
+		credentials = append(credentials, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if jwksURL != "" {
+		keys, err := fetchJWKS(jwksURL)
+		if err != nil {
+			// the registered keys may still do
+			log.Printf("agent %s JWKS: %v", agentkey, err)
+		}
+		credentials = append(credentials, keys...)
+	}
+	return credentials, nil
+}
+
+// agentKeyInfo describes an agent's public key for admins
+type agentKeyInfo struct {
+	Kid      string     `json:"kid"`
+	JWK      jwk        `json:"jwk"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// JWKS documents are cached for a while, so that each request doesn't fetch them. A failed
+// fetch is remembered for a shorter while, so that a down server isn't asked on every request,
+// and the keys last fetched keep being used until they are too old.
+const (
+	jwksCacheTime   = 10 * time.Minute
+	jwksFailureTime = 30 * time.Second
+	jwksMaxStale    = 24 * time.Hour
+)
+
+type cachedJWKS struct {
+	keys    []agentCredential
+	fetched time.Time // when keys were fetched
+	err     error     // the last fetch's error, if it failed
+	failed  time.Time
+}
+
+// jwksFetch is a fetch in progress, which other requests for the same URL wait for
+type jwksFetch struct {
+	done chan struct{}
+	keys []agentCredential
+	err  error
+}
+
+var (
+	jwksCache    = map[string]cachedJWKS{}
+	jwksFetching = map[string]*jwksFetch{}
+	jwksCacheMu  sync.Mutex
+	jwksClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+// fetchJWKS returns the usable keys of the JWKS document at a URL. When it can't be fetched,
+// the keys fetched before are returned along with the error.
+func fetchJWKS(url string) ([]agentCredential, error) {
+	jwksCacheMu.Lock()
+	cached, ok := jwksCache[url]
+	switch {
+	case ok && time.Since(cached.fetched) < jwksCacheTime:
+		jwksCacheMu.Unlock()
+		return cached.keys, nil
+	case ok && cached.err != nil && time.Since(cached.failed) < jwksFailureTime:
+		jwksCacheMu.Unlock()
+		return cached.keys, cached.err
+	}
+	if f, ok := jwksFetching[url]; ok {
+		jwksCacheMu.Unlock()
+		<-f.done
+		return f.keys, f.err
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	jwksFetching[url] = f
+	jwksCacheMu.Unlock()
+
+	f.keys, f.err = loadJWKS(url)
+
+	jwksCacheMu.Lock()
+	delete(jwksFetching, url)
+	if f.err == nil {
+		jwksCache[url] = cachedJWKS{keys: f.keys, fetched: time.Now()}
+	} else {
+		if time.Since(cached.fetched) > jwksMaxStale {
+			cached.keys = nil
+		}
+		cached.err, cached.failed = f.err, time.Now()
+		jwksCache[url] = cached
+		f.keys = cached.keys
+	}
+	jwksCacheMu.Unlock()
+	close(f.done)
+	return f.keys, f.err
+}
+
+// loadJWKS fetches the JWKS document at a URL and returns its usable keys
+func loadJWKS(url string) ([]agentCredential, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	var set jwks
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	var keys []agentCredential
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if c, err := k.credential(); err == nil {
+			keys = append(keys, c)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ed25519JWK returns a new ed25519 key and its JWK
+func ed25519JWK(t *testing.T) (ed25519.PrivateKey, jwk) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, jwk{Kty: "OKP", Crv: "Ed25519", X: b64Encode(pub)}
+}
+
+// p256JWK returns a new P-256 key and its JWK
+func p256JWK(t *testing.T) (*ecdsa.PrivateKey, jwk) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := elliptic.Marshal(elliptic.P256(), priv.X, priv.Y)
+	return priv, jwk{Kty: "EC", Crv: "P-256", X: b64Encode(point[1:33]), Y: b64Encode(point[33:])}
+}
+
+// signedJWT signs claims with a private key, naming its kid in the header
+func signedJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestEdDSASignVerify(t *testing.T) {
+	priv, k := ed25519JWK(t)
+	c, err := k.credential()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Alg != "EdDSA" {
+		t.Errorf("got alg %s want EdDSA", c.Alg)
+	}
+
+	tokenString := signedJWT(t, edDSA, "", priv, jwt.MapClaims{"did": "a DID"})
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return c.Key, nil
+	})
+	if err != nil || !token.Valid {
+		t.Errorf("EdDSA JWT did not verify: %v", err)
+	}
+
+	other, _ := ed25519JWK(t)
+	if _, err = jwt.Parse(signedJWT(t, edDSA, "", other, jwt.MapClaims{}), func(token *jwt.Token) (interface{}, error) {
+		return c.Key, nil
+	}); err == nil {
+		t.Errorf("EdDSA JWT signed with another key verified")
+	}
+}
+
+func TestJWKCredential(t *testing.T) {
+	_, edKey := ed25519JWK(t)
+	_, ecKey := p256JWK(t)
+	offCurve := ecKey
+	offCurve.Y = ecKey.X
+
+	tests := []struct {
+		name string
+		key  jwk
+		alg  string
+		err  string
+	}{
+		{"ed25519", edKey, "EdDSA", ""},
+		{"P-256", ecKey, "ES256", ""},
+		{"short ed25519", jwk{Kty: "OKP", Crv: "Ed25519", X: b64Encode([]byte("short"))}, "", "Ed25519 key size incorrect"},
+		{"off curve", offCurve, "", "P-256 key is not valid"},
+		{"RSA", jwk{Kty: "RSA"}, "", "key type RSA  is not supported, use OKP Ed25519 or EC P-256"},
+		{"alg mismatch", jwk{Kty: edKey.Kty, Crv: edKey.Crv, X: edKey.X, Alg: "ES256"}, "", "alg ES256 does not match the key type"},
+	}
+	for _, test := range tests {
+		c, err := test.key.credential()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%s: got error %v want %q", test.name, err, test.err)
+		case test.err == "" && c.Alg != test.alg:
+			t.Errorf("%s: got alg %s want %s", test.name, c.Alg, test.alg)
+		}
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	k := jwk{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if got, want := k.thumbprint(), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+		t.Errorf("got thumbprint %s want %s", got, want)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	_, k := ed25519JWK(t)
+	single, _ := json.Marshal(k)
+	set, _ := json.Marshal(jwks{Keys: []jwk{k, k}})
+
+	if keys, err := parseKeys(single); err != nil || len(keys) != 1 || keys[0].X != k.X {
+		t.Errorf("single JWK: got %v, %v", keys, err)
+	}
+	if keys, err := parseKeys(set); err != nil || len(keys) != 2 {
+		t.Errorf("JWKS: got %v, %v", keys, err)
+	}
+	if _, err := parseKeys([]byte("not a key")); err == nil {
+		t.Errorf("parsed a key from invalid JSON")
+	}
+}
+
+func TestFetchJWKS(t *testing.T) {
+	_, edKey := ed25519JWK(t)
+	_, ecKey := p256JWK(t)
+	ecKey.Use = "enc"
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{edKey, ecKey}})
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		keys, err := fetchJWKS(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the encryption key is skipped
+		if len(keys) != 1 || keys[0].Alg != "EdDSA" {
+			t.Errorf("got keys %v want the ed25519 key", keys)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want it cached after the first", fetches)
+	}
+}
+
+func TestFetchJWKSConcurrent(t *testing.T) {
+	_, edKey := ed25519JWK(t)
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{edKey}})
+	}))
+	defer server.Close()
+
+	// requests for a URL being fetched wait for that fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if keys, err := fetchJWKS(server.URL); err != nil || len(keys) != 1 {
+				t.Errorf("got keys %v with error %v", keys, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("JWKS fetched %d times, want one fetch shared", n)
+	}
+}
+
+func TestFetchJWKSFailure(t *testing.T) {
+	_, edKey := ed25519JWK(t)
+	fetches, failing := 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{edKey}})
+	}))
+	defer server.Close()
+
+	if _, err := fetchJWKS(server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the cached keys are due a refresh that fails, they are still served
+	failing = true
+	jwksCacheMu.Lock()
+	cached := jwksCache[server.URL]
+	cached.fetched = time.Now().Add(-jwksCacheTime)
+	jwksCache[server.URL] = cached
+	jwksCacheMu.Unlock()
+	for i := 0; i < 2; i++ {
+		keys, err := fetchJWKS(server.URL)
+		if err == nil || len(keys) != 1 {
+			t.Errorf("got keys %v with error %v, want the stale key and the error", keys, err)
+		}
+	}
+	// and the failure is cached too
+	if fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want the failure cached", fetches)
+	}
+
+	// keys too old aren't served
+	jwksCacheMu.Lock()
+	cached = jwksCache[server.URL]
+	cached.fetched, cached.failed = time.Now().Add(-jwksMaxStale), time.Time{}
+	jwksCache[server.URL] = cached
+	jwksCacheMu.Unlock()
+	if keys, err := fetchJWKS(server.URL); err == nil || len(keys) != 0 {
+		t.Errorf("got keys %v with error %v, want no keys", keys, err)
+	}
+}
+
+func TestAgentKeys(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	agentkey := "a-keyed-agent"
+	if err = createAgent(agentkey, "A Keyed Agent", []string{scopeRegister}, agentQuotas{}); err != nil {
+		t.Fatalf("createAgent failed: %v", err)
+	}
+	edPriv, edKey := ed25519JWK(t)
+	ecPriv, ecKey := p256JWK(t)
+	ecKey.Kid = "p256-key"
+	edKid, err := addAgentKey(agentkey, edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edKid != edKey.thumbprint() {
+		t.Errorf("got kid %s want the key's thumbprint", edKid)
+	}
+	if _, err = addAgentKey(agentkey, ecKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = addAgentKey(agentkey, ecKey); err == nil {
+		t.Errorf("added a key with a kid the agent already has")
+	}
+
+	claims := jwt.MapClaims{"did": "a DID"}
+	if _, err = parseAgentJWT(signedJWT(t, edDSA, edKid, edPriv, claims), agentkey, scopeRegister, jwt.MapClaims{}); err != nil {
+		t.Errorf("EdDSA JWT did not parse: %v", err)
+	}
+	if _, err = parseAgentJWT(signedJWT(t, jwt.SigningMethodES256, "p256-key", ecPriv, claims), agentkey, scopeRegister, jwt.MapClaims{}); err != nil {
+		t.Errorf("ES256 JWT did not parse: %v", err)
+	}
+	// without a kid every key of the JWT's alg is tried
+	if _, err = parseAgentJWT(signedJWT(t, edDSA, "", edPriv, claims), agentkey, scopeRegister, jwt.MapClaims{}); err != nil {
+		t.Errorf("EdDSA JWT without a kid did not parse: %v", err)
+	}
+
+	otherPriv, _ := ed25519JWK(t)
+	if _, err = parseAgentJWT(signedJWT(t, edDSA, edKid, otherPriv, claims), agentkey, scopeRegister, jwt.MapClaims{}); err == nil {
+		t.Errorf("JWT signed with an unregistered key parsed")
+	}
+
+	a, err := getAgent(agentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Keys) != 2 {
+		t.Errorf("got %d agent keys want 2", len(a.Keys))
+	}
+	for _, k := range a.Keys {
+		if k.Kid == edKid && k.LastUsed == nil {
+			t.Errorf("key last_used was not recorded")
+		}
+	}
+
+	if err = revokeAgentKey(agentkey, edKid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseAgentJWT(signedJWT(t, edDSA, edKid, edPriv, claims), agentkey, scopeRegister, jwt.MapClaims{}); err == nil {
+		t.Errorf("JWT signed with a revoked key parsed")
+	}
+	if err = revokeAgentKey(agentkey, edKid); err == nil || err.Error() != "active agent key not found" {
+		t.Errorf("got error %v revoking a revoked key", err)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM agents")
+	stmt.Exec()
+}
@@ -17,13 +17,73 @@ func agentRegister(w http.ResponseWriter, r *http.Request) {
 	}
 	var agentRegistration AgentRegistration
 	if err := json.NewDecoder(r.Body).Decode(&agentRegistration); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
+	// a client certificate can stand in for the agentkey
+	agentkey, byCert, err := requestAgent(r, agentRegistration.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+
+	id, p := agentRegisterDID(agentkey, byCert, agentRegistration.Registration)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%q}`, id)
+}
+
+// agentRegisterDID records the DID in an agent's registration JWT as verified, returning its id
+func agentRegisterDID(agentkey string, byCert bool, tokenString string) (string, *problem) {
+	// validate the registration, then check that the agent is within its quotas
+	registration, p := agentRegistrationFrom(tokenString, agentkey, byCert)
+	if p != nil {
+		return "", p
+	}
+	if _, p = recordWithinQuota(agentkey, registration); p != nil {
+		return "", p
+	}
+	return registration.DID.ID, nil
+}
+
+// recordWithinQuota reserves registrations against an agent's quotas and records them, all in
+// one transaction, so that they only count against the quotas if they are all recorded. When
+// one fails to record it returns that registration's index with the problem, otherwise -1.
+func recordWithinQuota(agentkey string, registrations ...*Registration) (int, *problem) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return -1, databaseProblem("b")
+	}
+	if err = reserveRegistrations(tx, agentkey, len(registrations)); err != nil {
+		tx.Rollback()
+		return -1, quotaProblem(err)
+	}
+	for i, registration := range registrations {
+		if err = recordDIDWith(tx, registration); err != nil {
+			tx.Rollback()
+			return i, newProblem(http.StatusBadRequest, codeRecordFailed, err.Error())
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return -1, databaseProblem("c")
+	}
+	return -1, nil
+}
+
+// agentRegistrationFrom parses and validates an agent's registration JWT, returning the
+// registration to record or the problem to respond with. Agents identified by their client
+// certificate needn't sign the JWT.
+func agentRegistrationFrom(tokenString string, agentkey string, byCert bool) (*Registration, *problem) {
 	type regSecret struct {
 		Cyphertext string `json:"cyphertext"`
 		Nonce      string `json:"nonce"`
+		Format     string `json:"format"`
 	}
 
 	type ConfirmClaims struct {
@@ -34,34 +94,19 @@ func agentRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse the JWT
-	token, err := jwt.ParseWithClaims(agentRegistration.Registration, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		hmacSecret, err := apiAuthSecret(agentRegistration.AgentKey)
-		if err != nil {
-			return nil, err
-		}
-		return hmacSecret, nil
-	})
-
+	parse := parseAgentJWT
+	if byCert {
+		parse = parseCertAgentJWT
+	}
+	token, err := parse(tokenString, agentkey, scopeRegister, &ConfirmClaims{})
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT-%s"}`, err)
-		return
+		return nil, newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
 	}
 
 	// check that the JWT is valid and save local claims var into claimsData
-	var claimsData *ConfirmClaims
-	if claims, ok := token.Claims.(*ConfirmClaims); ok && token.Valid {
-		claimsData = claims
-	} else {
-		// if JWT is not valid
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"Registration JWT invalid"}`)
-		return
+	claimsData, ok := token.Claims.(*ConfirmClaims)
+	if !ok || !token.Valid {
+		return nil, newProblem(http.StatusUnauthorized, codeJWTInvalid, "Registration JWT invalid")
 	}
 
 	// enter data into a registration struct
@@ -70,14 +115,12 @@ func agentRegister(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal([]byte(claimsData.DID), &registration.DID)
 	registration.Secret.Cyphertext = claimsData.Secret.Cyphertext
 	registration.Secret.Nonce = claimsData.Secret.Nonce
+	registration.Secret.Format = claimsData.Secret.Format
 	registration.Signature = claimsData.Signature
 	registration.Raw = rawDID
 	registration.Root = registration.DID.ID
 	registration.Status = "verified"
-	registration.AgentID = agentRegistration.AgentKey
-
-	// master key that the secret is encrypted with
-	registration.Secret.MasterKey = Conf.Keys.Public
+	registration.AgentID = agentkey
 
 	// validate the registration
 	var errResult *multierror.Error
@@ -95,23 +138,7 @@ func agentRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if errResult.ErrorOrNil() != nil {
-		errResult.ErrorFormat = formatErrors
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, errResult.Error())
-		return
-	}
-
-	// record the DID
-	if err = recordDID(&registration); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, err.Error())
-		return
+		return nil, validationProblem(http.StatusBadRequest, errResult)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"success":"true", "id":%q}`, registration.DID.ID)
-
+	return &registration, nil
 }
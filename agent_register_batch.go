@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchRegistrations limits how many registrations one batch request may carry
+const maxBatchRegistrations = 1000
+
+// maxRegistrationJWT is the largest registration JWT expected in a batch, and maxBatchBody the
+// largest batch request body, which is read no further
+const (
+	maxRegistrationJWT = 8 << 10
+	maxBatchBody       = maxBatchRegistrations * maxRegistrationJWT
+)
+
+// batchResult is the outcome of one registration in a batch, in the order they were sent
+type batchResult struct {
+	Index   int               `json:"index"`
+	Success bool              `json:"success"`
+	ID      string            `json:"id,omitempty"`
+	Status  int               `json:"status"`
+	Code    string            `json:"code,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Errors  []validationError `json:"errors,omitempty"`
+}
+
+// fail records the problem with a registration in its result
+func (res *batchResult) fail(p *problem) {
+	res.Status, res.Code, res.Error, res.Errors = p.Status, p.Code, p.Detail, p.Errors
+}
+
+// Register many DIDs for an agent at once, each a registration JWT as sent to /agentRegister.
+// An atomic batch is recorded in one transaction, all or nothing; otherwise each registration
+// is recorded or refused on its own.
+func agentRegisterBatch(w http.ResponseWriter, r *http.Request) {
+	type BatchRequest struct {
+		AgentKey      string   `json:"agentkey"`
+		Registrations []string `json:"registrations"`
+		Atomic        bool     `json:"atomic"`
+	}
+	var batchRequest BatchRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+	if err := json.NewDecoder(r.Body).Decode(&batchRequest); err != nil {
+		writeBodyProblem(w, err, maxBatchBody)
+		return
+	}
+
+	switch n := len(batchRequest.Registrations); {
+	case n == 0:
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "registrations must not be empty")
+		return
+	case n > maxBatchRegistrations:
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("a batch holds at most %d registrations", maxBatchRegistrations))
+		return
+	}
+
+	agentkey, byCert, err := requestAgent(r, batchRequest.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+
+	if !batchRequest.Atomic {
+		writeBatchResults(w, http.StatusOK, recordBatchEach(agentkey, byCert, batchRequest.Registrations))
+		return
+	}
+	results, p := recordBatchAtomic(agentkey, byCert, batchRequest.Registrations)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeBatchResults(w, http.StatusCreated, results)
+}
+
+// recordBatchEach validates and records each registration in turn, as /agentRegister would
+func recordBatchEach(agentkey string, byCert bool, registrations []string) []batchResult {
+	results := make([]batchResult, len(registrations))
+	for i, tokenString := range registrations {
+		results[i] = batchResult{Index: i}
+		registration, p := agentRegistrationFrom(tokenString, agentkey, byCert)
+		if p == nil {
+			_, p = recordWithinQuota(agentkey, registration)
+		}
+		if p != nil {
+			results[i].fail(p)
+			continue
+		}
+		results[i].Success, results[i].ID, results[i].Status = true, registration.DID.ID, http.StatusCreated
+	}
+	return results
+}
+
+// recordBatchAtomic validates every registration, then records them all in one transaction.
+// Nothing is recorded unless every registration is, and the problem lists the results otherwise.
+func recordBatchAtomic(agentkey string, byCert bool, registrations []string) ([]batchResult, *problem) {
+	results := make([]batchResult, len(registrations))
+	valid := make([]*Registration, len(registrations))
+	failed := false
+	for i, tokenString := range registrations {
+		results[i] = batchResult{Index: i}
+		registration, p := agentRegistrationFrom(tokenString, agentkey, byCert)
+		if p != nil {
+			results[i].fail(p)
+			failed = true
+			continue
+		}
+		valid[i] = registration
+	}
+	if failed {
+		return nil, rollBackBatch(results)
+	}
+
+	// the whole batch must fit in the agent's quotas
+	if i, p := recordWithinQuota(agentkey, valid...); p != nil {
+		if i < 0 {
+			return nil, p
+		}
+		results[i].fail(p)
+		return nil, rollBackBatch(results)
+	}
+
+	for i, registration := range valid {
+		results[i].Success, results[i].ID, results[i].Status = true, registration.DID.ID, http.StatusCreated
+	}
+	return results, nil
+}
+
+// rollBackBatch is the problem with an atomic batch that wasn't recorded because of the failed
+// results in it
+func rollBackBatch(results []batchResult) *problem {
+	for i := range results {
+		if results[i].Error == "" {
+			results[i].fail(newProblem(http.StatusFailedDependency, codeBatchNotRecorded, "not recorded, another registration in the batch failed"))
+		}
+	}
+	p := newProblem(http.StatusBadRequest, codeBatchNotRecorded, "batch not recorded")
+	p.Results = results
+	return p
+}
+
+// batchRecorded counts the registrations in a batch that were recorded
+func batchRecorded(results []batchResult) int {
+	recorded := 0
+	for _, res := range results {
+		if res.Success {
+			recorded++
+		}
+	}
+	return recorded
+}
+
+func writeBatchResults(w http.ResponseWriter, status int, results []batchResult) {
+	recorded := batchRecorded(results)
+	jsn, _ := json.Marshal(results)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"success":true, "recorded":%d, "failed":%d, "results":%s}`, recorded, len(results)-recorded, jsn)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/ed25519"
+)
+
+// batchRegistration builds an agent registration JWT for a new DID, returning the DID's id and the JWT
+func batchRegistration(t *testing.T, seed string) (string, string) {
+	signingKey := ed25519.NewKeyFromSeed(getHash(seed))
+	signingPub := b64Encode(signingKey.Public().(ed25519.PublicKey))
+	cypher, nonce, encryptingPub := sealToMaster([]byte("registration secret "+seed), Conf.Keys.Public)
+	id := "did:jlinc:" + signingPub
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	doc, _ := json.Marshal(map[string]interface{}{
+		"@context": Conf.At.ContextV1,
+		"id":       id,
+		"created":  created,
+		"publicKey": []map[string]string{
+			{"id": id + "#signing", "type": "ed25519", "owner": id, "publicKeyBase64": signingPub},
+			{"id": id + "#encrypting", "type": "curve25519", "owner": id, "publicKeyBase64": encryptingPub},
+		},
+	})
+	token := agentJWT(t, Conf.APIAuth[testAgentKey], jwt.MapClaims{
+		"did":       string(doc),
+		"signature": b64Encode(ed25519.Sign(signingKey, getHash(id+"."+created))),
+		"secret":    map[string]string{"cyphertext": cypher, "nonce": nonce, "format": secretFormatBox},
+	})
+	return id, token
+}
+
+func agentRegisterBatchRequest(t *testing.T, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/agentRegisterBatch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(agentRegisterBatch).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAgentRegisterBatchInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no input", "", http.StatusUnprocessableEntity},
+		{"empty batch", `{"agentkey":"an agent","registrations":[]}`, http.StatusBadRequest},
+		{"too many", fmt.Sprintf(`{"agentkey":"an agent","registrations":[%s""]}`, strings.Repeat(`"",`, maxBatchRegistrations)), http.StatusRequestEntityTooLarge},
+		{"too large", fmt.Sprintf(`{"agentkey":"an agent","registrations":[%q]}`, strings.Repeat("x", maxBatchBody)), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		if rr := agentRegisterBatchRequest(t, test.body); rr.Code != test.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, rr.Code, test.status)
+		}
+	}
+}
+
+func TestAgentRegisterBatch(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	type batchResponse struct {
+		Recorded int           `json:"recorded"`
+		Failed   int           `json:"failed"`
+		Results  []batchResult `json:"results"`
+	}
+	batch := func(atomic bool, tokens ...string) (*httptest.ResponseRecorder, batchResponse) {
+		registrations, _ := json.Marshal(tokens)
+		rr := agentRegisterBatchRequest(t, fmt.Sprintf(`{"agentkey":%q,"registrations":%s,"atomic":%v}`, testAgentKey, registrations, atomic))
+		var response batchResponse
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr, response
+	}
+	registered := func(id string) bool {
+		var found bool
+		DB.QueryRow("SELECT true FROM didstore WHERE id = $1 AND agent_id = $2", id, testAgentKey).Scan(&found)
+		return found
+	}
+
+	// each registration in a batch stands on its own
+	firstID, first := batchRegistration(t, "batch test key 1")
+	secondID, second := batchRegistration(t, "batch test key 2")
+	rr, response := batch(false, first, "not a JWT", second)
+	if rr.Code != http.StatusOK || response.Recorded != 2 || response.Failed != 1 {
+		t.Errorf("batch not recorded per item: got %v %s", rr.Code, rr.Body.String())
+	}
+	if len(response.Results) == 3 {
+		if !response.Results[0].Success || response.Results[0].ID != firstID || response.Results[1].Success || response.Results[1].Status != http.StatusUnauthorized {
+			t.Errorf("unexpected results: %+v", response.Results)
+		}
+	}
+	if !registered(firstID) || !registered(secondID) {
+		t.Errorf("valid registrations in the batch were not recorded")
+	}
+
+	// an atomic batch is recorded all together or not at all
+	thirdID, third := batchRegistration(t, "batch test key 3")
+	rr, response = batch(true, third, first)
+	if rr.Code != http.StatusBadRequest || len(response.Results) != 2 || response.Results[0].Status != http.StatusFailedDependency {
+		t.Errorf("atomic batch with a duplicate DID: got %v %s", rr.Code, rr.Body.String())
+	}
+	if registered(thirdID) {
+		t.Errorf("registration recorded from a failed atomic batch")
+	}
+
+	fourthID, fourth := batchRegistration(t, "batch test key 4")
+	rr, response = batch(true, third, fourth)
+	if rr.Code != http.StatusCreated || response.Recorded != 2 {
+		t.Errorf("atomic batch not recorded: got %v %s", rr.Code, rr.Body.String())
+	}
+	if !registered(thirdID) || !registered(fourthID) {
+		t.Errorf("atomic batch registrations were not recorded")
+	}
+
+	var count int
+	DB.QueryRow("SELECT count FROM agent_usage WHERE agent_id = $1 AND day = current_date AND operation = $2", testAgentKey, usageRegister).Scan(&count)
+	if count != 4 {
+		t.Errorf("got %d registrations in usage want 4", count)
+	}
+
+	// delete previous entries from the test database
+	for _, table := range []string{"didstore", "agent_usage"} {
+		stmt, _ := DB.Prepare("DELETE FROM " + table)
+		stmt.Exec()
+	}
+}
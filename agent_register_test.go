@@ -31,12 +31,11 @@ func TestNoAgentRegisterInput(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
 	}
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "text/plain; charset=utf-8")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
-	expected := `Not valid JSON
-`
+	expected := problemJSON(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -47,6 +46,14 @@ func TestAgentRegisterBadJWTSignature(t *testing.T) {
 		log.Fatal(err)
 		return
 	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
 
 	input := strings.NewReader(`{"agentkey":"74fb5cf4f8ce852e143e2859d61b7df5c6572edbbb580e71395d3266506face7","registration":"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJkaWQiOiJ7XCJAY29udGV4dFwiOlwiaHR0cHM6Ly93M2lkLm9yZy9kaWQvdjFcIixcImlkXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MFwiLFwiY3JlYXRlZFwiOlwiMjAxOS0wMS0xOVQyMTo1OToyNC4zMDlaXCIsXCJwdWJsaWNLZXlcIjpbe1wiaWRcIjpcImRpZDpqbGluYzpONTR6MTNka3JJNTZFT3lJZHlNWmxHOHIyZUZnWVlvdVZUM0gwUHJYNDkwI3NpZ25pbmdcIixcInR5cGVcIjpcImVkMjU1MTlcIixcIm93bmVyXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MFwiLFwicHVibGljS2V5QmFzZTY0XCI6XCJONTR6MTNka3JJNTZFT3lJZHlNWmxHOHIyZUZnWVlvdVZUM0gwUHJYNDkwXCJ9LHtcImlkXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MCNlbmNyeXB0aW5nXCIsXCJ0eXBlXCI6XCJjdXJ2ZTI1NTE5XCIsXCJvd25lclwiOlwiZGlkOmpsaW5jOk41NHoxM2Rrckk1NkVPeUlkeU1abEc4cjJlRmdZWW91VlQzSDBQclg0OTBcIixcInB1YmxpY0tleUJhc2U2NFwiOlwid0R1S2lQQzAyWGJJYjZkdHBqVFR5YkR4ZTNxc1FzdkFDcnhzYzN5UGoyMFwifV19Iiwic2lnbmF0dXJlIjoiSUNwTUlhTGFKa1N5ckU4YmpBU0huNERhejZIQmNIcVc1OGNTUkNuQzJqdENqT01mMlJMU0d1Z01EaU84WjNzeDhfVlhvQ01XRGRRWnhzMDZiMWhWQXciLCJzZWNyZXQiOnsiY3lwaGVydGV4dCI6IkFBQUFBQUFBQUFBQUFBQUFBQUFBQU9takNpejhUZDhoX1ZPbFVPZjRKdHFoU2x6WnNSV1dwaGZHNXNVRmNKbHpUeE1TMV92Z3lmNmtNN0xQUlF2OGtLVkptOUVqLThFc0ROVTRuYU5wdjM1MUM3UVNqZmpNTXBUd2UxR2RIVG5BIiwibm9uY2UiOiJ0R2pNRWstZmh4UF9kQ3Brb2RWbUUwNE9zSEwxZUhfcSJ9LCJpYXQiOjE1NDc5MzUxNjR9.n8rOyusQjRrKo0Pjv79SY0-nEn0gYR8Q7PdqjQFBVtU"}`)
 
@@ -60,15 +67,15 @@ func TestAgentRegisterBadJWTSignature(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
 	}
 
-	expected := `{"success":"false", "error":"JWT-signature is invalid"}`
+	expected := problemJSON(http.StatusUnauthorized, codeJWTInvalid, "JWT-signature is invalid")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -79,6 +86,14 @@ func TestUnknownAgentRegisterInput(t *testing.T) {
 		log.Fatal(err)
 		return
 	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
 
 	input := strings.NewReader(`{"agentkey":"ab373311c9047728c1be7137b51c513bea97fc5764411becc7c0a7ec1c7053ea","registration":"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJkaWQiOiJ7XCJAY29udGV4dFwiOlwiaHR0cHM6Ly93M2lkLm9yZy9kaWQvdjFcIixcImlkXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MFwiLFwiY3JlYXRlZFwiOlwiMjAxOS0wMS0xOVQyMTo1OToyNC4zMDlaXCIsXCJwdWJsaWNLZXlcIjpbe1wiaWRcIjpcImRpZDpqbGluYzpONTR6MTNka3JJNTZFT3lJZHlNWmxHOHIyZUZnWVlvdVZUM0gwUHJYNDkwI3NpZ25pbmdcIixcInR5cGVcIjpcImVkMjU1MTlcIixcIm93bmVyXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MFwiLFwicHVibGljS2V5QmFzZTY0XCI6XCJONTR6MTNka3JJNTZFT3lJZHlNWmxHOHIyZUZnWVlvdVZUM0gwUHJYNDkwXCJ9LHtcImlkXCI6XCJkaWQ6amxpbmM6TjU0ejEzZGtySTU2RU95SWR5TVpsRzhyMmVGZ1lZb3VWVDNIMFByWDQ5MCNlbmNyeXB0aW5nXCIsXCJ0eXBlXCI6XCJjdXJ2ZTI1NTE5XCIsXCJvd25lclwiOlwiZGlkOmpsaW5jOk41NHoxM2Rrckk1NkVPeUlkeU1abEc4cjJlRmdZWW91VlQzSDBQclg0OTBcIixcInB1YmxpY0tleUJhc2U2NFwiOlwid0R1S2lQQzAyWGJJYjZkdHBqVFR5YkR4ZTNxc1FzdkFDcnhzYzN5UGoyMFwifV19Iiwic2lnbmF0dXJlIjoiSUNwTUlhTGFKa1N5ckU4YmpBU0huNERhejZIQmNIcVc1OGNTUkNuQzJqdENqT01mMlJMU0d1Z01EaU84WjNzeDhfVlhvQ01XRGRRWnhzMDZiMWhWQXciLCJzZWNyZXQiOnsiY3lwaGVydGV4dCI6IkFBQUFBQUFBQUFBQUFBQUFBQUFBQU9takNpejhUZDhoX1ZPbFVPZjRKdHFoU2x6WnNSV1dwaGZHNXNVRmNKbHpUeE1TMV92Z3lmNmtNN0xQUlF2OGtLVkptOUVqLThFc0ROVTRuYU5wdjM1MUM3UVNqZmpNTXBUd2UxR2RIVG5BIiwibm9uY2UiOiJ0R2pNRWstZmh4UF9kQ3Brb2RWbUUwNE9zSEwxZUhfcSJ9LCJpYXQiOjE1NDc5MzUxNjR9.n8rOyusQjRrKo0Pjv79SY2-nEn0gYR8Q7PdqjQFBVtU"}`)
 
@@ -92,15 +107,15 @@ func TestUnknownAgentRegisterInput(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
 	}
 
-	expected := `{"success":"false", "error":"JWT-agentkey not found"}`
+	expected := problemJSON(http.StatusUnauthorized, codeJWTInvalid, "JWT-agentkey not found")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -143,7 +158,7 @@ func TestGoodAgentRegisterInput(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
 	}
 
-	goodBody := regexp.MustCompile(`^\{"success":"true", "id":"did:jlinc:[\w\-]+"\}$`)
+	goodBody := regexp.MustCompile(`^\{"success":true, "id":"did:jlinc:[\w\-]+"\}$`)
 	if !goodBody.MatchString(rr.Body.String()) {
 		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
 	}
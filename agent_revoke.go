@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+// Revoke a DID that the agent registered, on behalf of its user
+func agentRevoke(w http.ResponseWriter, r *http.Request) {
+	type AgentRevoke struct {
+		AgentKey    string `json:"agentkey"`
+		TokenString string `json:"revokeRequest"`
+	}
+	var agentRevoke AgentRevoke
+	if err := json.NewDecoder(r.Body).Decode(&agentRevoke); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+
+	// a client certificate can stand in for the agentkey
+	agentkey, byCert, err := requestAgent(r, agentRevoke.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+
+	id, p := agentRevokeDID(agentkey, byCert, agentRevoke.TokenString)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	// return success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "revoked":%q}`, id)
+}
+
+// agentRevokeDID revokes the DID named in an agent's revoke JWT, returning its id. Agents
+// identified by their client certificate needn't sign the JWT.
+func agentRevokeDID(agentkey string, byCert bool, tokenString string) (string, *problem) {
+	type RevokeClaims struct {
+		ID string `json:"id"`
+		jwt.StandardClaims
+	}
+
+	// parse the JWT
+	parse := parseAgentJWT
+	if byCert {
+		parse = parseCertAgentJWT
+	}
+	token, err := parse(tokenString, agentkey, scopeRevoke, &RevokeClaims{})
+	if err != nil {
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
+	}
+
+	// check that the JWT is valid
+	claims, ok := token.Claims.(*RevokeClaims)
+	if !ok || !token.Valid {
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, "JWT invalid")
+	}
+
+	// the DID must be in the agent's custody
+	_, status, err := agentCustody(agentkey, claims.ID)
+	switch {
+	case err == sql.ErrNoRows: //didn't find it
+		return "", newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
+	case err == errNotAgentDID || err == errSelfCustody:
+		return "", newProblem(http.StatusForbidden, codeForbidden, err.Error())
+	case err != nil: // query error!
+		return "", databaseProblem("q")
+	case status == "superseded": //superseded DIDs stay superseded
+		return "", newProblem(http.StatusConflict, codeDIDSuperseded, "DID superseded")
+	}
+
+	// everything checks, set DB status to revoked
+	_, err = DB.Exec(`UPDATE didstore SET status = 'revoked', modified = NOW() WHERE id = $1 AND status != 'superseded'`, claims.ID)
+	if err != nil {
+		return "", databaseProblem("e")
+	}
+	recordUsage(agentkey, usageRevoke)
+	return claims.ID, nil
+}
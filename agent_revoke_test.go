@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+func agentRevokeRequest(t *testing.T, id string) *httptest.ResponseRecorder {
+	token := agentJWT(t, Conf.APIAuth[testAgentKey], jwt.MapClaims{"id": id})
+	input := fmt.Sprintf(`{"agentkey":%q,"revokeRequest":%q}`, testAgentKey, token)
+
+	req, err := http.NewRequest("POST", "/agentRevoke", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(agentRevoke).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAgentRevoke(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	agentDID := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	otherDID := "did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"
+	insertAgentDID(t, agentDID, testAgentKey)
+	insertAgentDID(t, otherDID, "another agent")
+
+	tests := []struct {
+		id       string
+		status   int
+		expected string
+	}{
+		{"did:jlinc:unknown", http.StatusNotFound, problemJSON(http.StatusNotFound, codeDIDNotFound, "DID not found")},
+		{otherDID, http.StatusForbidden, problemJSON(http.StatusForbidden, codeForbidden, "DID was not registered by this agent")},
+		{agentDID, http.StatusOK, fmt.Sprintf(`{"success":true, "revoked":%q}`, agentDID)},
+	}
+	for _, test := range tests {
+		rr := agentRevokeRequest(t, test.id)
+		if status := rr.Code; status != test.status {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, test.status)
+		}
+		if rr.Body.String() != test.expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), test.expected)
+		}
+	}
+
+	var status string
+	DB.QueryRow("SELECT status FROM didstore WHERE id = $1", agentDID).Scan(&status)
+	if status != "revoked" {
+		t.Errorf("DID was not revoked: got status %q", status)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	multierror "github.com/hashicorp/go-multierror"
+	_ "github.com/lib/pq"
+)
+
+// Supersede a DID that the agent registered, on behalf of its user
+func agentSupersede(w http.ResponseWriter, r *http.Request) {
+	type AgentSupersede struct {
+		AgentKey  string `json:"agentkey"`
+		Supersede string `json:"supersede"`
+	}
+	var agentSupersede AgentSupersede
+	if err := json.NewDecoder(r.Body).Decode(&agentSupersede); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+
+	// a client certificate can stand in for the agentkey
+	agentkey, byCert, err := requestAgent(r, agentSupersede.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+
+	id, p := agentSupersedeDID(agentkey, byCert, agentSupersede.Supersede)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%q}`, id)
+}
+
+// agentSupersedeDID records the DID in an agent's supersede JWT as verified, superseding the
+// DID it names, and returns the new DID's id. Agents identified by their client certificate
+// needn't sign the JWT.
+func agentSupersedeDID(agentkey string, byCert bool, tokenString string) (string, *problem) {
+	type SupersedeClaims struct {
+		DID        string `json:"did"`
+		Signature  string `json:"signature"`
+		Supersedes string `json:"supersedes"`
+		jwt.StandardClaims
+	}
+
+	// parse the JWT
+	parse := parseAgentJWT
+	if byCert {
+		parse = parseCertAgentJWT
+	}
+	token, err := parse(tokenString, agentkey, scopeSupersede, &SupersedeClaims{})
+	if err != nil {
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
+	}
+
+	// check that the JWT is valid and save local claims var into claimsData
+	var claimsData *SupersedeClaims
+	if claims, ok := token.Claims.(*SupersedeClaims); ok && token.Valid {
+		claimsData = claims
+	} else {
+		// if JWT is not valid
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, "Supersede JWT invalid")
+	}
+
+	// enter data into a registration struct
+	var registration Registration
+	json.Unmarshal([]byte(claimsData.DID), &registration.DID)
+	registration.Signature = claimsData.Signature
+	registration.Supersedes = claimsData.Supersedes
+	registration.Raw = claimsData.DID
+	registration.Status = "verified"
+	registration.AgentID = agentkey
+
+	// validate the registration
+	var errResult *multierror.Error
+	if err = validateDIDparams(&registration); err != nil {
+		errResult = multierror.Append(errResult, err)
+	}
+	if err = getDIDkeys(&registration); err != nil {
+		errResult = multierror.Append(errResult, err)
+	}
+	if err = validateDIDsignature(&registration); err != nil {
+		errResult = multierror.Append(errResult, err)
+	}
+
+	if errResult.ErrorOrNil() != nil {
+		return "", validationProblem(http.StatusBadRequest, errResult)
+	}
+
+	// the superseded DID must be an active DID in the agent's custody
+	root, status, err := agentCustody(agentkey, registration.Supersedes)
+	switch {
+	case err == sql.ErrNoRows: //didn't find it
+		return "", newProblem(http.StatusBadRequest, codeSupersedesNotFound, "item to supersede not found")
+	case err == errNotAgentDID || err == errSelfCustody:
+		return "", newProblem(http.StatusForbidden, codeForbidden, err.Error())
+	case err != nil: // query error!
+		return "", databaseProblem("q")
+	case status != "verified": //must be an active DID
+		return "", newProblem(http.StatusConflict, codeSupersedesNotActive, "item to supersede not active")
+	}
+	registration.Root = root
+
+	// check the quota, record the DID and supersede the old one together, so that concurrent
+	// supersedes can't go over the quota or leave two verified successors
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", databaseProblem("b")
+	}
+	if err = checkSupersedeQuota(tx, agentkey, root); err != nil {
+		tx.Rollback()
+		return "", quotaProblem(err)
+	}
+	if err = recordDIDWith(tx, &registration); err != nil {
+		tx.Rollback()
+		return "", newProblem(http.StatusBadRequest, codeRecordFailed, err.Error())
+	}
+	result, err := tx.Exec(`UPDATE didstore SET superseded_by = $1, superseded_at = NOW(), status = 'superseded', modified = NOW() WHERE id = $2 AND status = 'verified'`, registration.DID.ID, registration.Supersedes)
+	if err != nil {
+		tx.Rollback()
+		return "", databaseProblem("e")
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		tx.Rollback()
+		return "", newProblem(http.StatusConflict, codeSupersedesNotActive, "item to supersede not active")
+	}
+	if err = tx.Commit(); err != nil {
+		return "", databaseProblem("c")
+	}
+	recordUsage(agentkey, usageSupersede)
+	return registration.DID.ID, nil
+}
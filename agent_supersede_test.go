@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const testAgentKey = "74fb5cf4f8ce852e143e2859d61b7df5c6572edbbb580e71395d3266506face7"
+
+// testDID builds a V1 DID document for a signing key, returning its id, the document and its signature
+func testDID(signingKey ed25519.PrivateKey) (string, string, string) {
+	encryptingPub, _, _ := box.GenerateKey(rand.Reader)
+	signingPub := b64Encode(signingKey.Public().(ed25519.PublicKey))
+	id := "did:jlinc:" + signingPub
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	doc, _ := json.Marshal(map[string]interface{}{
+		"@context": Conf.At.ContextV1,
+		"id":       id,
+		"created":  created,
+		"publicKey": []map[string]string{
+			{"id": id + "#signing", "type": "ed25519", "owner": id, "publicKeyBase64": signingPub},
+			{"id": id + "#encrypting", "type": "curve25519", "owner": id, "publicKeyBase64": b64Encode(encryptingPub[:])},
+		},
+	})
+	signature := b64Encode(ed25519.Sign(signingKey, getHash(id+"."+created)))
+	return id, string(doc), signature
+}
+
+// insertAgentDID enters a verified root DID registered by an agent
+func insertAgentDID(t *testing.T, id string, agentkey string) {
+	_, err := DB.Exec(`INSERT INTO didstore (id, root, agent_id, status) VALUES ($1, $1, $2, 'verified')`, id, agentkey)
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+}
+
+func agentSupersedeRequest(t *testing.T, supersedes string, signingKey ed25519.PrivateKey) (string, *httptest.ResponseRecorder) {
+	id, doc, signature := testDID(signingKey)
+	token := agentJWT(t, Conf.APIAuth[testAgentKey], jwt.MapClaims{"did": doc, "signature": signature, "supersedes": supersedes})
+	input := fmt.Sprintf(`{"agentkey":%q,"supersede":%q}`, testAgentKey, token)
+
+	req, err := http.NewRequest("POST", "/agentSupersede", strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(agentSupersede).ServeHTTP(rr, req)
+	return id, rr
+}
+
+func TestNoAgentSupersedeInput(t *testing.T) {
+	req, err := http.NewRequest("POST", "/agentSupersede", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(agentSupersede).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+
+	expected := problemJSON(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestAgentSupersede(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	agentDID := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	otherDID := "did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"
+	insertAgentDID(t, agentDID, testAgentKey)
+	insertAgentDID(t, otherDID, "another agent")
+
+	// DIDs registered by another agent can't be superseded
+	_, rr := agentSupersedeRequest(t, otherDID, ed25519.NewKeyFromSeed(getHash("agent supersede test key 1")))
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	expected := problemJSON(http.StatusForbidden, codeForbidden, "DID was not registered by this agent")
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// the agent's own DID is superseded right away
+	newID, rr := agentSupersedeRequest(t, agentDID, ed25519.NewKeyFromSeed(getHash("agent supersede test key 2")))
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v: %s", status, http.StatusCreated, rr.Body.String())
+	}
+	expected = fmt.Sprintf(`{"success":true, "id":%q}`, newID)
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	var status, supersededBy, root, agentID string
+	DB.QueryRow("SELECT status, superseded_by FROM didstore WHERE id = $1", agentDID).Scan(&status, &supersededBy)
+	if status != "superseded" || supersededBy != newID {
+		t.Errorf("superseded DID not updated: got %q, %q", status, supersededBy)
+	}
+	DB.QueryRow("SELECT status, root, agent_id FROM didstore WHERE id = $1", newID).Scan(&status, &root, &agentID)
+	if status != "verified" || root != agentDID || agentID != testAgentKey {
+		t.Errorf("superseding DID not recorded: got %q, %q, %q", status, root, agentID)
+	}
+
+	// once the user opts out, the agent can't supersede the chain
+	DB.Exec("UPDATE didstore SET self_custody = true WHERE id = $1", agentDID)
+	_, rr = agentSupersedeRequest(t, newID, ed25519.NewKeyFromSeed(getHash("agent supersede test key 3")))
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+	expected = problemJSON(http.StatusForbidden, codeForbidden, "DID is in self custody")
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
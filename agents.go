@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+// what an agent may do with its secrets
+const (
+	scopeRegister  = "register"
+	scopeSupersede = "supersede"
+	scopeRevoke    = "revoke"
+	scopeRead      = "read"
+	scopeInvite    = "invite"
+)
+
+var agentScopes = []string{scopeRegister, scopeSupersede, scopeRevoke, scopeRead, scopeInvite}
+
+func validScope(scope string) bool {
+	return hasScope(agentScopes, scope)
+}
+
+// agentCredential verifies an agent's JWTs: one of its HMAC secrets, or one of its public keys.
+// Credentials from [api_auth] or a JWKS URL have no id.
+type agentCredential struct {
+	ID  int64
+	Kid string
+	Alg string      // "HS" for HMAC secrets, otherwise the JWT alg of the public key
+	Key interface{} // []byte, ed25519.PublicKey or *ecdsa.PublicKey
+}
+
+// verifies reports whether the credential can check a JWT signed with the given method and key id
+func (c agentCredential) verifies(method jwt.SigningMethod, kid string) bool {
+	if c.Alg == "HS" {
+		_, ok := method.(*jwt.SigningMethodHMAC)
+		return ok
+	}
+	return method.Alg() == c.Alg && (kid == "" || c.Kid == "" || kid == c.Kid)
+}
+
+// agentCredentials returns the active credentials of an enabled agent allowed the given scope,
+// or any scope when it's empty, its secrets newest first then its public keys. Agents not in
+// the agents table fall back to [api_auth] in config.toml, which have every scope.
+func agentCredentials(agentkey string, scope string) ([]agentCredential, error) {
+	var enabled bool
+	var scopes []string
+	var jwksURL string
+	err := DB.QueryRow("SELECT enabled, scopes, jwks_url FROM agents WHERE id = $1", agentkey).Scan(&enabled, pq.Array(&scopes), &jwksURL)
+	if err == sql.ErrNoRows {
+		secret, err := apiAuthSecret(agentkey)
+		if err != nil {
+			return nil, err
+		}
+		return []agentCredential{{Alg: "HS", Key: secret}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !enabled {
+		return nil, fmt.Errorf("agent disabled")
+	}
+	if scope != "" && !hasScope(scopes, scope) {
+		return nil, fmt.Errorf("agent not authorized to %s", scope)
+	}
+
+	rows, err := DB.Query("SELECT id, secret, envelope_key, envelope_kek, envelope_master FROM agent_secrets WHERE agent_id = $1 AND revoked IS NULL ORDER BY created DESC, id DESC", agentkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []agentCredential
+	for rows.Next() {
+		var id int64
+		var sealed, envelopeKey, envelopeKEK, envelopeMaster string
+		if err = rows.Scan(&id, &sealed, &envelopeKey, &envelopeKEK, &envelopeMaster); err != nil {
+			return nil, err
+		}
+		env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+		if err == nil {
+			err = env.openValues(&sealed)
+		}
+		if err != nil {
+			log.Printf("agent %s secret %d: %v", agentkey, id, err)
+			continue
+		}
+		credentials = append(credentials, agentCredential{ID: id, Alg: "HS", Key: []byte(sealed)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keys, err := agentPublicKeys(agentkey, jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	credentials = append(credentials, keys...)
+
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("agent has no active secrets or keys")
+	}
+	return credentials, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAgentJWT parses a JWT signed with any of the agent's active credentials, so that a new
+// secret or key can be rolled out before the old one is revoked. JWTs signed with a public key
+// may name it in their kid header.
+func parseAgentJWT(tokenString string, agentkey string, scope string, claims jwt.Claims) (*jwt.Token, error) {
+	credentials, err := agentCredentials(agentkey, scope)
+	if err != nil {
+		// report it the way a failing key lookup inside jwt.Parse would
+		return nil, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorUnverifiable}
+	}
+	token, c, err := verifyAgentJWT(tokenString, credentials, claims)
+	if err == nil && (c.ID != 0 || c.Alg != "HS") {
+		touchAgent(agentkey, c)
+	}
+	return token, err
+}
+
+// agentSigned reports whether a JWT is signed with one of the agent's active credentials,
+// whatever its scopes
+func agentSigned(tokenString string, agentkey string) bool {
+	if tokenString == "" || agentkey == "" {
+		return false
+	}
+	credentials, err := agentCredentials(agentkey, "")
+	if err != nil {
+		return false
+	}
+	_, _, err = verifyAgentJWT(tokenString, credentials, &jwt.MapClaims{})
+	return err == nil
+}
+
+// verifyAgentJWT parses a JWT signed with any of the credentials, returning the one that verified it
+func verifyAgentJWT(tokenString string, credentials []agentCredential, claims jwt.Claims) (*jwt.Token, agentCredential, error) {
+	// the header says which credentials to try
+	unverified, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, agentCredential{}, err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+
+	var token *jwt.Token
+	var verified agentCredential
+	err = &jwt.ValidationError{Inner: fmt.Errorf("Unexpected signing method: %v", unverified.Header["alg"]), Errors: jwt.ValidationErrorUnverifiable}
+	for _, c := range credentials {
+		if !c.verifies(unverified.Method, kid) {
+			continue
+		}
+		token, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			if !c.verifies(token.Method, kid) {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return c.Key, nil
+		})
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
+			continue // try the next credential
+		}
+		verified = c
+		break
+	}
+	return token, verified, err
+}
+
+type agentContextKey string
+
+var agentKey = agentContextKey("agentkey")
+
+// agentAuth authenticates requests that have no body to carry an agentkey, such as GETs.
+// They need a recently issued JWT in the Authorization header, signed with one of the
+// agent's secrets and naming the agent in its iss claim, or an agent's client certificate.
+func agentAuth(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if certAgent := certAgentFrom(r.Context()); certAgent != "" {
+				if err := checkAgentScope(certAgent, scope); err != nil {
+					writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+					return
+				}
+				touchAgent(certAgent, agentCredential{})
+				ctx := context.WithValue(r.Context(), agentKey, certAgent)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			var claims jwt.StandardClaims
+			_, _, err := new(jwt.Parser).ParseUnverified(tokenString, &claims)
+			if err == nil {
+				_, err = parseAgentJWT(tokenString, claims.Issuer, scope, &claims)
+			}
+			if err == nil && !Conf.IsTest {
+				// allow 10 minutes for latency and a minute for clock error, as for DID timestamps
+				issued := time.Unix(claims.IssuedAt, 0)
+				if time.Since(issued) > time.Minute*10 || time.Until(issued) > time.Minute {
+					err = errors.New("iat is out of bounds")
+				}
+			}
+			if err != nil {
+				writeProblem(w, http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
+				return
+			}
+			ctx := context.WithValue(r.Context(), agentKey, claims.Issuer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// agentFrom returns the agentkey set by agentAuth
+func agentFrom(ctx context.Context) string {
+	agentkey, _ := ctx.Value(agentKey).(string)
+	return agentkey
+}
+
+// touchAgent records when an agent and its secret or key were last used
+func touchAgent(agentkey string, c agentCredential) {
+	if _, err := DB.Exec("UPDATE agents SET last_used = NOW() WHERE id = $1", agentkey); err != nil {
+		log.Printf("agent %s: %v", agentkey, err)
+	}
+	if c.ID == 0 {
+		return // a key from the agent's JWKS URL, or a client certificate
+	}
+	table := "agent_secrets"
+	if c.Alg != "HS" {
+		table = "agent_keys"
+	}
+	if _, err := DB.Exec("UPDATE "+table+" SET last_used = NOW() WHERE id = $1", c.ID); err != nil {
+		log.Printf("agent %s %s %d: %v", agentkey, table, c.ID, err)
+	}
+}
+
+var (
+	errAgentNotFound = errors.New("agent not found")
+	errNotAgentDID   = errors.New("DID was not registered by this agent")
+	errSelfCustody   = errors.New("DID is in self custody")
+	// a database agent can't take the id of a configured one, which would shadow it
+	errAgentConfigured = errors.New("an agent with this id is configured in api_auth")
+	errAgentIDReserved = errors.New("agent id is reserved")
+)
+
+// reservedAgentIDs stand for something other than an agent where agents are recorded: invites
+// made through the admin API or command are created by inviteCreatorAdmin
+var reservedAgentIDs = map[string]bool{inviteCreatorAdmin: true}
+
+// agentQuotas limit what an agent may do, zero meaning no limit
+type agentQuotas struct {
+	RegistrationsPerDay  int `json:"registrationsPerDay"`
+	ActiveDIDs           int `json:"activeDIDs"`
+	SupersedesPerDID     int `json:"supersedesPerDID"`
+	SupersedePeriodHours int `json:"supersedePeriodHours"`
+}
+
+// agent is an agents row as shown to admins
+type agent struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Scopes      []string          `json:"scopes"`
+	Enabled     bool              `json:"enabled"`
+	Quotas      agentQuotas       `json:"quotas"`
+	Created     time.Time         `json:"created"`
+	LastUsed    *time.Time        `json:"lastUsed,omitempty"`
+	JWKSURL     string            `json:"jwksURL,omitempty"`
+	CertSubject string            `json:"certSubject,omitempty"`
+	CertSPKI    string            `json:"certSPKI,omitempty"`
+	Secrets     []agentSecretInfo `json:"secrets,omitempty"`
+	Keys        []agentKeyInfo    `json:"keys,omitempty"`
+}
+
+// agentSecretInfo describes an agent secret without revealing it
+type agentSecretInfo struct {
+	ID       int64      `json:"id"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+}
+
+// agentUpdate holds the agent fields to change, nil fields are left as they are
+type agentUpdate struct {
+	Name        *string      `json:"name"`
+	Scopes      []string     `json:"scopes"`
+	Enabled     *bool        `json:"enabled"`
+	Quotas      *agentQuotas `json:"quotas"`
+	JWKSURL     *string      `json:"jwksURL"`
+	CertSubject *string      `json:"certSubject"`
+	CertSPKI    *string      `json:"certSPKI"`
+}
+
+func validScopes(scopes []string) error {
+	for _, s := range scopes {
+		if !validScope(s) {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
+
+func nullTimePtr(t pq.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// newAgentID returns the id for a new agent, generating one when id is empty. Both the admin
+// API and the admin command create agents with it.
+func newAgentID(id string) (string, error) {
+	if id == "" {
+		return newAgentKey()
+	}
+	if reservedAgentIDs[id] {
+		return id, errAgentIDReserved
+	}
+	if _, ok := Conf.APIAuth[id]; ok {
+		return id, errAgentConfigured
+	}
+	return id, nil
+}
+
+// createAgent adds an enabled agent with the given scopes and quotas
+func createAgent(agentkey string, name string, scopes []string, quotas agentQuotas) error {
+	return createAgentWith(DB, agentkey, name, scopes, quotas)
+}
+
+// createAgentWith inserts an agent using db, which may be a transaction
+func createAgentWith(db dbtx, agentkey string, name string, scopes []string, quotas agentQuotas) error {
+	if err := validScopes(scopes); err != nil {
+		return err
+	}
+	if quotas.SupersedePeriodHours == 0 {
+		quotas.SupersedePeriodHours = 24
+	}
+	_, err := db.Exec(`INSERT INTO agents (id, name, scopes, quota_registrations_per_day, quota_active_dids, quota_supersedes_per_did, quota_supersede_period_hours)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		agentkey, name, pq.Array(scopes), quotas.RegistrationsPerDay, quotas.ActiveDIDs, quotas.SupersedesPerDID, quotas.SupersedePeriodHours)
+	return err
+}
+
+// createAgentWithSecret creates an agent and issues its first secret in one transaction, so
+// that a failure doesn't leave an agent behind that nobody can authenticate as
+func createAgentWithSecret(agentkey string, name string, scopes []string, quotas agentQuotas) (int64, string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	if err = createAgentWith(tx, agentkey, name, scopes, quotas); err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	secretID, secret, err := issueAgentSecretWith(tx, agentkey)
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, "", err
+	}
+	return secretID, secret, nil
+}
+
+// isUniqueViolation reports whether err is postgres refusing a duplicate key
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+const agentColumns = "id, name, scopes, enabled, quota_registrations_per_day, quota_active_dids, quota_supersedes_per_did, quota_supersede_period_hours, created, last_used, jwks_url, cert_subject, cert_spki"
+
+func scanAgent(row interface{ Scan(...interface{}) error }) (agent, error) {
+	var a agent
+	var lastUsed pq.NullTime
+	err := row.Scan(&a.ID, &a.Name, pq.Array(&a.Scopes), &a.Enabled, &a.Quotas.RegistrationsPerDay, &a.Quotas.ActiveDIDs,
+		&a.Quotas.SupersedesPerDID, &a.Quotas.SupersedePeriodHours, &a.Created, &lastUsed, &a.JWKSURL, &a.CertSubject, &a.CertSPKI)
+	a.LastUsed = nullTimePtr(lastUsed)
+	return a, err
+}
+
+// getAgent returns an agent along with its secrets and keys, revoked ones included
+func getAgent(agentkey string) (*agent, error) {
+	a, err := scanAgent(DB.QueryRow("SELECT "+agentColumns+" FROM agents WHERE id = $1", agentkey))
+	if err == sql.ErrNoRows {
+		return nil, errAgentNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query("SELECT id, created, last_used, revoked FROM agent_secrets WHERE agent_id = $1 ORDER BY id", agentkey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s agentSecretInfo
+		var lastUsed, revoked pq.NullTime
+		if err = rows.Scan(&s.ID, &s.Created, &lastUsed, &revoked); err != nil {
+			return nil, err
+		}
+		s.LastUsed, s.Revoked = nullTimePtr(lastUsed), nullTimePtr(revoked)
+		a.Secrets = append(a.Secrets, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keyRows, err := DB.Query("SELECT kid, jwk, created, last_used, revoked FROM agent_keys WHERE agent_id = $1 ORDER BY id", agentkey)
+	if err != nil {
+		return nil, err
+	}
+	defer keyRows.Close()
+	for keyRows.Next() {
+		var k agentKeyInfo
+		var stored string
+		var lastUsed, revoked pq.NullTime
+		if err = keyRows.Scan(&k.Kid, &stored, &k.Created, &lastUsed, &revoked); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(stored), &k.JWK)
+		k.LastUsed, k.Revoked = nullTimePtr(lastUsed), nullTimePtr(revoked)
+		a.Keys = append(a.Keys, k)
+	}
+	return &a, keyRows.Err()
+}
+
+// listAgents returns every agent without its secrets
+func listAgents() ([]agent, error) {
+	rows, err := DB.Query("SELECT " + agentColumns + " FROM agents ORDER BY created, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	agents := []agent{}
+	for rows.Next() {
+		a, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, a)
+	}
+	return agents, rows.Err()
+}
+
+// updateAgent changes the given fields of an agent
+func updateAgent(agentkey string, u agentUpdate) error {
+	if err := validScopes(u.Scopes); err != nil {
+		return err
+	}
+	var scopes interface{}
+	if u.Scopes != nil {
+		scopes = pq.Array(u.Scopes)
+	}
+	var quotas agentQuotas
+	if u.Quotas != nil {
+		quotas = *u.Quotas
+	}
+
+	result, err := DB.Exec(`UPDATE agents SET
+		name = COALESCE($2, name),
+		scopes = COALESCE($3, scopes),
+		enabled = COALESCE($4, enabled),
+		quota_registrations_per_day = CASE WHEN $5 THEN $6 ELSE quota_registrations_per_day END,
+		quota_active_dids = CASE WHEN $5 THEN $7 ELSE quota_active_dids END,
+		quota_supersedes_per_did = CASE WHEN $5 THEN $8 ELSE quota_supersedes_per_did END,
+		quota_supersede_period_hours = CASE WHEN $5 AND $9 > 0 THEN $9 ELSE quota_supersede_period_hours END,
+		jwks_url = COALESCE($10, jwks_url),
+		cert_subject = COALESCE($11, cert_subject),
+		cert_spki = COALESCE($12, cert_spki)
+		WHERE id = $1`,
+		agentkey, u.Name, scopes, u.Enabled, u.Quotas != nil,
+		quotas.RegistrationsPerDay, quotas.ActiveDIDs, quotas.SupersedesPerDID, quotas.SupersedePeriodHours, u.JWKSURL,
+		u.CertSubject, u.CertSPKI)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errAgentNotFound
+	}
+	return nil
+}
+
+// revokeAgentSecret stops a secret from being accepted
+func revokeAgentSecret(agentkey string, secretID int64) error {
+	result, err := DB.Exec("UPDATE agent_secrets SET revoked = NOW() WHERE agent_id = $1 AND id = $2 AND revoked IS NULL", agentkey, secretID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("active agent secret not found")
+	}
+	return nil
+}
+
+// agentDID is a DID registered by an agent
+type agentDID struct {
+	ID         string     `json:"id"`
+	Root       string     `json:"root"`
+	Status     string     `json:"status"`
+	Created    time.Time  `json:"created"`
+	Modified   *time.Time `json:"modified,omitempty"`
+	Superseded *time.Time `json:"superseded,omitempty"`
+}
+
+// didFilter narrows a listing of DIDs, zero values matching everything
+type didFilter struct {
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func nullIfZero(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// agentDIDs lists a page of the DIDs an agent registered in the order they were registered,
+// along with the cursor for the next page, which is empty on the last one
+func agentDIDs(agentkey string, f didFilter, p page) ([]agentDID, string, error) {
+	rows, err := DB.Query(`SELECT id, root, status, created, modified, superseded_at, sequence FROM didstore
+		WHERE agent_id = $1 AND sequence > $2 AND ($3 = '' OR status = $3)
+		AND ($4::timestamp IS NULL OR created >= $4) AND ($5::timestamp IS NULL OR created < $5)
+		ORDER BY sequence LIMIT $6`,
+		agentkey, p.After, f.Status, nullIfZero(f.CreatedAfter), nullIfZero(f.CreatedBefore), p.Limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	dids := []agentDID{}
+	var sequence int64
+	var cursor string
+	for rows.Next() {
+		// the extra row only shows there is another page
+		if len(dids) == p.Limit {
+			cursor = nextCursor(sequence)
+			break
+		}
+		var d agentDID
+		var modified, superseded pq.NullTime
+		if err = rows.Scan(&d.ID, &d.Root, &d.Status, &d.Created, &modified, &superseded, &sequence); err != nil {
+			return nil, "", err
+		}
+		d.Modified, d.Superseded = nullTimePtr(modified), nullTimePtr(superseded)
+		dids = append(dids, d)
+	}
+	return dids, cursor, rows.Err()
+}
+
+// issueAgentSecret generates a new secret for an agent, sealed at rest with its own envelope,
+// so it needs a key-encryption key. The secret is only ever returned here.
+func issueAgentSecret(agentkey string) (int64, string, error) {
+	return issueAgentSecretWith(DB, agentkey)
+}
+
+// issueAgentSecretWith issues a secret using db, which may be a transaction
+func issueAgentSecretWith(db dbtx, agentkey string) (int64, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, "", err
+	}
+	secret := b64Encode(raw)
+
+	env, err := newEnvelope()
+	if err != nil {
+		return 0, "", err
+	}
+	sealed, err := env.seal(secret)
+	if err != nil {
+		return 0, "", err
+	}
+	envelopeKey, envelopeKEK, envelopeMaster := env.stored()
+
+	var id int64
+	err = db.QueryRow("INSERT INTO agent_secrets (agent_id, secret, envelope_key, envelope_kek, envelope_master) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		agentkey, sealed, envelopeKey, envelopeKEK, envelopeMaster).Scan(&id)
+	if err != nil {
+		return 0, "", err
+	}
+	return id, secret, nil
+}
+
+// rewrapAgentSecrets moves the envelope keys of agent secrets onto the current key-encryption key
+func rewrapAgentSecrets() (int, error) {
+	if Conf.Keys.KEK == "" {
+		return 0, nil
+	}
+	rows, err := DB.Query("SELECT id, envelope_key, envelope_kek, envelope_master FROM agent_secrets WHERE envelope_key != '' AND envelope_kek != $1", Conf.Keys.KEK)
+	if err != nil {
+		return 0, err
+	}
+
+	type wrapped struct {
+		id                                       int64
+		envelopeKey, envelopeKEK, envelopeMaster string
+	}
+	var pending []wrapped
+	for rows.Next() {
+		var w wrapped
+		if err = rows.Scan(&w.id, &w.envelopeKey, &w.envelopeKEK, &w.envelopeMaster); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, w)
+	}
+	rows.Close()
+
+	for _, w := range pending {
+		env, err := openEnvelope(w.envelopeKey, w.envelopeKEK, w.envelopeMaster)
+		if err == nil {
+			err = env.wrap(Conf.Keys.KEK)
+		}
+		if err != nil {
+			log.Printf("rekey: unable to rewrap agent secret %d: %v", w.id, err)
+			continue
+		}
+		envelopeKey, envelopeKEK, envelopeMaster := env.stored()
+		_, err = DB.Exec("UPDATE agent_secrets SET envelope_key = $1, envelope_kek = $2, envelope_master = $3 WHERE id = $4 AND envelope_key = $5",
+			envelopeKey, envelopeKEK, envelopeMaster, w.id, w.envelopeKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// agentCustody returns the root and status of a DID that an agent may supersede or revoke
+// for its user: one the agent registered, in a chain whose user hasn't opted out of custody
+func agentCustody(agentkey string, id string) (root string, status string, err error) {
+	var agentID string
+	var selfCustody bool
+	err = DB.QueryRow("SELECT s.root, s.status, s.agent_id, r.self_custody FROM didstore AS s JOIN didstore AS r ON s.root = r.id WHERE s.id = $1", id).Scan(&root, &status, &agentID, &selfCustody)
+	switch {
+	case err != nil:
+	case agentID == "" || agentID != agentkey:
+		err = errNotAgentDID
+	case selfCustody:
+		err = errSelfCustody
+	}
+	return root, status, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+// agentJWT signs claims with an agent secret
+func agentJWT(t *testing.T, secret string, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAgentSecrets(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	agentkey := "an-agent"
+	if err = createAgent(agentkey, "An Agent", []string{scopeRegister, scopeRead}, agentQuotas{}); err != nil {
+		t.Fatalf("createAgent failed: %v", err)
+	}
+	if err = createAgent("another-agent", "", []string{"everything"}, agentQuotas{}); err == nil {
+		t.Errorf("agent created with an unknown scope")
+	}
+
+	oldID, oldSecret, err := issueAgentSecret(agentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newSecret, err := issueAgentSecret(agentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both active secrets are accepted while the new one is rolled out
+	for _, secret := range []string{oldSecret, newSecret} {
+		if _, err := parseAgentJWT(agentJWT(t, secret, jwt.MapClaims{"did": "a DID"}), agentkey, scopeRegister, jwt.MapClaims{}); err != nil {
+			t.Errorf("JWT signed with an active secret did not parse: %v", err)
+		}
+	}
+	var lastUsed pq.NullTime
+	DB.QueryRow("SELECT last_used FROM agent_secrets WHERE id = $1", oldID).Scan(&lastUsed)
+	if !lastUsed.Valid {
+		t.Errorf("secret last_used was not recorded")
+	}
+
+	// secrets are sealed at rest
+	var stored string
+	DB.QueryRow("SELECT secret FROM agent_secrets WHERE id = $1", oldID).Scan(&stored)
+	if stored == oldSecret {
+		t.Errorf("agent secret stored in plaintext")
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		scope  string
+		setup  string
+		err    string
+	}{
+		{"wrong secret", "not the secret", scopeRegister, "", "signature is invalid"},
+		{"missing scope", newSecret, scopeRevoke, "", "agent not authorized to revoke"},
+		{"revoked secret", oldSecret, scopeRegister, "UPDATE agent_secrets SET revoked = NOW() WHERE agent_id = $1 AND id = " + fmt.Sprint(oldID), "signature is invalid"},
+		{"disabled agent", newSecret, scopeRegister, "UPDATE agents SET enabled = false WHERE id = $1", "agent disabled"},
+	}
+	for _, test := range tests {
+		if test.setup != "" {
+			DB.Exec(test.setup, agentkey)
+		}
+		_, err := parseAgentJWT(agentJWT(t, test.secret, jwt.MapClaims{"did": "a DID"}), agentkey, test.scope, jwt.MapClaims{})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v want %q", test.name, err, test.err)
+		}
+	}
+
+	// agents in [api_auth] still work
+	for agentkey, secret := range Conf.APIAuth {
+		if _, err := parseAgentJWT(agentJWT(t, secret, jwt.MapClaims{"did": "a DID"}), agentkey, scopeRevoke, jwt.MapClaims{}); err != nil {
+			t.Errorf("JWT signed by a config agent did not parse: %v", err)
+		}
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM agents")
+	stmt.Exec()
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	if !isUniqueViolation(&pq.Error{Code: "23505"}) {
+		t.Errorf("unique_violation not recognized")
+	}
+	if isUniqueViolation(&pq.Error{Code: "23503"}) || isUniqueViolation(sql.ErrNoRows) || isUniqueViolation(nil) {
+		t.Errorf("other errors are not unique violations")
+	}
+}
+
+func TestNewAgentID(t *testing.T) {
+	Conf.APIAuth = map[string]string{"configured": "a-secret"}
+	defer func() { Conf.APIAuth = nil }()
+
+	if id, err := newAgentID(""); err != nil || len(id) != 64 {
+		t.Errorf("agentkey not generated: got %q with error %v", id, err)
+	}
+	if id, err := newAgentID("an-agent"); err != nil || id != "an-agent" {
+		t.Errorf("got %q with error %v", id, err)
+	}
+	if _, err := newAgentID("configured"); err != errAgentConfigured {
+		t.Errorf("configured agent id not refused: %v", err)
+	}
+	if _, err := newAgentID(inviteCreatorAdmin); err != errAgentIDReserved {
+		t.Errorf("reserved agent id not refused: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"text/template"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// newMasterKeypair makes a curve25519 master keypair, base64url encoded as [keys] holds them
+// and decryptRegSecret expects them
+func newMasterKeypair() (keypair, error) {
+	public, secret, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return keypair{}, err
+	}
+	return keypair{Public: b64Encode(public[:]), Secret: b64Encode(secret[:])}, nil
+}
+
+// bootstrap is what didserver init puts in a new config.toml
+type bootstrap struct {
+	ConnectionString string
+	URL              string
+	Port             string
+	Master           keypair
+	KEK              string
+	AgentKey         string
+	AgentSecret      string
+	AdminToken       string
+}
+
+// newBootstrap makes a master keypair, a key-encryption key, test agent credentials and an admin token
+func newBootstrap(connectionString string, url string, port string) (*bootstrap, error) {
+	b := &bootstrap{ConnectionString: connectionString, URL: url, Port: port}
+	var err error
+	if b.Master, err = newMasterKeypair(); err != nil {
+		return nil, err
+	}
+	var kek [32]byte
+	if _, err = rand.Read(kek[:]); err != nil {
+		return nil, err
+	}
+	b.KEK = b64Encode(kek[:])
+	for _, v := range []*string{&b.AgentKey, &b.AgentSecret, &b.AdminToken} {
+		if *v, err = newAgentKey(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+var configTemplate = template.Must(template.New("config.toml").Parse(`[database]
+connection_string = {{printf "%q" .ConnectionString}}
+
+[keys]
+public = {{printf "%q" .Master.Public}}
+secret = {{printf "%q" .Master.Secret}}
+rekey = false # re-encrypt stored secrets to the current key in the background
+envelope = false # seal stored secrets with a per-row data key wrapped by the key-encryption key
+kek = "kek-1"    # the key-encryption key that wraps new data keys, from [keys.keks]
+
+[keys.keks]
+"kek-1" = {{printf "%q" .KEK}}
+
+[at]
+contextV1 = "https://w3id.org/did/v1"
+contextV2 = "https://www.w3.org/ns/did/v1"
+
+[app]
+url = {{printf "%q" .URL}}
+port = {{printf "%q" .Port}}
+registration_mode = "open" # or "invite-only", or "agent-only" to close /register
+
+[pow] # proof of work asked of /register and /supersede
+enabled = false
+difficulty = 20          # leading zero bits
+max_difficulty = 26
+target_per_minute = 60   # puzzles a minute before the difficulty goes up a bit per doubling
+
+[rate_limits] # token buckets per route group, off without a rate
+shared = false           # keep the buckets in the database for every server to share
+
+[openapi] # the document describing the /v2 API, served at /openapi.json
+validate = false         # refuse /v2 requests that don't match it
+
+[admin] # bearer tokens for the /admin API
+tokens = [{{printf "%q" .AdminToken}}]
+
+[api_auth] # apiKey = apiSecret -- a test agent
+{{printf "%q" .AgentKey}} = {{printf "%q" .AgentSecret}}
+`))
+
+// writeConfig writes a config.toml holding the bootstrap's keys and credentials, readable only
+// by its owner. An existing file is only replaced when force is set.
+func (b *bootstrap) writeConfig(path string, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if os.IsExist(err) {
+		return errors.New(path + " already exists, use -force to replace it")
+	}
+	if err != nil {
+		return err
+	}
+	if err = configTemplate.Execute(f, b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
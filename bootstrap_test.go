@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestNewMasterKeypair(t *testing.T) {
+	kp, err := newMasterKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a secret sealed to the public key opens with the secret key, as a registration's would
+	senderPublic, senderSecret, _ := box.GenerateKey(rand.Reader)
+	var nonce [24]byte
+	var master [32]byte
+	rand.Read(nonce[:])
+	copy(master[:], b64Decode(kp.Public))
+	sealed := box.Seal(nil, []byte("registration secret"), &nonce, &master, senderSecret)
+
+	opened, ok := decryptRegSecret(b64Encode(sealed), b64Encode(nonce[:]), secretFormatBoxEasy, b64Encode(senderPublic[:]), b64Decode(kp.Secret))
+	if !ok || string(opened) != "registration secret" {
+		t.Errorf("secret does not decrypt with the new keypair")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+
+	b, err := newBootstrap("postgres://localhost:5432/did?sslmode=disable", "https://did.example.com", ":8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.writeConfig(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("config should only be readable by its owner: %v", info.Mode())
+	}
+
+	var c Config
+	if _, err = toml.DecodeFile(path, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Keys.Public != b.Master.Public || c.Keys.Secret != b.Master.Secret {
+		t.Errorf("master keypair: got %+v", c.Keys)
+	}
+	if c.Keys.KEK == "" || c.Keys.KEKs[c.Keys.KEK] != b.KEK || len(b64Decode(b.KEK)) != 32 {
+		t.Errorf("key-encryption key: got %+v", c.Keys)
+	}
+	if c.APIAuth[b.AgentKey] != b.AgentSecret || len(c.APIAuth) != 1 {
+		t.Errorf("test agent: got %v", c.APIAuth)
+	}
+	if len(c.Admin.Tokens) != 1 || c.Admin.Tokens[0] != b.AdminToken {
+		t.Errorf("admin tokens: got %v", c.Admin.Tokens)
+	}
+	if c.App.URL != "https://did.example.com" || c.App.Port != ":8080" || !validRegistrationMode(c.App.RegistrationMode) {
+		t.Errorf("app: got %+v", c.App)
+	}
+
+	// an existing config is only replaced with force
+	if err = b.writeConfig(path, false); err == nil {
+		t.Errorf("existing config should not be replaced")
+	}
+	if err = b.writeConfig(path, true); err != nil {
+		t.Errorf("forced write: %v", err)
+	}
+}
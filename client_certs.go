@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+// serverTLSConfig returns the TLS config to serve with, asking clients for a certificate
+// signed by one of the client CAs when there are any
+func serverTLSConfig(c tlsConfig) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile == "" {
+		if c.RequireClientCert {
+			return nil, errors.New("require_client_cert needs a client_ca_file")
+		}
+		return config, nil
+	}
+
+	bundle, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certSPKI is the base64url SHA-256 hash of a certificate's public key, which stays
+// the same when the certificate is renewed with the same key
+func certSPKI(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return b64Encode(hash[:])
+}
+
+// pemCertSPKI reads a PEM certificate and returns its SPKI hash
+func pemCertSPKI(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return certSPKI(cert), nil
+}
+
+// agentForCert returns the agent whose cert_spki or cert_subject matches a verified client certificate
+func agentForCert(cert *x509.Certificate) (string, error) {
+	var agentkey string
+	err := DB.QueryRow(`SELECT id FROM agents WHERE (cert_spki != '' AND cert_spki = $1) OR (cert_subject != '' AND cert_subject = $2)
+		ORDER BY cert_spki = $1 DESC LIMIT 1`, certSPKI(cert), cert.Subject.String()).Scan(&agentkey)
+	if err == sql.ErrNoRows {
+		return "", errAgentNotFound
+	}
+	return agentkey, err
+}
+
+type certAgentContextKey string
+
+var certAgentKey = certAgentContextKey("certAgent")
+
+// clientCertAgent identifies the agent a request's verified client certificate belongs to.
+// Requests without one, or with one that isn't an agent's, carry on unidentified.
+func clientCertAgent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		agentkey, err := agentForCert(r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			if err != errAgentNotFound {
+				log.Printf("client certificate: %v", err)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), certAgentKey, agentkey)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// certAgentFrom returns the agent identified by the request's client certificate, if any
+func certAgentFrom(ctx context.Context) string {
+	agentkey, _ := ctx.Value(certAgentKey).(string)
+	return agentkey
+}
+
+// checkAgentScope checks that an agent is enabled and has a scope
+func checkAgentScope(agentkey string, scope string) error {
+	var enabled bool
+	var scopes []string
+	err := DB.QueryRow("SELECT enabled, scopes FROM agents WHERE id = $1", agentkey).Scan(&enabled, pq.Array(&scopes))
+	switch {
+	case err == sql.ErrNoRows:
+		return errAgentNotFound
+	case err != nil:
+		return err
+	case !enabled:
+		return errors.New("agent disabled")
+	case !hasScope(scopes, scope):
+		return fmt.Errorf("agent not authorized to %s", scope)
+	}
+	return nil
+}
+
+// parseCertAgentJWT parses a JWT from an agent authenticated by its client certificate.
+// The TLS connection already vouches for the agent, so the JWT may be unsigned.
+func parseCertAgentJWT(tokenString string, agentkey string, scope string, claims jwt.Claims) (*jwt.Token, error) {
+	if err := checkAgentScope(agentkey, scope); err != nil {
+		return nil, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorUnverifiable}
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, err
+	}
+	if err = claims.Valid(); err != nil {
+		return nil, err
+	}
+	token.Valid = true
+	touchAgent(agentkey, agentCredential{})
+	return token, nil
+}
+
+// requestAgent returns the agent a request is from: the one its client certificate belongs to,
+// or else the agentkey it sent. The two must agree when there are both.
+func requestAgent(r *http.Request, agentkey string) (string, bool, error) {
+	certAgent := certAgentFrom(r.Context())
+	switch {
+	case certAgent == "":
+		return agentkey, false, nil
+	case agentkey != "" && agentkey != certAgent:
+		return "", false, errors.New("agentkey does not match the client certificate")
+	}
+	return certAgent, true, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+// testCert creates a self-signed certificate, returning it parsed and as PEM
+func testCert(t *testing.T, commonName string) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// withClientCert makes a request look like it came with a verified client certificate
+func withClientCert(r *http.Request, cert *x509.Certificate) *http.Request {
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	_, caPEM := testCert(t, "Test CA")
+	dir, err := ioutil.TempDir("", "didserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, caPEM, 0600)
+	notPEM := filepath.Join(dir, "not.pem")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	tests := []struct {
+		name       string
+		conf       tlsConfig
+		clientAuth tls.ClientAuthType
+		err        bool
+	}{
+		{"no client CAs", tlsConfig{}, tls.NoClientCert, false},
+		{"optional client certs", tlsConfig{ClientCAFile: caFile}, tls.VerifyClientCertIfGiven, false},
+		{"required client certs", tlsConfig{ClientCAFile: caFile, RequireClientCert: true}, tls.RequireAndVerifyClientCert, false},
+		{"required without CAs", tlsConfig{RequireClientCert: true}, 0, true},
+		{"missing CA file", tlsConfig{ClientCAFile: filepath.Join(dir, "missing.pem")}, 0, true},
+		{"CA file without certificates", tlsConfig{ClientCAFile: notPEM}, 0, true},
+	}
+	for _, test := range tests {
+		config, err := serverTLSConfig(test.conf)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: expected an error", test.name)
+		case !test.err && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case !test.err && config.ClientAuth != test.clientAuth:
+			t.Errorf("%s: got client auth %v want %v", test.name, config.ClientAuth, test.clientAuth)
+		}
+	}
+}
+
+func TestCertSPKI(t *testing.T) {
+	cert, certPEM := testCert(t, "an agent")
+	spki, err := pemCertSPKI(certPEM)
+	if err != nil || spki != certSPKI(cert) || len(b64Decode(spki)) != 32 {
+		t.Errorf("got SPKI hash %q, %v want %q", spki, err, certSPKI(cert))
+	}
+	if _, err = pemCertSPKI([]byte("not a certificate")); err == nil {
+		t.Errorf("SPKI hash of a non-PEM certificate")
+	}
+}
+
+func TestRequestAgent(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/agentRegister", nil)
+	if agentkey, byCert, err := requestAgent(req, "an agent"); agentkey != "an agent" || byCert || err != nil {
+		t.Errorf("without a certificate: got %q %v %v", agentkey, byCert, err)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), certAgentKey, "cert agent"))
+	if agentkey, byCert, err := requestAgent(req, ""); agentkey != "cert agent" || !byCert || err != nil {
+		t.Errorf("with a certificate: got %q %v %v", agentkey, byCert, err)
+	}
+	if _, _, err := requestAgent(req, "another agent"); err == nil {
+		t.Errorf("agentkey that doesn't match the certificate accepted")
+	}
+}
+
+func TestClientCertAgent(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	agentkey := "a-certified-agent"
+	if err = createAgent(agentkey, "", []string{scopeRegister, scopeRead}, agentQuotas{}); err != nil {
+		t.Fatal(err)
+	}
+	byKey, _ := testCert(t, "another name")
+	bySubject, _ := testCert(t, "certified agent")
+	unknown, _ := testCert(t, "unknown agent")
+	spki, subject := certSPKI(byKey), bySubject.Subject.String()
+	if err = updateAgent(agentkey, agentUpdate{CertSPKI: &spki, CertSubject: &subject}); err != nil {
+		t.Fatal(err)
+	}
+
+	var found string
+	handler := clientCertAgent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		found = certAgentFrom(r.Context())
+	}))
+	for _, test := range []struct {
+		name  string
+		cert  *x509.Certificate
+		agent string
+	}{
+		{"SPKI hash", byKey, agentkey},
+		{"subject", bySubject, agentkey},
+		{"unknown", unknown, ""},
+	} {
+		req, _ := http.NewRequest("GET", "/agent/dids", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), withClientCert(req, test.cert))
+		if found != test.agent {
+			t.Errorf("%s: got agent %q want %q", test.name, found, test.agent)
+		}
+	}
+
+	// a certified agent registers with an unsigned JWT and no agentkey
+	id, signed := batchRegistration(t, "client cert test key")
+	claims := jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(signed, claims)
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	req, _ := http.NewRequest("POST", "/agentRegister", strings.NewReader(fmt.Sprintf(`{"registration":%q}`, unsigned)))
+	rr := httptest.NewRecorder()
+	clientCertAgent(http.HandlerFunc(agentRegister)).ServeHTTP(rr, withClientCert(req, byKey))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("certified agent registration: got %v %s", rr.Code, rr.Body.String())
+	}
+	var registeredBy string
+	DB.QueryRow("SELECT agent_id FROM didstore WHERE id = $1", id).Scan(&registeredBy)
+	if registeredBy != agentkey {
+		t.Errorf("DID registered by %q want %q", registeredBy, agentkey)
+	}
+
+	// without a certificate the unsigned JWT is refused
+	req, _ = http.NewRequest("POST", "/agentRegister", strings.NewReader(fmt.Sprintf(`{"agentkey":%q,"registration":%q}`, agentkey, unsigned)))
+	rr = httptest.NewRecorder()
+	clientCertAgent(http.HandlerFunc(agentRegister)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned registration without a certificate: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// the certificate stands in for the Authorization header, within the agent's scopes
+	req, _ = http.NewRequest("GET", "/agent/dids", nil)
+	rr = httptest.NewRecorder()
+	clientCertAgent(agentAuth(scopeRead)(http.HandlerFunc(agentListDIDs))).ServeHTTP(rr, withClientCert(req, byKey))
+	if rr.Code != http.StatusOK {
+		t.Errorf("certified agent listing DIDs: got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	clientCertAgent(agentAuth(scopeRevoke)(http.HandlerFunc(agentListDIDs))).ServeHTTP(rr, withClientCert(req, byKey))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("certified agent without the scope: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// delete previous entries from the test database
+	for _, table := range []string{"didstore", "agent_usage", "agents"} {
+		stmt, _ := DB.Prepare("DELETE FROM " + table)
+		stmt.Exec()
+	}
+}
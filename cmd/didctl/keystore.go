@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jlinclabs/didserver/didclient"
+)
+
+// entry is a DID held in the keystore, with what didctl needs for its next step
+type entry struct {
+	ID         string              `json:"id"`
+	Root       string              `json:"root,omitempty"`
+	Status     string              `json:"status"` // keys until registered, then the DID's status
+	Keys       *didclient.Keys     `json:"keys"`
+	Secret     []byte              `json:"secret,omitempty"` // the chain's registration secret
+	Document   *didclient.Document `json:"document,omitempty"`
+	Challenge  string              `json:"challenge,omitempty"`
+	Supersedes string              `json:"supersedes,omitempty"`
+}
+
+// keystore is the file of DIDs didctl has made, keyed by id. It holds secret keys, so it is
+// only readable by its owner.
+type keystore struct {
+	path string
+	DIDs map[string]*entry `json:"dids"`
+}
+
+// defaultKeystore is ~/.didctl/keystore.json
+func defaultKeystore() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "didctl-keystore.json"
+	}
+	return filepath.Join(home, ".didctl", "keystore.json")
+}
+
+// loadKeystore reads a keystore, which is empty when the file doesn't exist yet
+func loadKeystore(path string) (*keystore, error) {
+	ks := &keystore{path: path, DIDs: map[string]*entry{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, ks); err != nil {
+		return nil, fmt.Errorf("cannot read keystore %s: %v", path, err)
+	}
+	if ks.DIDs == nil {
+		ks.DIDs = map[string]*entry{}
+	}
+	return ks, nil
+}
+
+// save writes the keystore, replacing the file only once it is completely written
+func (ks *keystore) save() error {
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ks.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ks.path)
+}
+
+// get finds a DID in the keystore
+func (ks *keystore) get(id string) (*entry, error) {
+	e, ok := ks.DIDs[id]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the keystore %s", id, ks.path)
+	}
+	return e, nil
+}
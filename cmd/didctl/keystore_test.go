@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlinclabs/didserver/didclient"
+)
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nested", "keystore.json")
+
+	ks, err := loadKeystore(path)
+	if err != nil || len(ks.DIDs) != 0 {
+		t.Fatalf("missing keystore should load empty: %v", err)
+	}
+	if _, err = ks.get("did:jlinc:x"); err == nil {
+		t.Errorf("unknown DID should not be found")
+	}
+
+	keys, _ := didclient.GenerateKeys()
+	ks.DIDs[keys.ID()] = &entry{ID: keys.ID(), Status: "init", Keys: keys, Secret: []byte("secret"), Challenge: "c"}
+	if err = ks.save(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("keystore should only be readable by its owner: %v %v", info.Mode(), err)
+	}
+
+	ks, err = loadKeystore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ks.get(keys.ID())
+	if err != nil || string(e.Secret) != "secret" || e.Keys.ID() != keys.ID() || e.Challenge != "c" {
+		t.Errorf("keystore entry did not survive: %+v %v", e, err)
+	}
+}
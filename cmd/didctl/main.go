@@ -0,0 +1,359 @@
+// Command didctl registers and manages JLINC DIDs with a DID server, keeping their keys and
+// registration secrets in a local keystore. Every command prints JSON.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jlinclabs/didserver/didclient"
+)
+
+const usage = "usage: didctl [-server URL] [-keystore FILE] keygen|register|confirm|supersede|revoke|resolve|history|verify ..."
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "didctl:", err)
+		os.Exit(1)
+	}
+}
+
+// ctl holds what every command needs
+type ctl struct {
+	ctx      context.Context
+	client   *didclient.Client
+	keystore *keystore
+	in       io.Reader
+	out      io.Writer
+}
+
+// didStatus is what commands print about a DID in the keystore, leaving out its secrets
+type didStatus struct {
+	ID         string `json:"id"`
+	Root       string `json:"root,omitempty"`
+	Status     string `json:"status"`
+	Challenge  string `json:"challenge,omitempty"`
+	Supersedes string `json:"supersedes,omitempty"`
+}
+
+func run(args []string, in io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("didctl", flag.ContinueOnError)
+	server := flags.String("server", envOr("DIDCTL_SERVER", "http://localhost:5001"), "DID server URL")
+	path := flags.String("keystore", envOr("DIDCTL_KEYSTORE", defaultKeystore()), "keystore file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New(usage)
+	}
+
+	ks, err := loadKeystore(*path)
+	if err != nil {
+		return err
+	}
+	c := &ctl{ctx: context.Background(), client: didclient.New(*server), keystore: ks, in: in, out: out}
+
+	cmd, args := flags.Arg(0), flags.Args()[1:]
+	switch cmd {
+	case "keygen":
+		return c.keygen(args)
+	case "register":
+		return c.register(args)
+	case "confirm":
+		return c.confirm(args)
+	case "supersede":
+		return c.supersede(args)
+	case "revoke":
+		return c.revoke(args)
+	case "resolve":
+		return c.resolve(args)
+	case "history":
+		return c.history(args)
+	case "verify":
+		return c.verify(args)
+	default:
+		return fmt.Errorf("unknown command %q; %s", cmd, usage)
+	}
+}
+
+// didctl keygen: make keys for a DID and keep them for register
+func (c *ctl) keygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	e, err := c.newEntry()
+	if err != nil {
+		return err
+	}
+	if err = c.keystore.save(); err != nil {
+		return err
+	}
+	return c.print(e)
+}
+
+func (c *ctl) newEntry() (*entry, error) {
+	keys, err := didclient.GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{ID: keys.ID(), Status: "keys", Keys: keys}
+	c.keystore.DIDs[e.ID] = e
+	return e, nil
+}
+
+// didctl register [ID]: register a DID for keys from keygen, or for new keys
+func (c *ctl) register(args []string) error {
+	flags := flag.NewFlagSet("register", flag.ContinueOnError)
+	version := flags.Int("version", 2, "DID document version, 1 or 2")
+	invite := flags.String("invite", "", "invite token, for invite-only servers")
+	confirm := flags.Bool("confirm", false, "confirm the registration straight away")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var e *entry
+	var err error
+	if flags.NArg() > 0 {
+		if e, err = c.keystore.get(flags.Arg(0)); err != nil {
+			return err
+		}
+		if e.Status != "keys" {
+			return fmt.Errorf("%s is already registered", e.ID)
+		}
+	} else if e, err = c.newEntry(); err != nil {
+		return err
+	}
+
+	doc, err := didclient.NewDocument(e.Keys, *version, time.Now())
+	if err != nil {
+		return err
+	}
+	secret, err := didclient.NewRegistrationSecret()
+	if err != nil {
+		return err
+	}
+	master, err := c.client.MasterPublicKey(c.ctx)
+	if err != nil {
+		return err
+	}
+	encrypted, err := e.Keys.EncryptSecret(secret, master)
+	if err != nil {
+		return err
+	}
+	challenge, err := c.client.Register(c.ctx, &didclient.RegisterRequest{DID: doc, Signature: e.Keys.SignDocument(doc), Secret: encrypted, Invite: *invite})
+	if err != nil {
+		return err
+	}
+
+	e.Root, e.Secret, e.Document = e.ID, secret, doc
+	e.Status, e.Challenge = "init", challenge.Challenge
+	if err = c.keystore.save(); err != nil {
+		return err
+	}
+	if *confirm {
+		return c.confirmEntry(e)
+	}
+	return c.print(e)
+}
+
+// didctl confirm ID: confirm a registration or supersede
+func (c *ctl) confirm(args []string) error {
+	e, err := c.entryArg("confirm", args)
+	if err != nil {
+		return err
+	}
+	return c.confirmEntry(e)
+}
+
+func (c *ctl) confirmEntry(e *entry) error {
+	if e.Status != "init" {
+		return fmt.Errorf("%s has no registration to confirm", e.ID)
+	}
+	challenge := &didclient.Challenge{ID: e.ID, Challenge: e.Challenge}
+	var err error
+	if e.Supersedes == "" {
+		_, err = c.client.Confirm(c.ctx, challenge, e.Keys, e.Secret)
+	} else {
+		_, err = c.client.ConfirmSupersede(c.ctx, challenge, e.Keys, e.Secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.Status, e.Challenge = "verified", ""
+	if old, ok := c.keystore.DIDs[e.Supersedes]; ok {
+		old.Status = "superseded"
+	}
+	if err = c.keystore.save(); err != nil {
+		return err
+	}
+	return c.print(e)
+}
+
+// didctl supersede ID: register a DID with new keys that supersedes ID
+func (c *ctl) supersede(args []string) error {
+	flags := flag.NewFlagSet("supersede", flag.ContinueOnError)
+	version := flags.Int("version", 2, "DID document version, 1 or 2")
+	confirm := flags.Bool("confirm", false, "confirm the supersede straight away")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: didctl supersede [flags] ID")
+	}
+	old, err := c.keystore.get(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if old.Status != "verified" {
+		return fmt.Errorf("%s is %s, only a verified DID can be superseded", old.ID, old.Status)
+	}
+
+	keys, err := didclient.GenerateKeys()
+	if err != nil {
+		return err
+	}
+	doc, err := didclient.NewDocument(keys, *version, time.Now())
+	if err != nil {
+		return err
+	}
+	challenge, err := c.client.Supersede(c.ctx, &didclient.SupersedeRequest{
+		DID:                 doc,
+		Signature:           keys.SignDocument(doc),
+		Supersedes:          old.ID,
+		SupersedesSignature: old.Keys.SignSupersedes(doc.ID),
+	})
+	if err != nil {
+		return err
+	}
+
+	e := &entry{ID: doc.ID, Root: old.Root, Status: "init", Keys: keys, Secret: old.Secret, Document: doc, Challenge: challenge.Challenge, Supersedes: old.ID}
+	c.keystore.DIDs[e.ID] = e
+	if err = c.keystore.save(); err != nil {
+		return err
+	}
+	if *confirm {
+		return c.confirmEntry(e)
+	}
+	return c.print(e)
+}
+
+// didctl revoke ID
+func (c *ctl) revoke(args []string) error {
+	e, err := c.entryArg("revoke", args)
+	if err != nil {
+		return err
+	}
+	if _, err = c.client.Revoke(c.ctx, e.ID, e.Secret); err != nil {
+		return err
+	}
+	e.Status = "revoked"
+	if err = c.keystore.save(); err != nil {
+		return err
+	}
+	return c.print(e)
+}
+
+// didctl resolve ID
+func (c *ctl) resolve(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: didctl resolve ID")
+	}
+	res, err := c.client.Resolve(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(c.out, res)
+}
+
+// didctl history ID
+func (c *ctl) history(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: didctl history ID")
+	}
+	history, err := c.client.History(c.ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(c.out, map[string]interface{}{"history": history})
+}
+
+// didctl verify -signature SIG ID: check a signature over a message, given on the command
+// line, in a file or on stdin, against the signing key of a verified DID
+func (c *ctl) verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	signature := flags.String("signature", "", "base64url signature")
+	message := flags.String("message", "", "message that was signed")
+	file := flags.String("file", "", "file holding the message that was signed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *signature == "" {
+		return errors.New("usage: didctl verify -signature SIG [-message MESSAGE | -file FILE] ID")
+	}
+
+	msg := *message
+	if *message == "" {
+		var data []byte
+		var err error
+		if *file != "" {
+			data, err = ioutil.ReadFile(*file)
+		} else {
+			data, err = ioutil.ReadAll(c.in)
+		}
+		if err != nil {
+			return err
+		}
+		msg = string(data)
+	}
+
+	res, err := c.client.Resolve(c.ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	valid := false
+	if res.Status == "verified" {
+		key, err := didclient.SigningKey(res.DID)
+		if err != nil {
+			return err
+		}
+		valid = didclient.Verify(key, msg, *signature)
+	}
+	return printJSON(c.out, map[string]interface{}{"id": res.ID, "status": res.Status, "valid": valid})
+}
+
+// entryArg finds the DID named by a command's only argument
+func (c *ctl) entryArg(cmd string, args []string) (*entry, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: didctl %s ID", cmd)
+	}
+	return c.keystore.get(args[0])
+}
+
+func (c *ctl) print(e *entry) error {
+	return printJSON(c.out, didStatus{ID: e.ID, Root: e.Root, Status: e.Status, Challenge: e.Challenge, Supersedes: e.Supersedes})
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
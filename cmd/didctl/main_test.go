@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlinclabs/didserver/didclient"
+)
+
+func TestKeygenAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "didctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore.json")
+
+	var out bytes.Buffer
+	if err = run([]string{"-keystore", path, "keygen"}, nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	var status didStatus
+	if err = json.Unmarshal(out.Bytes(), &status); err != nil || status.Status != "keys" {
+		t.Fatalf("keygen: got %s %v", out.String(), err)
+	}
+	ks, _ := loadKeystore(path)
+	keys := ks.DIDs[status.ID].Keys
+
+	// a server that resolves the new DID as verified
+	doc, _ := didclient.NewDocument(keys, 2, time.Now())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsn, _ := json.Marshal(doc)
+		json.NewEncoder(w).Encode(didclient.Resolution{ID: doc.ID, Status: "verified", DID: jsn})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		message string
+		valid   bool
+	}{
+		{"hello", true},
+		{"goodbye", false},
+	}
+	for _, test := range tests {
+		out.Reset()
+		args := []string{"-server", server.URL, "-keystore", path, "verify", "-signature", keys.Sign("hello"), status.ID}
+		if err = run(args, strings.NewReader(test.message), &out); err != nil {
+			t.Fatal(err)
+		}
+		var res struct {
+			Valid bool `json:"valid"`
+		}
+		json.Unmarshal(out.Bytes(), &res)
+		if res.Valid != test.valid {
+			t.Errorf("verify %q: got %s", test.message, out.String())
+		}
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	if err := run([]string{"frobnicate"}, nil, nil); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("got %v", err)
+	}
+	if err := run(nil, nil, nil); err == nil || !strings.HasPrefix(err.Error(), "usage:") {
+		t.Errorf("got %v", err)
+	}
+}
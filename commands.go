@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runCommand runs a didserver subcommand given on the command line
+func runCommand(args []string) error {
+	switch args[0] {
+	case "rekey":
+		return rekeyCommand(args[1:])
+	case "keystore":
+		return keystoreCommand(args[1:])
+	case "admin":
+		return adminCommand(args[1:])
+	case "keygen":
+		return keygenCommand(args[1:])
+	case "init":
+		return initCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// didserver rekey: re-encrypt stored registration secrets to the current master key
+func rekeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	batch := flags.Int("batch", 100, "rows to re-encrypt per batch")
+	pause := flags.Duration("pause", 0, "time to wait between batches")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := setup(); err != nil {
+		return err
+	}
+	defer DB.Close()
+
+	n, err := rekey(*batch, *pause)
+	fmt.Printf("examined %d stored secrets\n", n)
+	return err
+}
+
+// didserver keystore: encrypt master secret keys read from stdin into a keystore file,
+// with the passphrase taken from the environment
+func keystoreCommand(args []string) error {
+	flags := flag.NewFlagSet("keystore", flag.ContinueOnError)
+	out := flags.String("out", "master.keystore", "keystore file to write")
+	env := flags.String("passphrase-env", "DIDSERVER_KEYSTORE_PASSPHRASE", "environment variable holding the passphrase")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	secrets, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	ks, err := sealKeystore(string(secrets), os.Getenv(*env))
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, contents, 0600)
+}
+
+// didserver keygen: print a new master keypair for [keys]
+func keygenCommand(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	kp, err := newMasterKeypair()
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]string{"public": kp.Public, "secret": kp.Secret})
+}
+
+// didserver init: write a config.toml with a new master keypair, test agent credentials and
+// an admin token
+func initCommand(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	out := flags.String("out", "config.toml", "config file to write")
+	force := flags.Bool("force", false, "replace the config file if it exists")
+	connStr := flags.String("database", "postgres://localhost:5432/did?sslmode=disable", "database connection string")
+	url := flags.String("url", "http://localhost:5001", "URL the server is reached at")
+	port := flags.String("port", ":5001", "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	b, err := newBootstrap(*connStr, *url, *port)
+	if err != nil {
+		return err
+	}
+	if err = b.writeConfig(*out, *force); err != nil {
+		return err
+	}
+	return printJSON(map[string]string{"config": *out, "masterPublicKey": b.Master.Public, "agentkey": b.AgentKey})
+}
+
+// didserver admin agent ...: manage agents directly in the database
+func adminCommand(args []string) error {
+	if len(args) > 0 && args[0] == "usage" {
+		return usageCommand(args[1:])
+	}
+	if len(args) > 1 && args[0] == "invite" {
+		return inviteCommand(args[1], args[2:])
+	}
+	if len(args) < 2 || args[0] != "agent" {
+		return errors.New("usage: didserver admin agent create|list|show|set|enable|disable|issue-secret|revoke-secret|add-key|revoke-key|dids, didserver admin invite create|list|revoke, or didserver admin usage")
+	}
+	if err := setup(); err != nil {
+		return err
+	}
+	defer DB.Close()
+
+	sub, args := args[1], args[2:]
+	flags := flag.NewFlagSet("admin agent "+sub, flag.ContinueOnError)
+	id := flags.String("id", "", "agentkey, generated when empty")
+	name := flags.String("name", "", "agent name")
+	scopes := flags.String("scopes", scopeRegister, "comma separated scopes: "+strings.Join(agentScopes, ", "))
+	var quotas agentQuotas
+	flags.IntVar(&quotas.RegistrationsPerDay, "registrations-per-day", 0, "registrations allowed per day, 0 for no limit")
+	flags.IntVar(&quotas.ActiveDIDs, "active-dids", 0, "active DIDs allowed, 0 for no limit")
+	flags.IntVar(&quotas.SupersedesPerDID, "supersedes-per-did", 0, "supersedes allowed per DID in each period, 0 for no limit")
+	flags.IntVar(&quotas.SupersedePeriodHours, "supersede-period-hours", 24, "length of the supersede quota period")
+	jwksURL := flags.String("jwks-url", "", "URL of a JWKS with the agent's public keys")
+	keyFile := flags.String("file", "", "JWK or JWKS file for add-key, read from stdin when empty")
+	certSubject := flags.String("cert-subject", "", "subject of the agent's client certificates, such as CN=agent,O=Example")
+	certSPKI := flags.String("cert-spki", "", "base64url SHA-256 hash of the agent's client certificate public key")
+	certFile := flags.String("cert-file", "", "PEM client certificate to take the agent's cert-spki from")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// every subcommand but create and list takes an agentkey
+	agentkey := flags.Arg(0)
+	if sub != "create" && sub != "list" && agentkey == "" {
+		return fmt.Errorf("usage: didserver admin agent %s [flags] AGENTKEY", sub)
+	}
+
+	switch sub {
+	case "create":
+		agentkey, err := newAgentID(*id)
+		if err != nil {
+			return err
+		}
+		secretID, secret, err := createAgentWithSecret(agentkey, *name, strings.Split(*scopes, ","), quotas)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]interface{}{"id": agentkey, "secretID": secretID, "secret": secret})
+	case "list":
+		agents, err := listAgents()
+		if err != nil {
+			return err
+		}
+		return printJSON(agents)
+	case "show":
+		a, err := getAgent(agentkey)
+		if err != nil {
+			return err
+		}
+		return printJSON(a)
+	case "set":
+		// only change what was given on the command line
+		a, err := getAgent(agentkey)
+		if err != nil {
+			return err
+		}
+		update := agentUpdate{Quotas: &a.Quotas}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				update.Name = name
+			case "scopes":
+				update.Scopes = strings.Split(*scopes, ",")
+			case "registrations-per-day":
+				a.Quotas.RegistrationsPerDay = quotas.RegistrationsPerDay
+			case "active-dids":
+				a.Quotas.ActiveDIDs = quotas.ActiveDIDs
+			case "supersedes-per-did":
+				a.Quotas.SupersedesPerDID = quotas.SupersedesPerDID
+			case "supersede-period-hours":
+				a.Quotas.SupersedePeriodHours = quotas.SupersedePeriodHours
+			case "jwks-url":
+				update.JWKSURL = jwksURL
+			case "cert-subject":
+				update.CertSubject = certSubject
+			case "cert-spki":
+				update.CertSPKI = certSPKI
+			}
+		})
+		if *certFile != "" {
+			data, err := ioutil.ReadFile(*certFile)
+			if err != nil {
+				return err
+			}
+			if *certSPKI, err = pemCertSPKI(data); err != nil {
+				return err
+			}
+			update.CertSPKI = certSPKI
+		}
+		return updateAgent(agentkey, update)
+	case "enable", "disable":
+		enabled := sub == "enable"
+		return updateAgent(agentkey, agentUpdate{Enabled: &enabled})
+	case "issue-secret":
+		if _, err := getAgent(agentkey); err != nil {
+			return err
+		}
+		secretID, secret, err := issueAgentSecret(agentkey)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]interface{}{"secretID": secretID, "secret": secret})
+	case "add-key":
+		var data []byte
+		var err error
+		if *keyFile == "" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(*keyFile)
+		}
+		if err != nil {
+			return err
+		}
+		keys, err := parseKeys(data)
+		if err != nil {
+			return err
+		}
+		if _, err = getAgent(agentkey); err != nil {
+			return err
+		}
+		var kids []string
+		for _, k := range keys {
+			kid, err := addAgentKey(agentkey, k)
+			if err != nil {
+				return err
+			}
+			kids = append(kids, kid)
+		}
+		return printJSON(kids)
+	case "revoke-key":
+		if flags.Arg(1) == "" {
+			return errors.New("usage: didserver admin agent revoke-key AGENTKEY KID")
+		}
+		return revokeAgentKey(agentkey, flags.Arg(1))
+	case "revoke-secret":
+		secretID, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if err != nil {
+			return errors.New("usage: didserver admin agent revoke-secret AGENTKEY SECRETID")
+		}
+		return revokeAgentSecret(agentkey, secretID)
+	case "dids":
+		// print every page
+		var dids []agentDID
+		p := page{Limit: maxPageLimit}
+		for {
+			more, cursor, err := agentDIDs(agentkey, didFilter{}, p)
+			if err != nil {
+				return err
+			}
+			dids = append(dids, more...)
+			if cursor == "" {
+				return printJSON(dids)
+			}
+			if p.After, err = cursorSequence(cursor); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown admin agent command %q", sub)
+	}
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// didserver admin usage: report agent usage for a period
+func usageCommand(args []string) error {
+	flags := flag.NewFlagSet("admin usage", flag.ContinueOnError)
+	agentkey := flags.String("agent", "", "report on one agent instead of all of them")
+	from := flags.String("from", "", "first day of the report, YYYY-MM-DD, defaults to the start of this month")
+	to := flags.String("to", "", "day after the last day of the report, YYYY-MM-DD, defaults to the start of next month")
+	asCSV := flags.Bool("csv", false, "write CSV instead of JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	start, end, err := usagePeriod(*from, *to)
+	if err != nil {
+		return err
+	}
+	if err = setup(); err != nil {
+		return err
+	}
+	defer DB.Close()
+
+	report, err := usageReport(*agentkey, start, end)
+	if err != nil {
+		return err
+	}
+	if *asCSV {
+		return writeUsageCSV(os.Stdout, report)
+	}
+	return printJSON(report)
+}
+
+// didserver admin invite ...: manage invites for invite-only registration
+func inviteCommand(sub string, args []string) error {
+	flags := flag.NewFlagSet("admin invite "+sub, flag.ContinueOnError)
+	note := flags.String("note", "", "who or what the invite is for")
+	maxUses := flags.Int("max-uses", 1, "registrations the invite allows, 0 for no limit")
+	expiresIn := flags.Duration("expires-in", 0, "time until the invite expires, such as 72h, 0 for never")
+	createdBy := flags.String("created-by", "", "list only the invites made by this agent, or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := setup(); err != nil {
+		return err
+	}
+	defer DB.Close()
+
+	switch sub {
+	case "create":
+		var expires *time.Time
+		if *expiresIn > 0 {
+			t := time.Now().Add(*expiresIn)
+			expires = &t
+		}
+		id, token, err := createInvite(inviteCreatorAdmin, *note, *maxUses, expires)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]interface{}{"id": id, "invite": token})
+	case "list":
+		invites, err := listInvites(*createdBy)
+		if err != nil {
+			return err
+		}
+		return printJSON(invites)
+	case "revoke":
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return errors.New("usage: didserver admin invite revoke ID")
+		}
+		return revokeInvite(id, "")
+	default:
+		return fmt.Errorf("unknown invite command %q", sub)
+	}
+}
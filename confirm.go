@@ -16,10 +16,25 @@ func registerConfirm(w http.ResponseWriter, r *http.Request) {
 	}
 	var challengeResponse ChallengeResponse
 	if err := json.NewDecoder(r.Body).Decode(&challengeResponse); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
+	didID, p := confirmRegistration(challengeResponse.TokenString)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	// return success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%q}`, didID)
+}
+
+// confirmRegistration verifies a signed challenge response and marks its registration verified,
+// returning the DID's id
+func confirmRegistration(tokenString string) (string, *problem) {
 	type ConfirmClaims struct {
 		ID        string `json:"id"`
 		Signature string `json:"signature"`
@@ -27,7 +42,7 @@ func registerConfirm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse the JWT
-	token, err := jwt.ParseWithClaims(challengeResponse.TokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
@@ -39,61 +54,52 @@ func registerConfirm(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT-%s"}`, err)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
 	}
 
 	var (
-		challenge     string
-		signingPubkey string
-		DIDstring     string
+		challenge      string
+		signingPubkey  string
+		DIDstring      string
+		envelopeKey    string
+		envelopeKEK    string
+		envelopeMaster string
 	)
 	// check that the JWT is valid
 	if claims, ok := token.Claims.(*ConfirmClaims); ok && token.Valid {
 		// then check that the signature is correct
-		DB.QueryRow("SELECT challenge, signing_pubkey, did from didstore where id = $1", claims.ID).Scan(&challenge, &signingPubkey, &DIDstring)
+		DB.QueryRow("SELECT challenge, signing_pubkey, did, envelope_key, envelope_kek, envelope_master from didstore where id = $1", claims.ID).Scan(&challenge, &signingPubkey, &DIDstring, &envelopeKey, &envelopeKEK, &envelopeMaster)
+		env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+		if err == nil {
+			err = env.openValues(&challenge)
+		}
+		if err != nil {
+			return "", newProblem(http.StatusInternalServerError, codeInternalError, "envelope error")
+		}
 
 		signedHashed := getHash(challenge)
 		sig := b64Decode(claims.Signature)
 		if sigVerified := ed25519.Verify(b64Decode(signingPubkey), signedHashed, sig); !sigVerified {
 			// if signature doesn't verify
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintf(w, `{"success":"false", "error":"signature does not verify"}`)
-			return
+			return "", newProblem(http.StatusUnauthorized, codeSignatureInvalid, "signature does not verify")
 		}
 	} else {
 		// if JWT is not valid
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT invalid"}`)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, "JWT invalid")
 	}
 
 	// everything checks, set DB status to verifed
 	didID := token.Claims.(*ConfirmClaims).ID
 	stmt, err := DB.Prepare(`UPDATE didstore SET status = 'verified', modified = NOW() WHERE id = $1`)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-p"`)
-		return
+		return "", databaseProblem("p")
 	}
 
 	defer stmt.Close()
 
 	_, err = stmt.Exec(didID)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-e"`)
-		return
+		return "", databaseProblem("e")
 	}
-
-	// return success
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"success":"true", "id":%q}`, didID)
+	return didID, nil
 }
@@ -16,10 +16,25 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	}
 	var challengeResponse ChallengeResponse
 	if err := json.NewDecoder(r.Body).Decode(&challengeResponse); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
+	supersederID, p := confirmSupersession(challengeResponse.TokenString)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	// return success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%q}`, supersederID)
+}
+
+// confirmSupersession verifies a signed challenge response, marks the DID it superseded as
+// superseded and its own registration verified, returning the new DID's id
+func confirmSupersession(tokenString string) (string, *problem) {
 	type ConfirmClaims struct {
 		ID        string `json:"id"`
 		Signature string `json:"signature"`
@@ -27,7 +42,7 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// parse the JWT
-	token, err := jwt.ParseWithClaims(challengeResponse.TokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
@@ -39,38 +54,39 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT-%s"}`, err)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
 	}
 
 	var (
-		challenge     string
-		signingPubkey string
-		supersedes    string
+		challenge      string
+		signingPubkey  string
+		supersedes     string
+		envelopeKey    string
+		envelopeKEK    string
+		envelopeMaster string
 	)
 
 	// check that the JWT is valid
 	if claims, ok := token.Claims.(*ConfirmClaims); ok && token.Valid {
 		// then check that the signature is correct
-		DB.QueryRow("SELECT challenge, signing_pubkey, supersedes from didstore where id = $1", claims.ID).Scan(&challenge, &signingPubkey, &supersedes)
+		DB.QueryRow("SELECT challenge, signing_pubkey, supersedes, envelope_key, envelope_kek, envelope_master from didstore where id = $1", claims.ID).Scan(&challenge, &signingPubkey, &supersedes, &envelopeKey, &envelopeKEK, &envelopeMaster)
+		env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+		if err == nil {
+			err = env.openValues(&challenge)
+		}
+		if err != nil {
+			return "", newProblem(http.StatusInternalServerError, codeInternalError, "envelope error")
+		}
 
 		signedHashed := getHash(challenge)
 		sig := b64Decode(claims.Signature)
 		if sigVerified := ed25519.Verify(b64Decode(signingPubkey), signedHashed, sig); !sigVerified {
 			// if signature doesn't verify
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintf(w, `{"success":"false", "error":"signature does not verify"}`)
-			return
+			return "", newProblem(http.StatusUnauthorized, codeSignatureInvalid, "signature does not verify")
 		}
 	} else {
 		// if JWT is not valid
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT invalid"}`)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, "JWT invalid")
 	}
 
 	// everything checks, update the superseded record
@@ -78,10 +94,7 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	stmt, err := DB.Prepare(`UPDATE didstore SET superseded_by = $1, superseded_at = NOW(), status = 'superseded', modified = NOW() WHERE id = $2`)
 	if err != nil {
 		fmt.Printf("Errp: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-p"`)
-		return
+		return "", databaseProblem("p")
 	}
 
 	defer stmt.Close()
@@ -89,20 +102,14 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	_, err = stmt.Exec(supersederID, supersedes)
 	if err != nil {
 		fmt.Printf("Erre: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-e"`)
-		return
+		return "", databaseProblem("e")
 	}
 
 	// then set superseder status to verifed
 	stmt, err = DB.Prepare(`UPDATE didstore SET status = 'verified', modified = NOW() WHERE id = $1`)
 	if err != nil {
 		fmt.Printf("Errs: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-s"`)
-		return
+		return "", databaseProblem("s")
 	}
 
 	defer stmt.Close()
@@ -110,14 +117,7 @@ func confirmSupersede(w http.ResponseWriter, r *http.Request) {
 	_, err = stmt.Exec(supersederID)
 	if err != nil {
 		fmt.Printf("Erra: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-a"`)
-		return
+		return "", databaseProblem("a")
 	}
-
-	// return success
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"success":"true", "id":%q}`, supersederID)
+	return supersederID, nil
 }
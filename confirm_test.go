@@ -77,15 +77,15 @@ func TestBadConfirm(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
 	}
 
-	expected := fmt.Sprintf(`{"success":"false", "error":"JWT-signature is invalid"}`)
+	expected := problemJSON(http.StatusUnauthorized, codeJWTInvalid, "JWT-signature is invalid")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: want %s got %s", expected, rr.Body.String())
 	}
@@ -175,7 +175,7 @@ func TestGoodConfirm(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
 	}
 
-	expected := fmt.Sprintf(`{"success":"true", "id":%q}`, didID)
+	expected := fmt.Sprintf(`{"success":true, "id":%q}`, didID)
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: want %s got %s", expected, rr.Body.String())
 	}
@@ -264,7 +264,7 @@ func TestGoodV2Confirm(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
 	}
 
-	expected := fmt.Sprintf(`{"success":"true", "id":%q}`, didID)
+	expected := fmt.Sprintf(`{"success":true, "id":%q}`, didID)
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: want %s got %s", expected, rr.Body.String())
 	}
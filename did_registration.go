@@ -9,23 +9,27 @@ import (
 
 // Registration contains the information necessary to register a DID
 type Registration struct {
-	DID           did
-	Secret        secret
-	Signature     string `json:"signature"`
-	Challenge     string
-	SigningKey    string
-	EncryptingKey string
-	Raw           string
-	Root          string
-	Supersedes    string `json:"supersedes"`
-	SupersededBy  string
-	Status        string
-	AgentID       string
+	DID                 did
+	Secret              secret
+	Signature           string `json:"signature"`
+	Challenge           string
+	SigningKey          string
+	EncryptingKey       string
+	Raw                 string
+	Root                string
+	Supersedes          string `json:"supersedes"`
+	SupersedesSignature string `json:"supersedesSignature"`
+	SupersededBy        string
+	Status              string
+	AgentID             string
+	PoW                 *powSolution `json:"pow"`
+	Invite              string       `json:"invite"`
 }
 
 type secret struct {
 	Cyphertext string `json:"cyphertext"`
 	Nonce      string `json:"nonce"`
+	Format     string `json:"format"`
 	MasterKey  string
 }
 
@@ -49,7 +53,7 @@ type pubkey struct {
 
 // get the raw did section without emptying r.Body
 func getRawDID(r *http.Request) (j string, err error) {
-	type RawDid struct {
+	var raw struct {
 		DID interface{} `json:"did"`
 	}
 	var bodyBytes []byte
@@ -59,12 +63,29 @@ func getRawDID(r *http.Request) (j string, err error) {
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
 
 	// get the "did" section  of the request body into raw, then Marshal it back into JSON
-	var raw RawDid
 	json.Unmarshal(bodyBytes, &raw)
-	js, err := json.Marshal(raw)
+	return rawDIDFrom(raw.DID)
+}
+
+// rawDIDFrom is the raw form of a DID document that's stored with its registration
+func rawDIDFrom(doc interface{}) (string, error) {
+	js, err := json.Marshal(struct {
+		DID interface{} `json:"did"`
+	}{doc})
 	if err != nil {
 		return "", err
 	}
-
 	return string(js), nil
 }
+
+// didDocument is the DID document in a stored raw DID. Agent registrations store the document
+// itself.
+func didDocument(raw string) json.RawMessage {
+	var wrapped struct {
+		DID json.RawMessage `json:"did"`
+	}
+	if err := json.Unmarshal([]byte(raw), &wrapped); err == nil && len(wrapped.DID) > 0 && string(wrapped.DID) != "null" {
+		return wrapped.DID
+	}
+	return json.RawMessage(raw)
+}
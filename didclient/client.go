@@ -0,0 +1,314 @@
+package didclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Client calls a DID server's /v2 API
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// New makes a client for the server at the base URL, such as https://did.example.com
+func New(baseURL string) *Client {
+	return &Client{URL: strings.TrimRight(baseURL, "/"), HTTP: http.DefaultClient}
+}
+
+// Problem is an error response from the server, with the code that identifies it
+type Problem struct {
+	Type   string            `json:"type"`
+	Title  string            `json:"title"`
+	Status int               `json:"status"`
+	Detail string            `json:"detail"`
+	Code   string            `json:"code"`
+	Errors []ValidationError `json:"errors,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("didserver: %s (%s)", p.Detail, p.Code)
+}
+
+// ValidationError is one of the errors found in a registration
+type ValidationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RegisterRequest registers a DID. Invite is needed on invite-only servers.
+type RegisterRequest struct {
+	DID       *Document `json:"did"`
+	Signature string    `json:"signature"`
+	Secret    Secret    `json:"secret"`
+	PoW       *PoW      `json:"pow,omitempty"`
+	Invite    string    `json:"invite,omitempty"`
+}
+
+// SupersedeRequest registers a DID that supersedes an active one
+type SupersedeRequest struct {
+	DID                 *Document `json:"did"`
+	Signature           string    `json:"signature"`
+	Supersedes          string    `json:"supersedes"`
+	SupersedesSignature string    `json:"supersedesSignature"`
+	PoW                 *PoW      `json:"pow,omitempty"`
+}
+
+// PoW is a solved proof of work puzzle
+type PoW struct {
+	Puzzle string `json:"puzzle"`
+	Nonce  string `json:"nonce"`
+}
+
+// Puzzle is a proof of work puzzle issued by the server
+type Puzzle struct {
+	Puzzle     string    `json:"puzzle"`
+	Difficulty int       `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Challenge is a recorded registration and the challenge to sign to confirm it
+type Challenge struct {
+	ID        string `json:"id"`
+	Challenge string `json:"challenge"`
+}
+
+// Status is a DID and the status it has after a request
+type Status struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Resolution is a verified DID's document, or the DID that superseded it
+type Resolution struct {
+	ID           string          `json:"id"`
+	Status       string          `json:"status"`
+	DID          json.RawMessage `json:"did,omitempty"`
+	SupersededBy string          `json:"supersededBy,omitempty"`
+}
+
+// HistoryEntry is a DID in a chain, with the time it became valid, was superseded or was revoked
+type HistoryEntry struct {
+	DID        json.RawMessage `json:"did"`
+	Valid      string          `json:"valid,omitempty"`
+	Superseded string          `json:"superseded,omitempty"`
+	Revoked    string          `json:"revoked,omitempty"`
+}
+
+// do sends a request with a JSON body, when there is one, and decodes the response into out.
+// Error responses are returned as a *Problem.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsn, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsn)
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	jsn, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 400 {
+		p := &Problem{Status: res.StatusCode, Code: "unknown", Detail: http.StatusText(res.StatusCode)}
+		json.Unmarshal(jsn, p)
+		return p
+	}
+	if out == nil || len(jsn) == 0 {
+		return nil
+	}
+	return json.Unmarshal(jsn, out)
+}
+
+// MasterPublicKey gets the key registration secrets are encrypted to
+func (c *Client) MasterPublicKey(ctx context.Context) (string, error) {
+	var index struct {
+		MasterPublicKey string `json:"masterPublicKey"`
+	}
+	if err := c.do(ctx, "GET", "/", nil, &index); err != nil {
+		return "", err
+	}
+	return index.MasterPublicKey, nil
+}
+
+// Puzzle gets a proof of work puzzle, when the server asks for one
+func (c *Client) Puzzle(ctx context.Context) (*Puzzle, error) {
+	var puzzle Puzzle
+	if err := c.do(ctx, "GET", "/v2/pow", nil, &puzzle); err != nil {
+		return nil, err
+	}
+	return &puzzle, nil
+}
+
+// Register records a DID for confirmation. A server that wants proof of work gets it.
+func (c *Client) Register(ctx context.Context, req *RegisterRequest) (*Challenge, error) {
+	var challenge Challenge
+	err := c.do(ctx, "POST", "/v2/register", req, &challenge)
+	if powRequired(err) && req.PoW == nil {
+		if req.PoW, err = c.proofOfWork(ctx, req.DID.ID); err != nil {
+			return nil, err
+		}
+		err = c.do(ctx, "POST", "/v2/register", req, &challenge)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// Confirm confirms a registration, signing its challenge with the DID's keys and the request with
+// its registration secret
+func (c *Client) Confirm(ctx context.Context, challenge *Challenge, keys *Keys, secret []byte) (*Status, error) {
+	return c.confirm(ctx, "/v2/confirm", challenge, keys, secret)
+}
+
+// Supersede records a DID superseding an active one for confirmation
+func (c *Client) Supersede(ctx context.Context, req *SupersedeRequest) (*Challenge, error) {
+	var challenge Challenge
+	err := c.do(ctx, "POST", "/v2/supersede", req, &challenge)
+	if powRequired(err) && req.PoW == nil {
+		if req.PoW, err = c.proofOfWork(ctx, req.DID.ID); err != nil {
+			return nil, err
+		}
+		err = c.do(ctx, "POST", "/v2/supersede", req, &challenge)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// ConfirmSupersede confirms a supersede, signing its challenge with the new DID's keys and the
+// request with the chain's registration secret
+func (c *Client) ConfirmSupersede(ctx context.Context, challenge *Challenge, keys *Keys, rootSecret []byte) (*Status, error) {
+	return c.confirm(ctx, "/v2/confirmSupersede", challenge, keys, rootSecret)
+}
+
+func (c *Client) confirm(ctx context.Context, path string, challenge *Challenge, keys *Keys, secret []byte) (*Status, error) {
+	token, err := signedJWT(jwt.MapClaims{"id": challenge.ID, "signature": keys.SignChallenge(challenge.Challenge)}, secret)
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err = c.do(ctx, "POST", path, map[string]string{"challengeResponse": token}, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Revoke revokes a DID with its chain's registration secret
+func (c *Client) Revoke(ctx context.Context, id string, rootSecret []byte) (*Status, error) {
+	token, err := signedJWT(jwt.MapClaims{"id": id}, rootSecret)
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err = c.do(ctx, "POST", "/v2/revoke", map[string]string{"revokeRequest": token}, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Resolve gets a verified DID's document, or the id of the DID that superseded it
+func (c *Client) Resolve(ctx context.Context, id string) (*Resolution, error) {
+	var res Resolution
+	if err := c.do(ctx, "GET", "/v2/dids/"+url.PathEscape(id), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ResolveRoot gets the latest DID in the chain with the given root
+func (c *Client) ResolveRoot(ctx context.Context, root string) (*Resolution, error) {
+	var res Resolution
+	if err := c.do(ctx, "GET", "/v2/dids/"+url.PathEscape(root)+"/root", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// History lists every DID in a DID's chain, oldest first
+func (c *Client) History(ctx context.Context, id string) ([]HistoryEntry, error) {
+	var res struct {
+		History []HistoryEntry `json:"history"`
+	}
+	if err := c.do(ctx, "GET", "/v2/dids/"+url.PathEscape(id)+"/history", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.History, nil
+}
+
+func powRequired(err error) bool {
+	p, ok := err.(*Problem)
+	return ok && p.Code == "pow_required"
+}
+
+// proofOfWork gets a puzzle and solves it for the DID id
+func (c *Client) proofOfWork(ctx context.Context, id string) (*PoW, error) {
+	puzzle, err := c.Puzzle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Solve(ctx, puzzle, id)
+}
+
+// Solve finds a nonce that gives the puzzle's hash for the DID id as many leading zero bits as
+// its difficulty asks
+func Solve(ctx context.Context, puzzle *Puzzle, id string) (*PoW, error) {
+	for n := 0; ; n++ {
+		if n%4096 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		nonce := strconv.Itoa(n)
+		hashed := sha256.Sum256([]byte(puzzle.Puzzle + "." + id + "." + nonce))
+		if leadingZeroBits(hashed[:]) >= puzzle.Difficulty {
+			return &PoW{Puzzle: puzzle.Puzzle, Nonce: nonce}, nil
+		}
+	}
+}
+
+func leadingZeroBits(h []byte) int {
+	bits := 0
+	for _, b := range h {
+		if b != 0 {
+			for b&0x80 == 0 {
+				bits++
+				b <<= 1
+			}
+			return bits
+		}
+		bits += 8
+	}
+	return bits
+}
@@ -0,0 +1,228 @@
+package didclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeServer plays the server's side of registering, superseding and revoking DIDs, checking
+// the signatures and secrets it is sent
+type fakeServer struct {
+	masterPublic *[32]byte
+	masterSecret *[32]byte
+	secrets      map[string][]byte // registration secrets by root
+	roots        map[string]string // roots by DID id
+	keys         map[string][]byte // signing public keys by DID id
+	status       map[string]string
+}
+
+func newFakeServer() *httptest.Server {
+	public, secret, _ := box.GenerateKey(rand.Reader)
+	f := &fakeServer{masterPublic: public, masterSecret: secret,
+		secrets: map[string][]byte{}, roots: map[string]string{}, keys: map[string][]byte{}, status: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"masterPublicKey": encode(f.masterPublic[:])})
+	})
+	mux.HandleFunc("/v2/pow", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Puzzle{Puzzle: "puzzle", Difficulty: 8})
+	})
+	mux.HandleFunc("/v2/register", f.register)
+	mux.HandleFunc("/v2/supersede", f.supersede)
+	mux.HandleFunc("/v2/confirm", f.confirm)
+	mux.HandleFunc("/v2/confirmSupersede", f.confirm)
+	mux.HandleFunc("/v2/revoke", f.revoke)
+	mux.HandleFunc("/v2/dids/", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[len("/v2/dids/"):]
+		if f.status[id] == "" {
+			problem(w, http.StatusNotFound, "not_found", "DID not found")
+			return
+		}
+		json.NewEncoder(w).Encode(Resolution{ID: id, Status: f.status[id]})
+	})
+	return httptest.NewServer(mux)
+}
+
+func problem(w http.ResponseWriter, status int, code string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{Status: status, Code: code, Detail: detail})
+}
+
+func (f *fakeServer) verify(id string, message string, signature string) bool {
+	sig, _ := decode(signature)
+	hashed := sha256.Sum256([]byte(message))
+	return ed25519.Verify(ed25519.PublicKey(f.keys[id]), hashed[:], sig)
+}
+
+func (f *fakeServer) record(w http.ResponseWriter, doc *Document, signature string, pow *PoW) bool {
+	if pow == nil {
+		problem(w, http.StatusPreconditionRequired, "pow_required", "proof of work is required")
+		return false
+	}
+	hashed := sha256.Sum256([]byte(pow.Puzzle + "." + doc.ID + "." + pow.Nonce))
+	if leadingZeroBits(hashed[:]) < 8 {
+		problem(w, http.StatusBadRequest, "pow_invalid", "proof of work is not solved")
+		return false
+	}
+	key, _ := decode(doc.ID[len("did:jlinc:"):])
+	f.keys[doc.ID] = key
+	if !f.verify(doc.ID, doc.ID+"."+doc.Created, signature) {
+		problem(w, http.StatusBadRequest, "signature_invalid", "signature is invalid")
+		return false
+	}
+	f.status[doc.ID] = "init"
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Challenge{ID: doc.ID, Challenge: "challenge-" + doc.ID})
+	return true
+}
+
+func (f *fakeServer) register(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	cyphertext, _ := decode(req.Secret.Cyphertext)
+	nonceBytes, _ := decode(req.Secret.Nonce)
+	encryptingKey, _ := decode(req.DID.PublicKeys[1].PublicKeyBase64)
+	var nonce [24]byte
+	var encrypting [32]byte
+	copy(nonce[:], nonceBytes)
+	copy(encrypting[:], encryptingKey)
+	secret, ok := box.Open(nil, cyphertext, &nonce, &encrypting, f.masterSecret)
+	if !ok {
+		problem(w, http.StatusBadRequest, "secret_invalid", "secret does not decrypt")
+		return
+	}
+	if f.record(w, req.DID, req.Signature, req.PoW) {
+		f.roots[req.DID.ID] = req.DID.ID
+		f.secrets[req.DID.ID] = secret
+	}
+}
+
+func (f *fakeServer) supersede(w http.ResponseWriter, r *http.Request) {
+	var req SupersedeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	if f.status[req.Supersedes] != "verified" || !f.verify(req.Supersedes, req.DID.ID, req.SupersedesSignature) {
+		problem(w, http.StatusBadRequest, "supersedes_invalid", "supersedes signature is invalid")
+		return
+	}
+	if f.record(w, req.DID, req.Signature, req.PoW) {
+		f.roots[req.DID.ID] = f.roots[req.Supersedes]
+		f.status[req.Supersedes] = "superseded"
+	}
+}
+
+// claims checks a JWT is signed with the root secret of the DID it names
+func (f *fakeServer) claims(token string) (jwt.MapClaims, bool) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(tok *jwt.Token) (interface{}, error) {
+		id, _ := tok.Claims.(jwt.MapClaims)["id"].(string)
+		return f.secrets[f.roots[id]], nil
+	})
+	return claims, err == nil
+}
+
+func (f *fakeServer) confirm(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChallengeResponse string `json:"challengeResponse"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	claims, ok := f.claims(req.ChallengeResponse)
+	id, _ := claims["id"].(string)
+	signature, _ := claims["signature"].(string)
+	if !ok || !f.verify(id, "challenge-"+id, signature) {
+		problem(w, http.StatusUnauthorized, "unauthorized", "challenge response is invalid")
+		return
+	}
+	f.status[id] = "verified"
+	json.NewEncoder(w).Encode(Status{ID: id, Status: "verified"})
+}
+
+func (f *fakeServer) revoke(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RevokeRequest string `json:"revokeRequest"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	claims, ok := f.claims(req.RevokeRequest)
+	if !ok {
+		problem(w, http.StatusUnauthorized, "unauthorized", "revoke request is invalid")
+		return
+	}
+	id, _ := claims["id"].(string)
+	f.status[id] = "revoked"
+	json.NewEncoder(w).Encode(Status{ID: id, Status: "revoked"})
+}
+
+func TestLifecycle(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	client := New(server.URL + "/")
+	ctx := context.Background()
+
+	first, err := client.RegisterDID(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := client.Resolve(ctx, first.ID); err != nil || res.Status != "verified" {
+		t.Fatalf("registered DID: got %+v %v", res, err)
+	}
+
+	second, err := client.SupersedeDID(ctx, first, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Root != first.ID || string(second.Secret) != string(first.Secret) {
+		t.Errorf("superseding DID should keep the chain's root and secret")
+	}
+	if res, _ := client.Resolve(ctx, first.ID); res.Status != "superseded" {
+		t.Errorf("superseded DID: got %q", res.Status)
+	}
+
+	if err = client.RevokeDID(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := client.Resolve(ctx, second.ID); res.Status != "revoked" {
+		t.Errorf("revoked DID: got %q", res.Status)
+	}
+}
+
+func TestProblem(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+
+	_, err := New(server.URL).Resolve(context.Background(), "did:jlinc:unknown")
+	p, ok := err.(*Problem)
+	if !ok || p.Status != http.StatusNotFound || p.Code != "not_found" {
+		t.Fatalf("got %#v", err)
+	}
+	if p.Error() != "didserver: DID not found (not_found)" {
+		t.Errorf("unexpected message %q", p.Error())
+	}
+}
+
+func TestSolve(t *testing.T) {
+	pow, err := Solve(context.Background(), &Puzzle{Puzzle: "abc", Difficulty: 12}, "did:jlinc:x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte("abc.did:jlinc:x." + pow.Nonce))
+	if leadingZeroBits(hashed[:]) < 12 {
+		t.Errorf("nonce %s does not solve the puzzle", pow.Nonce)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Solve(ctx, &Puzzle{Puzzle: "abc", Difficulty: 256}, "did:jlinc:x"); err != context.Canceled {
+		t.Errorf("cancelled solve: got %v", err)
+	}
+}
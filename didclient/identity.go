@@ -0,0 +1,82 @@
+package didclient
+
+import (
+	"context"
+	"time"
+)
+
+// Identity is a registered DID with the keys and registration secret that control it
+type Identity struct {
+	ID       string    `json:"id"`
+	Root     string    `json:"root"`
+	Keys     *Keys     `json:"keys"`
+	Secret   []byte    `json:"secret"` // the chain's registration secret
+	Document *Document `json:"document"`
+}
+
+// RegisterDID makes new keys and a registration secret, and registers and confirms a version 1 or
+// 2 DID for them. Invite is only needed on invite-only servers.
+func (c *Client) RegisterDID(ctx context.Context, version int, invite string) (*Identity, error) {
+	keys, err := GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := NewDocument(keys, version, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	secret, err := NewRegistrationSecret()
+	if err != nil {
+		return nil, err
+	}
+	master, err := c.MasterPublicKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := keys.EncryptSecret(secret, master)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := c.Register(ctx, &RegisterRequest{DID: doc, Signature: keys.SignDocument(doc), Secret: encrypted, Invite: invite})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.Confirm(ctx, challenge, keys, secret); err != nil {
+		return nil, err
+	}
+	return &Identity{ID: doc.ID, Root: doc.ID, Keys: keys, Secret: secret, Document: doc}, nil
+}
+
+// SupersedeDID makes new keys and registers and confirms a version 1 or 2 DID for them that
+// supersedes the identity's DID. The new identity keeps the chain's root and secret.
+func (c *Client) SupersedeDID(ctx context.Context, current *Identity, version int) (*Identity, error) {
+	keys, err := GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := NewDocument(keys, version, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := c.Supersede(ctx, &SupersedeRequest{
+		DID:                 doc,
+		Signature:           keys.SignDocument(doc),
+		Supersedes:          current.ID,
+		SupersedesSignature: current.Keys.SignSupersedes(doc.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.ConfirmSupersede(ctx, challenge, keys, current.Secret); err != nil {
+		return nil, err
+	}
+	return &Identity{ID: doc.ID, Root: current.Root, Keys: keys, Secret: current.Secret, Document: doc}, nil
+}
+
+// RevokeDID revokes the identity's DID
+func (c *Client) RevokeDID(ctx context.Context, identity *Identity) error {
+	_, err := c.Revoke(ctx, identity.ID, identity.Secret)
+	return err
+}
@@ -0,0 +1,209 @@
+// Package didclient registers, supersedes, revokes and resolves JLINC DIDs with a DID server.
+// It builds and signs DID documents itself, so nothing else is needed to drive the server.
+package didclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/shengdoushi/base58"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The @context of each version of DID document the server accepts
+const (
+	ContextV1 = "https://w3id.org/did/v1"
+	ContextV2 = "https://www.w3.org/ns/did/v1"
+)
+
+// SecretFormat is the format EncryptSecret produces, the server's crypto_box_easy
+const SecretFormat = "crypto_box_easy"
+
+// Keys are a DID's ed25519 signing keypair and curve25519 encrypting keypair
+type Keys struct {
+	SigningPublicKey    []byte `json:"signingPublicKey"`
+	SigningSecretKey    []byte `json:"signingSecretKey"`
+	EncryptingPublicKey []byte `json:"encryptingPublicKey"`
+	EncryptingSecretKey []byte `json:"encryptingSecretKey"`
+}
+
+// GenerateKeys makes new signing and encrypting keypairs
+func GenerateKeys() (*Keys, error) {
+	signingPublic, signingSecret, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encryptingPublic, encryptingSecret, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{
+		SigningPublicKey:    signingPublic,
+		SigningSecretKey:    signingSecret,
+		EncryptingPublicKey: encryptingPublic[:],
+		EncryptingSecretKey: encryptingSecret[:],
+	}, nil
+}
+
+// ID is the DID id for the keys, did:jlinc: followed by the signing public key
+func (k *Keys) ID() string {
+	return "did:jlinc:" + encode(k.SigningPublicKey)
+}
+
+// sign signs the SHA-256 hash of a message, as the server verifies signatures
+func (k *Keys) sign(message string) string {
+	hashed := sha256.Sum256([]byte(message))
+	return encode(ed25519.Sign(ed25519.PrivateKey(k.SigningSecretKey), hashed[:]))
+}
+
+// SignDocument signs a DID document's id and created time, for its registration
+func (k *Keys) SignDocument(doc *Document) string {
+	return k.sign(doc.ID + "." + doc.Created)
+}
+
+// SignChallenge signs the challenge the server issued for a registration
+func (k *Keys) SignChallenge(challenge string) string {
+	return k.sign(challenge)
+}
+
+// SignSupersedes signs the id of the DID that supersedes the keys' DID
+func (k *Keys) SignSupersedes(id string) string {
+	return k.sign(id)
+}
+
+// Sign signs a message, to be checked with Verify against the DID's signing key
+func (k *Keys) Sign(message string) string {
+	return k.sign(message)
+}
+
+// Document is a DID document
+type Document struct {
+	Context    string      `json:"@context"`
+	ID         string      `json:"id"`
+	Created    string      `json:"created"`
+	PublicKeys []PublicKey `json:"publicKey"`
+}
+
+// PublicKey is a key in a DID document. Version 1 documents give keys an owner and base64
+// value, version 2 documents a controller and base58 value.
+type PublicKey struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	Owner           string `json:"owner,omitempty"`
+	Controller      string `json:"controller,omitempty"`
+	PublicKeyBase64 string `json:"publicKeyBase64,omitempty"`
+	PublicKeyBase58 string `json:"publicKeyBase58,omitempty"`
+}
+
+// NewDocument builds a version 1 or 2 DID document for the keys, created at the given time
+func NewDocument(k *Keys, version int, created time.Time) (*Document, error) {
+	id := k.ID()
+	doc := &Document{ID: id, Created: created.UTC().Format(time.RFC3339)}
+	switch version {
+	case 1:
+		doc.Context = ContextV1
+		doc.PublicKeys = []PublicKey{
+			{ID: id + "#signing", Type: "ed25519", Owner: id, PublicKeyBase64: encode(k.SigningPublicKey)},
+			{ID: id + "#encrypting", Type: "curve25519", Owner: id, PublicKeyBase64: encode(k.EncryptingPublicKey)},
+		}
+	case 2:
+		doc.Context = ContextV2
+		doc.PublicKeys = []PublicKey{
+			{ID: id + "#signing", Type: "Ed25519VerificationKey2018", Controller: id, PublicKeyBase58: base58.Encode(k.SigningPublicKey, base58.BitcoinAlphabet)},
+			{ID: id + "#encrypting", Type: "X25519KeyAgreementKey2019", Controller: id, PublicKeyBase58: base58.Encode(k.EncryptingPublicKey, base58.BitcoinAlphabet)},
+		}
+	default:
+		return nil, fmt.Errorf("DID document version must be 1 or 2, not %d", version)
+	}
+	return doc, nil
+}
+
+// SigningKey takes the ed25519 signing public key from a version 1 or 2 DID document
+func SigningKey(doc json.RawMessage) ([]byte, error) {
+	var d Document
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return nil, err
+	}
+	for _, pk := range d.PublicKeys {
+		if pk.ID != d.ID+"#signing" {
+			continue
+		}
+		if pk.PublicKeyBase58 != "" {
+			return base58.Decode(pk.PublicKeyBase58, base58.BitcoinAlphabet)
+		}
+		return decode(pk.PublicKeyBase64)
+	}
+	return nil, errors.New("DID document has no signing key")
+}
+
+// Verify checks a signature made as the keys' Sign methods make them, over the SHA-256 hash of
+// the message
+func Verify(publicKey []byte, message string, signature string) bool {
+	sig, err := decode(signature)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	hashed := sha256.Sum256([]byte(message))
+	return ed25519.Verify(ed25519.PublicKey(publicKey), hashed[:], sig)
+}
+
+// Secret is a registration secret encrypted to the server's master public key
+type Secret struct {
+	Cyphertext string `json:"cyphertext"`
+	Nonce      string `json:"nonce,omitempty"`
+	Format     string `json:"format,omitempty"`
+}
+
+// NewRegistrationSecret makes a random registration secret. The server keeps it encrypted,
+// and it signs the JWTs that confirm, revoke and otherwise manage the DID's chain.
+func NewRegistrationSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncryptSecret encrypts a registration secret from the keys' encrypting key to the server's
+// master public key, as GET / gives it
+func (k *Keys) EncryptSecret(secret []byte, masterPublicKey string) (Secret, error) {
+	master, err := decode(masterPublicKey)
+	if err != nil || len(master) != 32 {
+		return Secret{}, errors.New("master public key must be 32 bytes, base64url encoded")
+	}
+	if len(k.EncryptingSecretKey) != 32 {
+		return Secret{}, errors.New("encrypting secret key must be 32 bytes")
+	}
+
+	var nonce [24]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return Secret{}, err
+	}
+	var masterKey, encryptingKey [32]byte
+	copy(masterKey[:], master)
+	copy(encryptingKey[:], k.EncryptingSecretKey)
+
+	sealed := box.Seal(nil, secret, &nonce, &masterKey, &encryptingKey)
+	return Secret{Cyphertext: encode(sealed), Nonce: encode(nonce[:]), Format: SecretFormat}, nil
+}
+
+// signedJWT is an HS256 JWT of the claims signed with a registration secret, as the server
+// expects of confirm, revoke and self custody requests
+func signedJWT(claims jwt.MapClaims, secret []byte) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,118 @@
+package didclient
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shengdoushi/base58"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestNewDocument(t *testing.T) {
+	keys, err := GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := keys.ID()
+	if !strings.HasPrefix(id, "did:jlinc:") {
+		t.Errorf("unexpected id %q", id)
+	}
+
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.FixedZone("x", 3600))
+	v1, err := NewDocument(keys, 1, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Context != ContextV1 || v1.Created != "2020-05-01T11:00:00Z" {
+		t.Errorf("unexpected v1 document %+v", v1)
+	}
+	if v1.PublicKeys[0].PublicKeyBase64 != encode(keys.SigningPublicKey) || v1.PublicKeys[1].Owner != id {
+		t.Errorf("unexpected v1 keys %+v", v1.PublicKeys)
+	}
+
+	v2, err := NewDocument(keys, 2, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := base58.Decode(v2.PublicKeys[1].PublicKeyBase58, base58.BitcoinAlphabet)
+	if err != nil || string(decoded) != string(keys.EncryptingPublicKey) {
+		t.Errorf("v2 encrypting key does not decode: %v", err)
+	}
+	if v2.Context != ContextV2 || v2.PublicKeys[0].Type != "Ed25519VerificationKey2018" || v2.PublicKeys[0].Controller != id {
+		t.Errorf("unexpected v2 document %+v", v2)
+	}
+
+	if _, err = NewDocument(keys, 3, created); err == nil {
+		t.Errorf("version 3 should be refused")
+	}
+}
+
+func TestSignDocument(t *testing.T) {
+	keys, _ := GenerateKeys()
+	doc, _ := NewDocument(keys, 1, time.Now())
+
+	sig, err := decode(keys.SignDocument(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte(doc.ID + "." + doc.Created))
+	if !ed25519.Verify(ed25519.PublicKey(keys.SigningPublicKey), hashed[:], sig) {
+		t.Errorf("document signature does not verify")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys, _ := GenerateKeys()
+	for _, version := range []int{1, 2} {
+		doc, _ := NewDocument(keys, version, time.Now())
+		jsn, _ := json.Marshal(doc)
+		key, err := SigningKey(jsn)
+		if err != nil || string(key) != string(keys.SigningPublicKey) {
+			t.Fatalf("version %d signing key: got %v", version, err)
+		}
+		if !Verify(key, "hello", keys.Sign("hello")) {
+			t.Errorf("version %d: signature does not verify", version)
+		}
+		if Verify(key, "goodbye", keys.Sign("hello")) {
+			t.Errorf("version %d: signature verifies for the wrong message", version)
+		}
+	}
+
+	if _, err := SigningKey(json.RawMessage(`{"id":"did:jlinc:x","publicKey":[]}`)); err == nil {
+		t.Errorf("document without a signing key should be refused")
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	masterPublic, masterSecret, _ := box.GenerateKey(rand.Reader)
+	keys, _ := GenerateKeys()
+	secret, _ := NewRegistrationSecret()
+
+	encrypted, err := keys.EncryptSecret(secret, encode(masterPublic[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted.Format != SecretFormat {
+		t.Errorf("unexpected format %q", encrypted.Format)
+	}
+
+	cyphertext, _ := decode(encrypted.Cyphertext)
+	nonceBytes, _ := decode(encrypted.Nonce)
+	var nonce [24]byte
+	var encryptingPublic [32]byte
+	copy(nonce[:], nonceBytes)
+	copy(encryptingPublic[:], keys.EncryptingPublicKey)
+	opened, ok := box.Open(nil, cyphertext, &nonce, &encryptingPublic, masterSecret)
+	if !ok || string(opened) != string(secret) {
+		t.Errorf("secret does not decrypt with the master key")
+	}
+
+	if _, err = keys.EncryptSecret(secret, "short"); err == nil {
+		t.Errorf("bad master key should be refused")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -18,12 +19,17 @@ var DB *sql.DB
 
 // Config holds app configuration data from config.toml
 type Config struct {
-	Database database
-	Keys     keys
-	At       at
-	App      app
-	APIAuth  map[string]string `toml:"api_auth"`
-	IsTest   bool
+	Database   database
+	Keys       keys
+	At         at
+	App        app
+	APIAuth    map[string]string `toml:"api_auth"`
+	Admin      admin
+	TLS        tlsConfig
+	PoW        pow
+	RateLimits rateLimits `toml:"rate_limits"`
+	OpenAPI    openAPI    `toml:"openapi"`
+	IsTest     bool
 }
 
 type database struct {
@@ -31,24 +37,99 @@ type database struct {
 }
 
 type keys struct {
+	Public        string            `toml:"public"`
+	Secret        string            `toml:"secret"`
+	Rekey         bool              `toml:"rekey"`
+	Envelope      bool              `toml:"envelope"`
+	KEK           string            `toml:"kek"` // id of the key-encryption key that wraps new envelopes
+	Ring          []keypair         `toml:"ring"`
+	Provider      string            `toml:"provider"`
+	SecretFile    string            `toml:"secret_file"`
+	SecretEnv     string            `toml:"secret_env"`
+	KEKs          map[string]string `toml:"keks"` // key-encryption keys by id, for the config provider
+	KEKFile       string            `toml:"kek_file"`
+	KEKEnv        string            `toml:"kek_env"`
+	Keystore      string            `toml:"keystore"`
+	PassphraseEnv string            `toml:"passphrase_env"`
+	Command       []string          `toml:"command"`
+}
+
+// keypair is a retired master keypair, kept to decrypt secrets encrypted to it.
+// Secret is only needed when the secret keys come from config.toml.
+type keypair struct {
 	Public string `toml:"public"`
 	Secret string `toml:"secret"`
 }
 
+// admin holds the bearer tokens accepted by the /admin API
+type admin struct {
+	Tokens []string `toml:"tokens"`
+}
+
+// tlsConfig has the server's certificate and the CAs that sign agents' client certificates
+type tlsConfig struct {
+	CertFile          string `toml:"cert_file"`
+	KeyFile           string `toml:"key_file"`
+	ClientCAFile      string `toml:"client_ca_file"`
+	RequireClientCert bool   `toml:"require_client_cert"`
+}
+
+// pow sets the proof of work asked of /register and /supersede
+type pow struct {
+	Enabled         bool `toml:"enabled"`
+	Difficulty      int  `toml:"difficulty"`        // leading zero bits of a puzzle's hash
+	MaxDifficulty   int  `toml:"max_difficulty"`    // however many puzzles are issued
+	TargetPerMinute int  `toml:"target_per_minute"` // puzzles a minute before the difficulty rises
+}
+
+// rateLimits are token buckets for each route group, off when a group's rate is 0
+type rateLimits struct {
+	Shared  bool      `toml:"shared"` // keep the buckets in the database, for servers behind a load balancer
+	Resolve rateLimit `toml:"resolve"`
+	Write   rateLimit `toml:"write"`
+	Agent   rateLimit `toml:"agent"`
+}
+
+type rateLimit struct {
+	Rate  float64 `toml:"rate"`  // requests a second
+	Burst int     `toml:"burst"` // requests at once
+	Key   string  `toml:"key"`   // ip, agent or did
+}
+
+// openAPI sets how the OpenAPI document served at /openapi.json is used
+type openAPI struct {
+	Validate bool `toml:"validate"` // check /v2 requests against it
+}
+
 type at struct {
 	ContextV1 string `toml:"contextV1"`
 	ContextV2 string `toml:"contextV2"`
 }
 
 type app struct {
-	URL  string `toml:"url"`
-	Port string `toml:"port"`
+	URL              string `toml:"url"`
+	Port             string `toml:"port"`
+	RegistrationMode string `toml:"registration_mode"` // open, invite-only or agent-only
 }
 
 // Conf is a global configuration handle
 var Conf Config
 
 func main() {
+	// run a command instead of the server if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := setup(); err != nil {
+		log.Fatal(err)
+		return
+	}
+	defer DB.Close()
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -56,46 +137,119 @@ func main() {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.NoCache)
+	r.Use(clientCertAgent)
 
 	// Set a timeout value on the request context (ctx), that will signal
 	// through ctx.Done() that the request has timed out and further
 	// processing should be stopped.
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	r.Get("/", indexstr)
-	r.Get("/{DID}", resolve)
-	r.Get("/root/{DID}", resolveRoot)
-	r.Get("/history/{DID}", history)
+	// errors are application/problem+json, including for routes that don't exist
+	r.NotFound(notFound)
+	r.MethodNotAllowed(methodNotAllowed)
 
-	r.Post("/register", registerDID)
-	r.Post("/confirm", registerConfirm)
-	r.Post("/agentRegister", agentRegister)
-	r.Post("/supersede", supersedeDID)
-	r.Post("/confirmSupersede", confirmSupersede)
-	r.Post("/revoke", revoke)
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("resolve"))
+		r.Get("/", indexstr)
+		r.Get("/pow", powPuzzle)
+		r.Get("/openapi.json", serveOpenAPI)
+		r.Get("/{DID}", resolve)
+		r.Get("/root/{DID}", resolveRoot)
+		r.Get("/history/{DID}", history)
+	})
 
-	if _, err := toml.DecodeFile("./config.toml", &Conf); err != nil {
-		log.Fatal(err)
-		return
+	// POSTs with an Idempotency-Key header can be retried safely, once they're within the rate limit
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("write"), idempotent)
+		r.Post("/validate", validateDID)
+		r.Post("/register", registerDID)
+		r.Post("/confirm", registerConfirm)
+		r.Post("/supersede", supersedeDID)
+		r.Post("/confirmSupersede", confirmSupersede)
+		r.Post("/revoke", revoke)
+		r.Post("/rotateSecret", rotateSecret)
+		r.Post("/selfCustody", selfCustody)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("agent"), idempotent)
+		r.Post("/agentRegister", agentRegister)
+		r.Post("/agentRegisterBatch", agentRegisterBatch)
+		r.Post("/agentSupersede", agentSupersede)
+		r.Post("/agentRevoke", agentRevoke)
+		r.With(agentAuth(scopeRead), paginate).Get("/agent/dids", agentListDIDs)
+		r.With(agentAuth(scopeInvite)).Get("/agent/invites", agentListInvites)
+		r.With(agentAuth(scopeInvite)).Post("/agent/invites", agentCreateInvite)
+		r.With(agentAuth(scopeInvite)).Delete("/agent/invites/{inviteID}", agentRevokeInvite)
+	})
+
+	r.Mount("/v2", v2Router())
+	r.Mount("/admin", adminRouter())
+
+	// move stored secrets onto the current master key
+	if Conf.Keys.Rekey {
+		go func() {
+			n, err := rekey(100, time.Second)
+			log.Printf("rekey: examined %d stored secrets, error: %v", n, err)
+		}()
 	}
 
-	// Get a database connection
-	connStr := Conf.Database.ConnectionString
-	var err error
-	DB, err = sql.Open("postgres", connStr)
-	defer DB.Close()
+	// Start the server, over TLS when there's a certificate
+	if Conf.TLS.CertFile == "" {
+		log.Fatal(http.ListenAndServe(Conf.App.Port, r))
+	}
+	tlsConfig, err := serverTLSConfig(Conf.TLS)
 	if err != nil {
 		log.Fatal(err)
-		return
 	}
+	server := &http.Server{Addr: Conf.App.Port, Handler: r, TLSConfig: tlsConfig}
+	log.Fatal(server.ListenAndServeTLS(Conf.TLS.CertFile, Conf.TLS.KeyFile))
+}
 
-	if err := DB.Ping(); err != nil {
-		log.Fatal(err)
-		return
+// read config.toml and get a database connection
+func setup() error {
+	if _, err := toml.DecodeFile("./config.toml", &Conf); err != nil {
+		return err
+	}
+
+	if !validRegistrationMode(Conf.App.RegistrationMode) {
+		return fmt.Errorf("unknown registration_mode %q, use open, invite-only or agent-only", Conf.App.RegistrationMode)
+	}
+	for agentkey := range Conf.APIAuth {
+		if reservedAgentIDs[agentkey] {
+			return fmt.Errorf("api_auth agent id %q is reserved", agentkey)
+		}
+	}
+	for _, group := range []string{"resolve", "write", "agent"} {
+		if key := Conf.RateLimits.group(group).Key; !validRateLimitKey(key) {
+			return fmt.Errorf("unknown rate_limits.%s key %q, use ip, agent or did", group, key)
+		}
+	}
+
+	// make sure the current master secret key is available
+	var err error
+	if Keys, err = newKeyProvider(Conf.Keys); err != nil {
+		return err
+	}
+	if _, err = Keys.SecretKey(Conf.Keys.Public); err != nil {
+		return err
+	}
+	// and the current key-encryption key, which envelope encryption can't do without
+	if Conf.Keys.KEK != "" {
+		if _, err = keyEncryptionKey(Conf.Keys.KEK, ""); err != nil {
+			return err
+		}
+	} else if Conf.Keys.Envelope {
+		return errNoKEK
+	}
+
+	connStr := Conf.Database.ConnectionString
+	DB, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return err
 	}
 
-	// Start the server
-	log.Fatal(http.ListenAndServe(Conf.App.Port, r))
+	return DB.Ping()
 }
 
 // Index page
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// values sealed in an envelope are stored with this prefix, anything else is plaintext
+const envelopePrefix = "env:"
+
+// errNoKEK is returned when an envelope is needed but no key-encryption key is configured
+var errNoKEK = errors.New("envelope encryption needs a key-encryption key, set kek in [keys]")
+
+// envelope holds the data key that seals the sensitive columns of one row. The data key is
+// stored wrapped by a key-encryption key (KEK) that the key provider supplies apart from the
+// master keys, so that a copy of the database and the master secret key together still don't
+// open it. Envelopes made before KEKs were separate name no KEK and are wrapped by a key derived
+// from a master secret key, until rekey rewraps them. A nil *envelope leaves values as they are.
+type envelope struct {
+	dataKey [32]byte
+	key     string // the wrapped data key, stored in envelope_key
+	kek     string // the id of the KEK that wrapped it, stored in envelope_kek
+	master  string // for older envelopes, the master public key it was wrapped by, in envelope_master
+}
+
+// keyEncryptionKey returns the KEK with the given id, or for an older envelope without one,
+// the key derived from the master key that wrapped it
+func keyEncryptionKey(kek string, master string) (*[32]byte, error) {
+	var key []byte
+	var err error
+	if kek != "" {
+		key, err = keyProvider().KeyEncryptionKey(kek)
+	} else {
+		key, err = legacyKeyEncryptionKey(master)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key-encryption key %s is %d bytes, not 32", kek, len(key))
+	}
+	var k [32]byte
+	copy(k[:], key)
+	return &k, nil
+}
+
+// legacyKeyEncryptionKey derives the key that wrapped data keys before KEKs were kept apart
+// from the master keys
+func legacyKeyEncryptionKey(master string) ([]byte, error) {
+	sk, err := keyProvider().SecretKey(master)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sk)
+	mac.Write([]byte("didserver envelope key-encryption key"))
+	return mac.Sum(nil), nil
+}
+
+// newEnvelope creates an envelope with a fresh data key wrapped by the current KEK
+func newEnvelope() (*envelope, error) {
+	if Conf.Keys.KEK == "" {
+		return nil, errNoKEK
+	}
+	e := &envelope{}
+	if _, err := rand.Read(e.dataKey[:]); err != nil {
+		return nil, err
+	}
+	if err := e.wrap(Conf.Keys.KEK); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// openEnvelope unwraps a stored data key. Rows without one have no envelope.
+func openEnvelope(key string, kek string, master string) (*envelope, error) {
+	if key == "" {
+		return nil, nil
+	}
+	k, err := keyEncryptionKey(kek, master)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := secretOpen(key, k)
+	if err != nil || len(dataKey) != 32 {
+		return nil, errors.New("unable to unwrap envelope key")
+	}
+	e := &envelope{key: key, kek: kek, master: master}
+	copy(e.dataKey[:], dataKey)
+	return e, nil
+}
+
+// wrap wraps the data key with the KEK with the given id
+func (e *envelope) wrap(kek string) error {
+	if kek == "" {
+		return errNoKEK
+	}
+	k, err := keyEncryptionKey(kek, "")
+	if err != nil {
+		return err
+	}
+	if e.key, err = secretSeal(e.dataKey[:], k); err != nil {
+		return err
+	}
+	e.kek, e.master = kek, ""
+	return nil
+}
+
+// stored returns the values for the envelope_key, envelope_kek and envelope_master columns
+func (e *envelope) stored() (string, string, string) {
+	if e == nil {
+		return "", "", ""
+	}
+	return e.key, e.kek, e.master
+}
+
+func (e *envelope) seal(value string) (string, error) {
+	if e == nil || value == "" {
+		return value, nil
+	}
+	sealed, err := secretSeal([]byte(value), &e.dataKey)
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + sealed, nil
+}
+
+func (e *envelope) open(value string) (string, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return value, nil
+	}
+	if e == nil {
+		return "", errors.New("sealed value without an envelope key")
+	}
+	opened, err := secretOpen(strings.TrimPrefix(value, envelopePrefix), &e.dataKey)
+	if err != nil {
+		return "", err
+	}
+	return string(opened), nil
+}
+
+// sealValues seals each of the values in place
+func (e *envelope) sealValues(values ...*string) error {
+	for _, v := range values {
+		sealed, err := e.seal(*v)
+		if err != nil {
+			return err
+		}
+		*v = sealed
+	}
+	return nil
+}
+
+// openValues opens each of the values in place
+func (e *envelope) openValues(values ...*string) error {
+	for _, v := range values {
+		opened, err := e.open(*v)
+		if err != nil {
+			return err
+		}
+		*v = opened
+	}
+	return nil
+}
+
+// secretSeal encrypts with secretbox, returning the nonce and box base64url encoded together
+func secretSeal(message []byte, key *[32]byte) (string, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	return b64Encode(secretbox.Seal(nonce[:], message, &nonce, key)), nil
+}
+
+func secretOpen(sealed string, key *[32]byte) ([]byte, error) {
+	decoded := b64Decode(sealed)
+	if len(decoded) < 24+secretbox.Overhead {
+		return nil, errors.New("sealed value too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], decoded[:24])
+	message, ok := secretbox.Open(nil, decoded[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("unable to open sealed value")
+	}
+	return message, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+)
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+
+	env, err := newEnvelope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := env.seal("registration secret")
+	if err != nil || !strings.HasPrefix(sealed, envelopePrefix) {
+		t.Fatalf("value was not sealed: got %q with error %v", sealed, err)
+	}
+
+	// the stored data key opens it again, with the KEK it names
+	key, kek, master := env.stored()
+	if kek != Conf.Keys.KEK || master != "" {
+		t.Errorf("envelope should name the current KEK: got %q and master %q", kek, master)
+	}
+	opened, err := openEnvelope(key, kek, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := opened.open(sealed); err != nil || value != "registration secret" {
+		t.Errorf("sealed value did not open: got %q with error %v", value, err)
+	}
+
+	// a data key wrapped by another KEK doesn't unwrap
+	Conf.Keys.KEKs["next-kek"] = b64Encode([]byte("another thirty-two byte test key"))
+	defer delete(Conf.Keys.KEKs, "next-kek")
+	if _, err := openEnvelope(key, "next-kek", ""); err == nil {
+		t.Errorf("envelope key unwrapped with the wrong KEK")
+	}
+	if _, err := openEnvelope(key, "unknown-kek", ""); err == nil {
+		t.Errorf("envelope key unwrapped with an unknown KEK")
+	}
+
+	// rewrapping keeps the data key
+	if err = opened.wrap("next-kek"); err != nil {
+		t.Fatal(err)
+	}
+	key, kek, master = opened.stored()
+	rewrapped, err := openEnvelope(key, kek, master)
+	if err != nil || kek != "next-kek" {
+		t.Fatalf("rewrapped envelope did not open: %v", err)
+	}
+	if value, err := rewrapped.open(sealed); err != nil || value != "registration secret" {
+		t.Errorf("sealed value did not open after rewrapping: got %q with error %v", value, err)
+	}
+
+	// an older envelope wrapped by a key derived from the master key still opens, and rewraps to a KEK
+	derived, err := legacyKeyEncryptionKey(Conf.Keys.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacyKEK [32]byte
+	copy(legacyKEK[:], derived)
+	legacyKey, err := secretSeal(rewrapped.dataKey[:], &legacyKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := openEnvelope(legacyKey, "", Conf.Keys.Public)
+	if err != nil {
+		t.Fatalf("legacy envelope did not open: %v", err)
+	}
+	if err = legacy.wrap(Conf.Keys.KEK); err != nil {
+		t.Fatal(err)
+	}
+	if _, kek, master = legacy.stored(); kek != Conf.Keys.KEK || master != "" {
+		t.Errorf("legacy envelope was not rewrapped: got %q and master %q", kek, master)
+	}
+	if value, err := legacy.open(sealed); err != nil || value != "registration secret" {
+		t.Errorf("sealed value did not open after rewrapping a legacy envelope: got %q with error %v", value, err)
+	}
+
+	// rows without an envelope are plaintext
+	var none *envelope
+	if value, err := none.open("plaintext"); err != nil || value != "plaintext" {
+		t.Errorf("plaintext did not pass through: got %q with error %v", value, err)
+	}
+	if _, err := none.open(sealed); err == nil {
+		t.Errorf("sealed value opened without an envelope")
+	}
+}
+
+func TestEnvelopeRecordDID(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	Conf.Keys.Envelope = true
+	defer func() { Conf.Keys.Envelope = false }()
+
+	id := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	cypher, nonce, sender := sealToMaster([]byte("registration secret"), Conf.Keys.Public)
+	registration := Registration{
+		Root:          id,
+		EncryptingKey: sender,
+		Challenge:     "a challenge",
+		Status:        "init",
+		Secret:        secret{Cyphertext: cypher, Nonce: nonce, Format: secretFormatBox, MasterKey: Conf.Keys.Public},
+	}
+	registration.DID.ID = id
+	if err := recordDID(&registration); err != nil {
+		t.Fatalf("recordDID failed: %v", err)
+	}
+
+	var storedCypher, storedChallenge, envelopeKey string
+	DB.QueryRow("SELECT secret_cypher, challenge, envelope_key FROM didstore WHERE id = $1", id).Scan(&storedCypher, &storedChallenge, &envelopeKey)
+	if envelopeKey == "" || !strings.HasPrefix(storedCypher, envelopePrefix) || !strings.HasPrefix(storedChallenge, envelopePrefix) {
+		t.Errorf("registration was stored unsealed: cypher %q, challenge %q", storedCypher, storedChallenge)
+	}
+
+	secret, err := getJwtSecret(id)
+	if err != nil || string(secret) != "registration secret" {
+		t.Errorf("sealed secret did not decrypt: got %q with error %v", secret, err)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
@@ -10,15 +10,34 @@ import (
 	"github.com/lib/pq"
 )
 
+// historyEntry is one DID in a chain's history, with the time it became valid, was superseded or
+// was revoked
+type historyEntry struct {
+	DID        interface{} `json:"did"`
+	Valid      string      `json:"valid,omitempty"`
+	Superseded string      `json:"superseded,omitempty"`
+	Revoked    string      `json:"revoked,omitempty"`
+}
+
 func history(w http.ResponseWriter, r *http.Request) {
-	DIDstr := chi.URLParam(r, "DID")
-	if _, ok := getValidID(DIDstr); !ok {
-		w.Header().Set("Content-Type", "application/ld+json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"cannot parse request"}`))
+	results, p := didHistory(chi.URLParam(r, "DID"))
+	if p != nil {
+		p.write(w)
 		return
 	}
 
+	jsn, _ := json.Marshal(results)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"history":%s}`, jsn)
+}
+
+// didHistory lists every DID in the chain of a DID, oldest first
+func didHistory(DIDstr string) ([]historyEntry, *problem) {
+	if _, ok := getValidID(DIDstr); !ok {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidRequest, "cannot parse request")
+	}
+
 	type DidInstance struct {
 		DID        string
 		Status     string
@@ -31,10 +50,7 @@ func history(w http.ResponseWriter, r *http.Request) {
 	stmt, err := DB.Prepare("SELECT r.did, r.status, r.superseded_at, r.created, r.modified FROM didstore AS s JOIN didstore AS r ON s.root = r.root WHERE s.id = $1 AND r.status != 'init' ORDER BY r.created ASC")
 	defer stmt.Close()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-st"`)
-		return
+		return nil, databaseProblem("st")
 	}
 	rows, _ := stmt.Query(DIDstr)
 	defer rows.Close()
@@ -43,33 +59,21 @@ func history(w http.ResponseWriter, r *http.Request) {
 		i++
 		var didInstance DidInstance
 		if err = rows.Scan(&didInstance.DID, &didInstance.Status, &didInstance.Superseded, &didInstance.Created, &didInstance.Modified); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, `{"success":"false", "error":"database error-rs"`)
-			return
+			return nil, databaseProblem("rs")
 		}
 		instances = append(instances, didInstance)
 	}
 	if i == 0 { //no rows
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"status":"not found"}`))
-		return
+		return nil, newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	}
 
-	type HistoryResult struct { //container to be converted into the final JSON result
-		DID        interface{} `json:"did"`
-		Valid      string      `json:"valid,omitempty"`
-		Superseded string      `json:"superseded,omitempty"`
-		Revoked    string      `json:"revoked,omitempty"`
-	}
-	var results []HistoryResult
+	var results []historyEntry
 	type RawDid struct { //container for the DID object
 		DID interface{} `json:"did"`
 	}
 
 	for _, instance := range instances {
-		var historyResult HistoryResult
+		var historyResult historyEntry
 		var raw RawDid
 		//get the DID object into the HistoryResult struct field
 		json.Unmarshal([]byte(instance.DID), &raw)
@@ -90,9 +94,5 @@ func history(w http.ResponseWriter, r *http.Request) {
 
 		results = append(results, historyResult)
 	}
-
-	jsn, _ := json.Marshal(results)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"history":%s}`, jsn)
+	return results, nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a response is kept for retries with the same Idempotency-Key
+	idempotencyKeyTime = 24 * time.Hour
+	maxIdempotencyKey  = 255
+	// a body is hashed whole, so it's read no further than the largest any route accepts
+	maxIdempotentBody = maxV2BatchBody
+)
+
+var (
+	idempotencyMu     sync.Mutex
+	idempotencyPruned time.Time
+)
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyScope is what an Idempotency-Key is stored under: the key together with the route,
+// the Authorization header and the agent the request is verifiably from, which v1 agent routes
+// only name in their body, so that one client's key never replays another's response
+func idempotencyScope(w http.ResponseWriter, r *http.Request, key string) string {
+	return b64Encode(getHash(fmt.Sprintf("%s\n%s\n%s\n%s",
+		r.URL.Path, r.Header.Get("Authorization"), requestAgentKey(w, r), key)))
+}
+
+// idempotent makes a POST with an Idempotency-Key header safe to retry: the first response is
+// stored and replayed for retries with the same body, and a retry with a different body gets a 422.
+// Responses that are worth retrying for real, 429s and server errors, aren't kept.
+func idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != "POST" || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeProblem(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Idempotency-Key is longer than %d characters", maxIdempotencyKey))
+			return
+		}
+
+		bodyBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			writeBodyProblem(w, err, maxIdempotentBody)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+		scope := idempotencyScope(w, r, key)
+		requestHash := b64Encode(getHash(string(bodyBytes)))
+
+		claimed, err := claimIdempotencyKey(scope, requestHash)
+		if err != nil {
+			log.Printf("idempotency key: %v", err)
+			writeDatabaseProblem(w, "idempotency")
+			return
+		}
+		if !claimed {
+			replayResponse(w, scope, requestHash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 || rec.status == http.StatusTooManyRequests || rec.status >= 500 {
+				forgetIdempotencyKey(scope)
+				return
+			}
+			_, err := DB.Exec("UPDATE idempotency_keys SET status = $2, content_type = $3, body = $4 WHERE key = $1",
+				scope, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+			if err != nil {
+				log.Printf("idempotency key: %v", err)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// claimIdempotencyKey stores a new key, or takes over one that has expired, returning whether the
+// request is the first with the key
+func claimIdempotencyKey(scope string, requestHash string) (bool, error) {
+	idempotencyMu.Lock()
+	prune := time.Since(idempotencyPruned) > time.Hour
+	if prune {
+		idempotencyPruned = time.Now()
+	}
+	idempotencyMu.Unlock()
+	// expiry is compared with the database's clock, which sets created
+	keyTime := idempotencyKeyTime.Seconds()
+	if prune {
+		if _, err := DB.Exec("DELETE FROM idempotency_keys WHERE created < NOW() - $1::float8 * interval '1 second'", keyTime); err != nil {
+			log.Printf("idempotency keys: %v", err)
+		}
+	}
+
+	var claimed string
+	err := DB.QueryRow(`INSERT INTO idempotency_keys (key, request_hash) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET request_hash = $2, status = NULL, content_type = NULL, body = NULL, created = NOW()
+		WHERE idempotency_keys.created < NOW() - $3::float8 * interval '1 second'
+		RETURNING key`, scope, requestHash, keyTime).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func forgetIdempotencyKey(scope string) {
+	if _, err := DB.Exec("DELETE FROM idempotency_keys WHERE key = $1", scope); err != nil {
+		log.Printf("idempotency key: %v", err)
+	}
+}
+
+// replayResponse answers a retry with the stored response of the first request with its key
+func replayResponse(w http.ResponseWriter, scope string, requestHash string) {
+	var storedHash, contentType sql.NullString
+	var status sql.NullInt64
+	var body []byte
+	err := DB.QueryRow("SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE key = $1", scope).Scan(&storedHash, &status, &contentType, &body)
+	switch {
+	case err == sql.ErrNoRows:
+		// the first request failed and gave the key up just now
+		writeProblem(w, http.StatusConflict, codeIdempotencyInProgress, "a request with this Idempotency-Key is in progress, retry it")
+	case err != nil:
+		log.Printf("idempotency key: %v", err)
+		writeDatabaseProblem(w, "idempotency")
+	case storedHash.String != requestHash:
+		writeProblem(w, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was used with a different request body")
+	case !status.Valid:
+		writeProblem(w, http.StatusConflict, codeIdempotencyInProgress, "a request with this Idempotency-Key is in progress, retry it")
+	default:
+		if contentType.String != "" {
+			w.Header().Set("Content-Type", contentType.String)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(int(status.Int64))
+		w.Write(body)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+// countingHandler answers each request with how many it has seen
+func countingHandler(status int) (http.Handler, *int) {
+	n := 0
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"success":true, "n":%d}`, n)
+	}), &n
+}
+
+func idempotentRequest(handler http.Handler, method string, key string, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(method, "/agentRegister", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	idempotent(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestIdempotentPassThrough(t *testing.T) {
+	handler, n := countingHandler(http.StatusOK)
+
+	// requests without a key, and GETs, don't touch the database
+	idempotentRequest(handler, "POST", "", `{}`)
+	idempotentRequest(handler, "GET", "a-key", "")
+	if *n != 2 {
+		t.Errorf("requests without an Idempotency-Key not passed through: %d", *n)
+	}
+
+	rr := idempotentRequest(handler, "POST", strings.Repeat("k", maxIdempotencyKey+1), `{}`)
+	if rr.Code != http.StatusBadRequest || *n != 2 {
+		t.Errorf("overlong Idempotency-Key: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// the body is read no further than the largest any route accepts
+	rr = idempotentRequest(handler, "POST", "a-key", strings.Repeat("x", maxIdempotentBody+1))
+	if rr.Code != http.StatusRequestEntityTooLarge || *n != 2 {
+		t.Errorf("overlong body: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// the scope keeps clients apart
+	a := httptest.NewRequest("POST", "/agentRegister", nil)
+	b := httptest.NewRequest("POST", "/agentRegister", nil)
+	b.Header.Set("Authorization", "Bearer another-agent")
+	if idempotencyScope(httptest.NewRecorder(), a, "k") == idempotencyScope(httptest.NewRecorder(), b, "k") {
+		t.Errorf("same scope for different credentials")
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// the first response is replayed for a retry
+	handler, n := countingHandler(http.StatusCreated)
+	first := idempotentRequest(handler, "POST", "key-1", `{"did":1}`)
+	retry := idempotentRequest(handler, "POST", "key-1", `{"did":1}`)
+	if *n != 1 || retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry not replayed: ran %d times, got %v %s", *n, retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected replay headers %v", retry.Header())
+	}
+
+	// reusing the key for another body is an error
+	if rr := idempotentRequest(handler, "POST", "key-1", `{"did":2}`); rr.Code != http.StatusUnprocessableEntity || *n != 1 {
+		t.Errorf("key reused with a different body: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// a different key runs the request again
+	if idempotentRequest(handler, "POST", "key-2", `{"did":1}`); *n != 2 {
+		t.Errorf("request with a new key not run")
+	}
+
+	// server errors aren't kept, so the retry runs
+	failing, failures := countingHandler(http.StatusInternalServerError)
+	idempotentRequest(failing, "POST", "key-3", `{}`)
+	idempotentRequest(failing, "POST", "key-3", `{}`)
+	if *failures != 2 {
+		t.Errorf("server error replayed")
+	}
+
+	// agents that name themselves in the body are kept apart too, once their JWTs verify
+	signed := agentJWT(t, Conf.APIAuth[testAgentKey], jwt.MapClaims{"iss": testAgentKey})
+	if rr := idempotentRequest(handler, "POST", "key-4", fmt.Sprintf(`{"agentkey":%q,"registration":%q}`, testAgentKey, signed)); rr.Code != http.StatusCreated || *n != 3 {
+		t.Errorf("agent request not run: got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := idempotentRequest(handler, "POST", "key-4", `{"agentkey":"another-agent","registration":"x.y.z"}`); rr.Header().Get("Idempotent-Replayed") != "" || *n != 4 {
+		t.Errorf("another agent got the agent's response: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM idempotency_keys")
+	stmt.Exec()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+)
+
+// registration modes set by registration_mode in [app]
+const (
+	registrationOpen       = "open"
+	registrationInviteOnly = "invite-only"
+	registrationAgentOnly  = "agent-only"
+)
+
+// invites created through the /admin API or the command line are made by this creator
+const inviteCreatorAdmin = "admin"
+
+var (
+	errInviteRequired = errors.New("registration needs an invite")
+	errInviteNotValid = errors.New("invite is not valid, used up or expired")
+	errAgentOnly      = errors.New("registration is only open to agents")
+	errInviteNotFound = errors.New("invite not found")
+)
+
+// registrationMode returns who may register through /register, open to anyone by default
+func registrationMode() string {
+	if Conf.App.RegistrationMode == "" {
+		return registrationOpen
+	}
+	return Conf.App.RegistrationMode
+}
+
+func validRegistrationMode(mode string) bool {
+	switch mode {
+	case "", registrationOpen, registrationInviteOnly, registrationAgentOnly:
+		return true
+	}
+	return false
+}
+
+// invite is an invites row, without its token
+type invite struct {
+	ID        int64      `json:"id"`
+	CreatedBy string     `json:"createdBy"`
+	Note      string     `json:"note,omitempty"`
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Created   time.Time  `json:"created"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
+
+// inviteHash is how an invite token is stored, so that the database alone can't be used to register
+func inviteHash(token string) string {
+	return b64Encode(getHash(token))
+}
+
+// createInvite issues an invite token good for maxUses registrations, or any number when 0,
+// until it expires if expires isn't nil. The token is only returned here.
+func createInvite(createdBy string, note string, maxUses int, expires *time.Time) (int64, string, error) {
+	if maxUses < 0 {
+		return 0, "", errors.New("maxUses must not be negative")
+	}
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, "", err
+	}
+	token := b64Encode(raw)
+
+	var expiresAt pq.NullTime
+	if expires != nil {
+		expiresAt = pq.NullTime{Time: expires.UTC(), Valid: true}
+	}
+	var id int64
+	err := DB.QueryRow("INSERT INTO invites (token_hash, created_by, note, max_uses, expires) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		inviteHash(token), createdBy, note, maxUses, expiresAt).Scan(&id)
+	return id, token, err
+}
+
+// listInvites returns the invites made by a creator, or every invite when createdBy is empty
+func listInvites(createdBy string) ([]invite, error) {
+	rows, err := DB.Query("SELECT id, created_by, note, max_uses, uses, expires, created, revoked FROM invites WHERE $1 = '' OR created_by = $1 ORDER BY id", createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []invite{}
+	for rows.Next() {
+		var i invite
+		var expires, revoked pq.NullTime
+		if err = rows.Scan(&i.ID, &i.CreatedBy, &i.Note, &i.MaxUses, &i.Uses, &expires, &i.Created, &revoked); err != nil {
+			return nil, err
+		}
+		i.Expires, i.Revoked = nullTimePtr(expires), nullTimePtr(revoked)
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// revokeInvite stops an invite from being used, if it was made by createdBy or createdBy is empty
+func revokeInvite(id int64, createdBy string) error {
+	result, err := DB.Exec("UPDATE invites SET revoked = NOW() WHERE id = $1 AND ($2 = '' OR created_by = $2) AND revoked IS NULL", id, createdBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errInviteNotFound
+	}
+	return nil
+}
+
+// useInvite takes one use of an invite, returning its id
+func useInvite(token string) (int64, error) {
+	var id int64
+	err := DB.QueryRow(`UPDATE invites SET uses = uses + 1
+		WHERE token_hash = $1 AND revoked IS NULL AND (expires IS NULL OR expires > NOW()) AND (max_uses = 0 OR uses < max_uses)
+		RETURNING id`, inviteHash(token)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errInviteNotValid
+	}
+	return id, err
+}
+
+// releaseInvite gives back the use of an invite by a registration that wasn't recorded
+func releaseInvite(id int64) {
+	if _, err := DB.Exec("UPDATE invites SET uses = uses - 1 WHERE id = $1 AND uses > 0", id); err != nil {
+		log.Printf("invite %d: %v", id, err)
+	}
+}
+
+// admitRegistration checks a /register request against the registration mode, taking a use of
+// its invite when one is needed. It returns the problem when the registration isn't allowed.
+func admitRegistration(token string) (int64, *problem) {
+	var err error
+	var inviteID int64
+	switch registrationMode() {
+	case registrationAgentOnly:
+		err = errAgentOnly
+	case registrationInviteOnly:
+		if token == "" {
+			err = errInviteRequired
+		} else {
+			inviteID, err = useInvite(token)
+		}
+	}
+	switch {
+	case err == nil:
+		return inviteID, nil
+	case err == errAgentOnly, err == errInviteRequired:
+		return 0, newProblem(http.StatusForbidden, codeRegistrationClosed, err.Error())
+	case err == errInviteNotValid:
+		return 0, newProblem(http.StatusForbidden, codeInviteInvalid, err.Error())
+	default:
+		return 0, databaseProblem("invite")
+	}
+}
+
+// createInviteFor issues an invite from the request body on behalf of createdBy
+func createInviteFor(w http.ResponseWriter, r *http.Request, createdBy string) {
+	type InviteRequest struct {
+		Note    string     `json:"note"`
+		MaxUses *int       `json:"maxUses"`
+		Expires *time.Time `json:"expires"`
+	}
+	var inviteRequest InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&inviteRequest); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+	maxUses := 1
+	if inviteRequest.MaxUses != nil {
+		maxUses = *inviteRequest.MaxUses
+	}
+
+	id, token, err := createInvite(createdBy, inviteRequest.Note, maxUses, inviteRequest.Expires)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"success":true, "id":%d, "invite":%q}`, id, token)
+}
+
+func listInvitesFor(w http.ResponseWriter, r *http.Request, createdBy string) {
+	invites, err := listInvites(createdBy)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	jsn, _ := json.Marshal(invites)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"invites":%s}`, jsn)
+}
+
+func revokeInviteFor(w http.ResponseWriter, r *http.Request, createdBy string) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "inviteID"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errors.New("invite id must be a number"))
+		return
+	}
+	if err = revokeInvite(id, createdBy); err == errInviteNotFound {
+		adminError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "revoked":%d}`, id)
+}
+
+// agents with the invite scope manage their own invites
+func agentCreateInvite(w http.ResponseWriter, r *http.Request) {
+	createInviteFor(w, r, agentFrom(r.Context()))
+}
+
+func agentListInvites(w http.ResponseWriter, r *http.Request) {
+	listInvitesFor(w, r, agentFrom(r.Context()))
+}
+
+func agentRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	revokeInviteFor(w, r, agentFrom(r.Context()))
+}
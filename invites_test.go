@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+)
+
+func TestRegistrationModes(t *testing.T) {
+	defer func() { Conf.App.RegistrationMode = "" }()
+
+	for _, mode := range []string{"", "open", "invite-only", "agent-only"} {
+		if !validRegistrationMode(mode) {
+			t.Errorf("registration mode %q not valid", mode)
+		}
+	}
+	if validRegistrationMode("closed") {
+		t.Errorf("unknown registration mode valid")
+	}
+
+	tests := []struct {
+		mode   string
+		status int
+		error  string
+	}{
+		{"", http.StatusOK, ""},
+		{"agent-only", http.StatusForbidden, "registration is only open to agents"},
+		{"invite-only", http.StatusForbidden, "registration needs an invite"},
+	}
+	for _, test := range tests {
+		Conf.App.RegistrationMode = test.mode
+		_, p := admitRegistration("")
+		if (p == nil) != (test.status == http.StatusOK) {
+			t.Errorf("%q: got %v want %v", test.mode, p, test.status)
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		rr := httptest.NewRecorder()
+		p.write(rr)
+		if rr.Code != test.status || rr.Body.String() != problemJSON(test.status, codeRegistrationClosed, test.error) {
+			t.Errorf("%q: unexpected response %v %s", test.mode, rr.Code, rr.Body.String())
+		}
+	}
+
+	// /register checks the mode before validating anything
+	Conf.App.RegistrationMode = registrationAgentOnly
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(registerDID).ServeHTTP(rr, httptest.NewRequest("POST", "/register", strings.NewReader(`{"did":{}}`)))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("register in agent-only mode: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// an invite is good for its number of uses
+	id, token, err := createInvite(inviteCreatorAdmin, "two registrations", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if used, err := useInvite(token); err != nil || used != id {
+			t.Errorf("use %d: got %d, %v", i, used, err)
+		}
+	}
+	if _, err = useInvite(token); err != errInviteNotValid {
+		t.Errorf("used up invite: got error %v", err)
+	}
+	releaseInvite(id)
+	if _, err = useInvite(token); err != nil {
+		t.Errorf("released use not given back: %v", err)
+	}
+
+	// tokens are stored hashed
+	var stored string
+	DB.QueryRow("SELECT token_hash FROM invites WHERE id = $1", id).Scan(&stored)
+	if stored == token {
+		t.Errorf("invite token stored in plaintext")
+	}
+
+	expires := time.Now().Add(-time.Minute)
+	_, expired, _ := createInvite(inviteCreatorAdmin, "", 0, &expires)
+	if _, err = useInvite(expired); err != errInviteNotValid {
+		t.Errorf("expired invite: got error %v", err)
+	}
+	if _, err = useInvite("not an invite"); err != errInviteNotValid {
+		t.Errorf("unknown invite: got error %v", err)
+	}
+
+	// agents only revoke their own invites, admins any
+	agentInvite, agentToken, _ := createInvite("an-inviting-agent", "", 0, nil)
+	if err = revokeInvite(agentInvite, "another-agent"); err != errInviteNotFound {
+		t.Errorf("agent revoked another agent's invite: %v", err)
+	}
+	if err = revokeInvite(agentInvite, ""); err != nil {
+		t.Errorf("admin could not revoke an agent's invite: %v", err)
+	}
+	if _, err = useInvite(agentToken); err != errInviteNotValid {
+		t.Errorf("revoked invite: got error %v", err)
+	}
+
+	// in invite-only mode /register takes a use of the invite, and gives it back when the registration fails
+	Conf.App.RegistrationMode = registrationInviteOnly
+	defer func() { Conf.App.RegistrationMode = "" }()
+	_, oneUse, _ := createInvite(inviteCreatorAdmin, "", 1, nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(registerDID).ServeHTTP(rr, httptest.NewRequest("POST", "/register", strings.NewReader(fmt.Sprintf(`{"did":{},"invite":%q}`, oneUse))))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid registration with an invite: got %v %s", rr.Code, rr.Body.String())
+	}
+	if _, err = useInvite(oneUse); err != nil {
+		t.Errorf("invite use not given back after a failed registration: %v", err)
+	}
+
+	// the admin API
+	Conf.Admin.Tokens = []string{testAdminToken}
+	rr = adminRequest(t, "POST", "/invites", `{"note":"for a partner","maxUses":10,"expires":"2099-01-01T00:00:00Z"}`)
+	var created struct {
+		ID     int64  `json:"id"`
+		Invite string `json:"invite"`
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), &created); err != nil || rr.Code != http.StatusCreated || created.Invite == "" {
+		t.Errorf("admin invite not created: got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = adminRequest(t, "GET", "/invites", "")
+	var listed struct {
+		Invites []invite `json:"invites"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &listed)
+	if len(listed.Invites) != 5 || strings.Contains(rr.Body.String(), created.Invite) {
+		t.Errorf("unexpected invite list: %s", rr.Body.String())
+	}
+	if rr = adminRequest(t, "DELETE", fmt.Sprintf("/invites/%d", created.ID), ""); rr.Code != http.StatusOK {
+		t.Errorf("admin invite not revoked: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM invites")
+	stmt.Exec()
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyProvider supplies the server's master secret keys and the key-encryption keys that wrap
+// envelope data keys, so that they needn't sit in plaintext in config.toml
+type KeyProvider interface {
+	// SecretKey returns the master secret key for the given master public key
+	SecretKey(public string) ([]byte, error)
+	// KeyEncryptionKey returns the key-encryption key with the given id
+	KeyEncryptionKey(id string) ([]byte, error)
+}
+
+// Keys is the key provider configured in config.toml
+var Keys KeyProvider
+
+// keyProvider returns the configured key provider, falling back to the keys in config.toml
+func keyProvider() KeyProvider {
+	if Keys != nil {
+		return Keys
+	}
+	return configKeyProvider{}
+}
+
+// newKeyProvider sets up the key provider selected by keys.provider
+func newKeyProvider(k keys) (KeyProvider, error) {
+	switch k.Provider {
+	case "", "config":
+		return configKeyProvider{}, nil
+	case "file":
+		return newFileKeyProvider(k.SecretFile, k.KEKFile)
+	case "env":
+		return newEnvKeyProvider(k.SecretEnv, k.KEKEnv)
+	case "keystore":
+		return newKeystoreKeyProvider(k.Keystore, os.Getenv(passphraseEnv(k)))
+	case "process":
+		return newProcessKeyProvider(k.Command)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", k.Provider)
+	}
+}
+
+func passphraseEnv(k keys) string {
+	if k.PassphraseEnv != "" {
+		return k.PassphraseEnv
+	}
+	return "DIDSERVER_KEYSTORE_PASSPHRASE"
+}
+
+// configKeyProvider reads the secret keys from the [keys] section of config.toml
+type configKeyProvider struct{}
+
+func (configKeyProvider) SecretKey(public string) ([]byte, error) {
+	if public == Conf.Keys.Public {
+		return secretKeySize(b64Decode(Conf.Keys.Secret))
+	}
+	for _, kp := range Conf.Keys.Ring {
+		if kp.Public == public && kp.Secret != "" {
+			return secretKeySize(b64Decode(kp.Secret))
+		}
+	}
+	return nil, fmt.Errorf("no secret key for master key %s", public)
+}
+
+func (configKeyProvider) KeyEncryptionKey(id string) ([]byte, error) {
+	if encoded, ok := Conf.Keys.KEKs[id]; ok {
+		return secretKeySize(b64Decode(encoded))
+	}
+	return nil, fmt.Errorf("no key-encryption key %s", id)
+}
+
+// secretKeySize refuses a secret key that isn't a curve25519 key, before it reaches box
+func secretKeySize(secret []byte) ([]byte, error) {
+	if len(secret) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("master secret key is %d bytes, not %d", len(secret), curve25519.ScalarSize)
+	}
+	return secret, nil
+}
+
+// staticKeyProvider holds keys loaded once at startup: secret keys indexed by their public
+// keys, and key-encryption keys by their ids
+type staticKeyProvider struct {
+	secrets map[string][]byte
+	keks    map[string][]byte
+}
+
+func (p *staticKeyProvider) SecretKey(public string) ([]byte, error) {
+	if secret, ok := p.secrets[public]; ok {
+		return secret, nil
+	}
+	return nil, fmt.Errorf("no secret key for master key %s", public)
+}
+
+func (p *staticKeyProvider) KeyEncryptionKey(id string) ([]byte, error) {
+	if kek, ok := p.keks[id]; ok {
+		return kek, nil
+	}
+	return nil, fmt.Errorf("no key-encryption key %s", id)
+}
+
+// newStaticKeyProvider parses base64url secret keys, padded or not, separated by whitespace.
+// Key-encryption keys may be among them, written id=key.
+func newStaticKeyProvider(encoded string) (*staticKeyProvider, error) {
+	p := &staticKeyProvider{secrets: map[string][]byte{}, keks: map[string][]byte{}}
+	for _, s := range strings.Fields(encoded) {
+		if isKEK(s) {
+			if err := p.addKEKs(s); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		secret := decodeKey(s)
+		if len(secret) != curve25519.ScalarSize {
+			return nil, errors.New("master secret key missing or size incorrect")
+		}
+		public, err := curve25519.X25519(secret, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		p.secrets[b64Encode(public)] = secret
+	}
+	if len(p.secrets) == 0 {
+		return nil, errors.New("no master secret keys found")
+	}
+	return p, nil
+}
+
+// isKEK tells a key-encryption key written id=key from a secret key, whose base64 padding
+// is an = too: it needs a key id before the = and more than padding after it
+func isKEK(s string) bool {
+	parts := strings.SplitN(s, "=", 2)
+	return len(parts) == 2 && validKeyID(parts[0]) && strings.Trim(parts[1], "=") != ""
+}
+
+// validKeyID allows letters, digits, '.', '-' and '_' in key ids
+func validKeyID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeKey decodes a base64url key, with or without padding
+func decodeKey(s string) []byte {
+	return b64Decode(strings.TrimRight(s, "="))
+}
+
+// addKEKs parses key-encryption keys written id=key, separated by whitespace
+func (p *staticKeyProvider) addKEKs(encoded string) error {
+	for _, s := range strings.Fields(encoded) {
+		parts := strings.SplitN(s, "=", 2)
+		if !isKEK(s) {
+			return errors.New("key-encryption keys must be written id=key")
+		}
+		kek, err := secretKeySize(decodeKey(parts[1]))
+		if err != nil {
+			return fmt.Errorf("key-encryption key %s: %v", parts[0], err)
+		}
+		p.keks[parts[0]] = kek
+	}
+	return nil
+}
+
+// newFileKeyProvider reads secret keys from a file, one per line, and key-encryption keys
+// from their own file when one is given
+func newFileKeyProvider(path string, kekPath string) (*staticKeyProvider, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newStaticKeyProvider(string(contents))
+	if err != nil || kekPath == "" {
+		return p, err
+	}
+	if contents, err = ioutil.ReadFile(kekPath); err != nil {
+		return nil, err
+	}
+	return p, p.addKEKs(string(contents))
+}
+
+// newEnvKeyProvider reads secret keys and key-encryption keys from their own environment variables
+func newEnvKeyProvider(name string, kekName string) (*staticKeyProvider, error) {
+	if name == "" {
+		name = "DIDSERVER_MASTER_SECRET"
+	}
+	if kekName == "" {
+		kekName = "DIDSERVER_KEKS"
+	}
+	p, err := newStaticKeyProvider(os.Getenv(name))
+	if err != nil {
+		return nil, err
+	}
+	return p, p.addKEKs(os.Getenv(kekName))
+}
+
+// keystore is a file of secret keys encrypted with a key derived from a passphrase
+type keystore struct {
+	Salt       string `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      string `json:"nonce"`
+	Cyphertext string `json:"cyphertext"`
+}
+
+func (ks keystore) key(passphrase string) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), b64Decode(ks.Salt), ks.N, ks.R, ks.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// newKeystoreKeyProvider decrypts a keystore written by sealKeystore
+func newKeystoreKeyProvider(path string, passphrase string) (*staticKeyProvider, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ks keystore
+	if err = json.Unmarshal(contents, &ks); err != nil {
+		return nil, err
+	}
+	key, err := ks.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], b64Decode(ks.Nonce))
+	secrets, ok := secretbox.Open(nil, b64Decode(ks.Cyphertext), &nonce, key)
+	if !ok {
+		return nil, errors.New("unable to open keystore, is the passphrase correct?")
+	}
+	return newStaticKeyProvider(string(secrets))
+}
+
+// sealKeystore encrypts whitespace separated secret keys, and key-encryption keys written
+// id=key, into a keystore
+func sealKeystore(secrets string, passphrase string) (*keystore, error) {
+	return sealKeystoreWithCost(secrets, passphrase, 1<<15)
+}
+
+// sealKeystoreWithCost is sealKeystore with the given scrypt cost parameter
+func sealKeystoreWithCost(secrets string, passphrase string, n int) (*keystore, error) {
+	if _, err := newStaticKeyProvider(secrets); err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("keystore passphrase is empty")
+	}
+
+	salt := make([]byte, 16)
+	var nonce [24]byte
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	ks := keystore{Salt: b64Encode(salt), N: n, R: 8, P: 1, Nonce: b64Encode(nonce[:])}
+	key, err := ks.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ks.Cyphertext = b64Encode(secretbox.Seal(nil, []byte(secrets), &nonce, key))
+	return &ks, nil
+}
+
+// processKeyTimeout is how long the key process has to answer before it is restarted
+const processKeyTimeout = 5 * time.Second
+
+// processKeyProvider asks a long running process for keys, such as a local signing daemon.
+// Each request is a line of JSON {"publicKey":...}, or {"kek":...} for a key-encryption key,
+// written to its stdin, answered by a line of JSON {"secretKey":...} or {"error":...} on its stdout.
+type processKeyProvider struct {
+	command []string
+	timeout time.Duration
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+func newProcessKeyProvider(command []string) (*processKeyProvider, error) {
+	if len(command) == 0 {
+		return nil, errors.New("key provider command is empty")
+	}
+	return &processKeyProvider{command: command, timeout: processKeyTimeout}, nil
+}
+
+func (p *processKeyProvider) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the process so that the next request starts a fresh one
+func (p *processKeyProvider) stop() {
+	if p.cmd != nil {
+		p.stdin.Close()
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		p.cmd = nil
+	}
+}
+
+// restart replaces a process that failed to answer. If it won't start, the next request tries again.
+func (p *processKeyProvider) restart() {
+	p.stop()
+	p.start()
+}
+
+func (p *processKeyProvider) SecretKey(public string) ([]byte, error) {
+	return p.ask(map[string]string{"publicKey": public})
+}
+
+func (p *processKeyProvider) KeyEncryptionKey(id string) ([]byte, error) {
+	return p.ask(map[string]string{"kek": id})
+}
+
+// ask sends the process one request and reads its answer
+func (p *processKeyProvider) ask(req map[string]string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	request, _ := json.Marshal(req)
+	if _, err := p.stdin.Write(append(request, '\n')); err != nil {
+		p.stop()
+		return nil, err
+	}
+	line, err := p.readLine()
+	if err != nil {
+		p.restart()
+		return nil, err
+	}
+
+	var response struct {
+		SecretKey string `json:"secretKey"`
+		Error     string `json:"error"`
+	}
+	if err = json.Unmarshal(line, &response); err != nil {
+		p.stop()
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return secretKeySize(b64Decode(response.SecretKey))
+}
+
+// readLine reads the process's answer, giving up when it takes longer than the timeout. The
+// caller stops the process then, which ends the read left waiting.
+func (p *processKeyProvider) readLine() ([]byte, error) {
+	type result struct {
+		line []byte
+		err  error
+	}
+	answer := make(chan result, 1)
+	go func(stdout *bufio.Reader) {
+		line, err := stdout.ReadBytes('\n')
+		answer <- result{line, err}
+	}(p.stdout)
+
+	select {
+	case r := <-answer:
+		return r.line, r.err
+	case <-time.After(p.timeout):
+		return nil, fmt.Errorf("key provider command did not answer within %v", p.timeout)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func testMasterKeypair(t *testing.T) (string, string) {
+	pub, sec, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b64Encode(pub[:]), b64Encode(sec[:])
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	pub1, sec1 := testMasterKeypair(t)
+	pub2, sec2 := testMasterKeypair(t)
+
+	_, kek := testMasterKeypair(t)
+
+	p, err := newStaticKeyProvider(sec1 + "\n" + sec2 + "\nkek-1=" + kek + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pub, sec := range map[string]string{pub1: sec1, pub2: sec2} {
+		if got, err := p.SecretKey(pub); err != nil || b64Encode(got) != sec {
+			t.Errorf("wrong secret key for %s: got %s with error %v", pub, b64Encode(got), err)
+		}
+	}
+	if _, err := p.SecretKey("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown master key")
+	}
+	if got, err := p.KeyEncryptionKey("kek-1"); err != nil || b64Encode(got) != kek {
+		t.Errorf("wrong key-encryption key: got %s with error %v", b64Encode(got), err)
+	}
+	if _, err := p.KeyEncryptionKey("unknown"); err == nil {
+		t.Errorf("expected an error for an unknown key-encryption key")
+	}
+	if _, err := newStaticKeyProvider(sec1 + " kek-1=tooShort"); err == nil {
+		t.Errorf("expected an error for a malformed key-encryption key")
+	}
+
+	if _, err := newStaticKeyProvider("tooShort"); err == nil {
+		t.Errorf("expected an error for a malformed secret key")
+	}
+
+	// a padded secret key isn't taken for a key-encryption key
+	p, err = newStaticKeyProvider(sec1 + "= kek-1=" + kek + "=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.SecretKey(pub1); err != nil || b64Encode(got) != sec1 {
+		t.Errorf("wrong padded secret key: got %s with error %v", b64Encode(got), err)
+	}
+	if got, err := p.KeyEncryptionKey("kek-1"); err != nil || b64Encode(got) != kek {
+		t.Errorf("wrong padded key-encryption key: got %s with error %v", b64Encode(got), err)
+	}
+	if len(p.keks) != 1 {
+		t.Errorf("expected one key-encryption key, got %d", len(p.keks))
+	}
+}
+
+func TestEnvKeyProvider(t *testing.T) {
+	pub, sec := testMasterKeypair(t)
+	_, kek := testMasterKeypair(t)
+	os.Setenv("DIDSERVER_TEST_MASTER_SECRET", sec)
+	defer os.Unsetenv("DIDSERVER_TEST_MASTER_SECRET")
+	os.Setenv("DIDSERVER_TEST_KEKS", "kek-1="+kek)
+	defer os.Unsetenv("DIDSERVER_TEST_KEKS")
+
+	p, err := newKeyProvider(keys{Provider: "env", SecretEnv: "DIDSERVER_TEST_MASTER_SECRET", KEKEnv: "DIDSERVER_TEST_KEKS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.SecretKey(pub); err != nil || b64Encode(got) != sec {
+		t.Errorf("wrong secret key: got %s with error %v", b64Encode(got), err)
+	}
+	if got, err := p.KeyEncryptionKey("kek-1"); err != nil || b64Encode(got) != kek {
+		t.Errorf("wrong key-encryption key: got %s with error %v", b64Encode(got), err)
+	}
+}
+
+func TestKeystoreKeyProvider(t *testing.T) {
+	pub, sec := testMasterKeypair(t)
+	// a low scrypt cost keeps the test quick
+	ks, err := sealKeystoreWithCost(sec, "correct horse battery staple", 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, _ := ioutil.TempDir("", "didserver")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.keystore")
+	contents, _ := json.Marshal(ks)
+	if err = ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newKeystoreKeyProvider(path, "wrong passphrase"); err == nil {
+		t.Errorf("expected an error for the wrong passphrase")
+	}
+
+	p, err := newKeystoreKeyProvider(path, "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := p.SecretKey(pub); err != nil || b64Encode(got) != sec {
+		t.Errorf("wrong secret key: got %s with error %v", b64Encode(got), err)
+	}
+}
+
+func TestProcessKeyProvider(t *testing.T) {
+	pub, sec := testMasterKeypair(t)
+	script := fmt.Sprintf(`while read line; do echo '{"secretKey":"%s"}'; done`, sec)
+
+	p, err := newProcessKeyProvider([]string{"sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	// the process serves more than one request
+	for i := 0; i < 2; i++ {
+		if got, err := p.SecretKey(pub); err != nil || b64Encode(got) != sec {
+			t.Errorf("wrong secret key: got %s with error %v", b64Encode(got), err)
+		}
+	}
+}
+
+func TestProcessKeyProviderTimeout(t *testing.T) {
+	pub, _ := testMasterKeypair(t)
+	p, err := newProcessKeyProvider([]string{"sh", "-c", "exec sleep 10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+	p.timeout = 100 * time.Millisecond
+
+	started := time.Now()
+	if _, err = p.SecretKey(pub); err == nil {
+		t.Errorf("a process that doesn't answer should time out")
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("timeout took %v", time.Since(started))
+	}
+	if p.cmd == nil {
+		t.Errorf("the process should be restarted after a timeout")
+	}
+}
+
+func TestProcessKeyProviderKeySize(t *testing.T) {
+	pub, _ := testMasterKeypair(t)
+	p, err := newProcessKeyProvider([]string{"sh", "-c", `while read line; do echo '{"secretKey":"c2hvcnQ"}'; done`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	if _, err = p.SecretKey(pub); err == nil {
+		t.Errorf("a secret key that isn't 32 bytes should be refused")
+	}
+}
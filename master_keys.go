@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// keyring returns the public half of every master keypair, the current one first
+func keyring() []string {
+	ring := []string{Conf.Keys.Public}
+	for _, kp := range Conf.Keys.Ring {
+		ring = append(ring, kp.Public)
+	}
+	return ring
+}
+
+// masterKeysFor returns the master public keys to try for a secret recorded with
+// the given secret_master value. Rows without one may use any key in the ring.
+func masterKeysFor(public string) []string {
+	if public == "" {
+		return keyring()
+	}
+	for _, pk := range keyring() {
+		if pk == public {
+			return []string{pk}
+		}
+	}
+	return nil
+}
+
+// openRegSecret decrypts a registration secret with the master key it was encrypted to,
+// returning the secret and that key's public half
+func openRegSecret(c string, n string, format string, pk string, master string) ([]byte, string, bool) {
+	for _, public := range masterKeysFor(master) {
+		sk, err := keyProvider().SecretKey(public)
+		if err != nil {
+			log.Printf("master key %s: %v", public, err)
+			continue
+		}
+		if secret, ok := decryptRegSecret(c, n, format, pk, sk); ok {
+			return secret, public, true
+		}
+	}
+	return nil, "", false
+}
+
+// resealRegSecret encrypts a registration secret to the current master key from a fresh
+// ephemeral keypair, since the server doesn't hold the DID's encrypting key. The result
+// is in the crypto_box_easy format.
+func resealRegSecret(secret []byte) (cypher, nonce, pubkey string, err error) {
+	ephemeralPub, ephemeralSecret, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	var n [24]byte
+	if _, err = rand.Read(n[:]); err != nil {
+		return "", "", "", err
+	}
+
+	var masterPub [32]byte
+	copy(masterPub[:], b64Decode(Conf.Keys.Public))
+	sealed := box.Seal(nil, secret, &n, &masterPub, ephemeralSecret)
+
+	return b64Encode(sealed), b64Encode(n[:]), b64Encode(ephemeralPub[:]), nil
+}
+
+// reencryptSecrets moves up to limit stored secrets after the given sequence number onto the
+// current master key, rewrapping envelope keys to the current key-encryption key and sealing
+// plaintext rows when envelope encryption is on. It returns the number of rows examined and the last sequence
+// number seen, and is safe to stop and rerun since finished rows no longer match.
+func reencryptSecrets(after int64, limit int) (int, int64, error) {
+	rows, err := DB.Query(`SELECT id, secret_cypher, secret_nonce, secret_format, COALESCE(NULLIF(secret_pubkey, ''), encrypting_pubkey), secret_master, envelope_key, envelope_kek, envelope_master, sequence
+		FROM didstore WHERE sequence > $2 AND secret_cypher != '' AND (secret_master != $1 OR (envelope_key != '' AND $5 != '' AND envelope_kek != $5) OR ($3 AND envelope_key = ''))
+		ORDER BY sequence LIMIT $4`, Conf.Keys.Public, after, Conf.Keys.Envelope, limit, Conf.Keys.KEK)
+	if err != nil {
+		return 0, after, err
+	}
+
+	type storedSecret struct {
+		id, cypher, nonce, format, pubkey, master, envelopeKey, envelopeKEK, envelopeMaster string
+	}
+	var pending []storedSecret
+	for rows.Next() {
+		var s storedSecret
+		if err = rows.Scan(&s.id, &s.cypher, &s.nonce, &s.format, &s.pubkey, &s.master, &s.envelopeKey, &s.envelopeKEK, &s.envelopeMaster, &after); err != nil {
+			rows.Close()
+			return len(pending), after, err
+		}
+		pending = append(pending, s)
+	}
+	rows.Close()
+
+	for _, s := range pending {
+		env, err := openEnvelope(s.envelopeKey, s.envelopeKEK, s.envelopeMaster)
+		if err == nil {
+			err = env.openValues(&s.cypher, &s.nonce)
+		}
+		if err != nil {
+			log.Printf("rekey: unable to open envelope for %s: %v", s.id, err)
+			continue
+		}
+
+		cypher, nonce, format, pubkey := s.cypher, s.nonce, s.format, s.pubkey
+		if s.master != Conf.Keys.Public {
+			secret, _, ok := openRegSecret(s.cypher, s.nonce, s.format, s.pubkey, s.master)
+			if !ok {
+				log.Printf("rekey: unable to decrypt registration secret for %s", s.id)
+				continue
+			}
+			if cypher, nonce, pubkey, err = resealRegSecret(secret); err != nil {
+				return len(pending), after, err
+			}
+			format = secretFormatBoxEasy
+		}
+
+		// keep the row's data key so that its other sealed values still open
+		switch {
+		case env != nil && Conf.Keys.KEK != "":
+			err = env.wrap(Conf.Keys.KEK)
+		case Conf.Keys.Envelope:
+			env, err = newEnvelope()
+		}
+		if err == nil {
+			err = env.sealValues(&cypher, &nonce)
+		}
+		if err != nil {
+			return len(pending), after, err
+		}
+		envelopeKey, envelopeKEK, envelopeMaster := env.stored()
+
+		_, err = DB.Exec(`UPDATE didstore SET secret_cypher = $1, secret_nonce = $2, secret_format = $3, secret_pubkey = $4, secret_master = $5, envelope_key = $6, envelope_kek = $7, envelope_master = $8
+			WHERE id = $9 AND secret_master = $10 AND envelope_key = $11`,
+			cypher, nonce, format, pubkey, Conf.Keys.Public, envelopeKey, envelopeKEK, envelopeMaster, s.id, s.master, s.envelopeKey)
+		if err != nil {
+			return len(pending), after, err
+		}
+	}
+
+	return len(pending), after, nil
+}
+
+// rekey re-encrypts every stored secret to the current master key in batches, then rewraps agent secrets
+func rekey(batchSize int, pause time.Duration) (int, error) {
+	var total int
+	var after int64
+	for {
+		n, last, err := reencryptSecrets(after, batchSize)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("rekey stopped after sequence %d: %v", after, err)
+		}
+		if n == 0 {
+			n, err = rewrapAgentSecrets()
+			if err != nil {
+				return total, fmt.Errorf("rekey stopped rewrapping agent secrets: %v", err)
+			}
+			return total + n, nil
+		}
+		after = last
+		time.Sleep(pause)
+	}
+}
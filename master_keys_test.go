@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"log"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// retiredKeyring moves a freshly generated keypair into the ring and returns it
+func retiredKeyring(t *testing.T) keypair {
+	pub, sec, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired := keypair{Public: b64Encode(pub[:]), Secret: b64Encode(sec[:])}
+	Conf.Keys.Ring = []keypair{retired}
+	return retired
+}
+
+// sealToMaster encrypts a secret to the given master public key the way node-sodium does
+func sealToMaster(secret []byte, master string) (cypher, nonce, sender string) {
+	senderPub, senderSecret, _ := box.GenerateKey(rand.Reader)
+	var n [24]byte
+	rand.Read(n[:])
+	var masterPub [32]byte
+	copy(masterPub[:], b64Decode(master))
+	sealed := box.Seal(make([]byte, 16), secret, &n, &masterPub, senderSecret)
+	return b64Encode(sealed), b64Encode(n[:]), b64Encode(senderPub[:])
+}
+
+func TestMasterKeysFor(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+	retired := retiredKeyring(t)
+
+	if keys := masterKeysFor(""); len(keys) != 2 || keys[0] != Conf.Keys.Public {
+		t.Errorf("unrecorded master key should try the whole ring, current first: got %v", keys)
+	}
+	if keys := masterKeysFor(retired.Public); len(keys) != 1 || keys[0] != retired.Public {
+		t.Errorf("retired master key not found: got %v", keys)
+	}
+	if keys := masterKeysFor("unknown"); len(keys) != 0 {
+		t.Errorf("unknown master key returned keys: got %v", keys)
+	}
+}
+
+func TestOpenRegSecretRetiredKey(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+	retired := retiredKeyring(t)
+
+	cypher, nonce, sender := sealToMaster([]byte("registration secret"), retired.Public)
+	secret, master, ok := openRegSecret(cypher, nonce, secretFormatBox, sender, "")
+	if !ok || string(secret) != "registration secret" || master != retired.Public {
+		t.Errorf("secret encrypted to a retired key did not decrypt: got %q, %q, %v", secret, master, ok)
+	}
+
+	// resealing moves it onto the current key
+	cypher, nonce, sender, err := resealRegSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, master, ok = openRegSecret(cypher, nonce, secretFormatBoxEasy, sender, Conf.Keys.Public)
+	if !ok || string(secret) != "registration secret" || master != Conf.Keys.Public {
+		t.Errorf("resealed secret did not decrypt with the current key: got %q, %q, %v", secret, master, ok)
+	}
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	retired := retiredKeyring(t)
+
+	id := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	cypher, nonce, sender := sealToMaster([]byte("registration secret"), retired.Public)
+	_, err = DB.Exec(`INSERT INTO didstore (id, root, encrypting_pubkey, secret_cypher, secret_nonce, secret_master, status) VALUES ($1, $1, $2, $3, $4, $5, 'verified')`,
+		id, sender, cypher, nonce, retired.Public)
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+
+	if n, err := rekey(10, 0); n != 1 || err != nil {
+		t.Errorf("rekey examined %d rows with error %v, want 1", n, err)
+	}
+
+	var master string
+	DB.QueryRow("SELECT secret_master FROM didstore WHERE id = $1", id).Scan(&master)
+	if master != Conf.Keys.Public {
+		t.Errorf("secret was not moved to the current master key: got %q", master)
+	}
+
+	// the retired key is no longer needed
+	Conf.Keys.Ring = nil
+	secret, err := getJwtSecret(id)
+	if err != nil || string(secret) != "registration secret" {
+		t.Errorf("re-encrypted secret did not decrypt: got %q with error %v", secret, err)
+	}
+
+	// a second run has nothing to do
+	if n, err := rekey(10, 0); n != 0 || err != nil {
+		t.Errorf("rekey examined %d rows with error %v, want 0", n, err)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
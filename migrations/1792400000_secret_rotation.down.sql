@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS secret_rotated;
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS secret_pubkey;
@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS secret_pubkey text DEFAULT '';
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS secret_rotated timestamp;
@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS secret_format;
@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS secret_format text DEFAULT '';
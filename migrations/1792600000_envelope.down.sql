@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS envelope_master;
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS envelope_key;
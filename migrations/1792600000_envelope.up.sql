@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS envelope_key text DEFAULT '';
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS envelope_master text DEFAULT '';
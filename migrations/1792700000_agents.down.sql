@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS agent_secrets;
+DROP TABLE IF EXISTS agents;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS agents (
+  id text PRIMARY KEY,
+  name text DEFAULT '',
+  scopes text[] DEFAULT '{}',
+  enabled boolean DEFAULT true,
+  created timestamp DEFAULT current_timestamp,
+  last_used timestamp
+);
+CREATE TABLE IF NOT EXISTS agent_secrets (
+  id bigserial PRIMARY KEY,
+  agent_id text NOT NULL REFERENCES agents (id) ON DELETE CASCADE,
+  secret text DEFAULT '',
+  envelope_key text DEFAULT '',
+  envelope_master text DEFAULT '',
+  created timestamp DEFAULT current_timestamp,
+  last_used timestamp,
+  revoked timestamp
+);
+CREATE INDEX IF NOT EXISTS agent_secrets_agent_id_idx ON agent_secrets (agent_id);
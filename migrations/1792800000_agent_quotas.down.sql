@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS didstore_agent_id_idx;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS quota_registrations_per_day;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS quota_active_dids;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS quota_supersedes_per_did;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS quota_supersede_period_hours;
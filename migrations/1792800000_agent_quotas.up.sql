@@ -0,0 +1,5 @@
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS quota_registrations_per_day integer DEFAULT 0;
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS quota_active_dids integer DEFAULT 0;
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS quota_supersedes_per_did integer DEFAULT 0;
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS quota_supersede_period_hours integer DEFAULT 24;
+CREATE INDEX IF NOT EXISTS didstore_agent_id_idx ON didstore (agent_id);
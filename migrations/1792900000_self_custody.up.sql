@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS self_custody boolean DEFAULT false;
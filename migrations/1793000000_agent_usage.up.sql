@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS agent_usage (
+  agent_id text NOT NULL,
+  day date NOT NULL DEFAULT current_date,
+  operation text NOT NULL,
+  count integer DEFAULT 0,
+  PRIMARY KEY (agent_id, day, operation)
+);
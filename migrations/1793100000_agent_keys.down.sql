@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS jwks_url;
+DROP TABLE IF EXISTS agent_keys;
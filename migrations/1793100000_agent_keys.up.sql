@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS agent_keys (
+  id bigserial PRIMARY KEY,
+  agent_id text NOT NULL REFERENCES agents (id) ON DELETE CASCADE,
+  kid text NOT NULL,
+  jwk text DEFAULT '',
+  created timestamp DEFAULT current_timestamp,
+  last_used timestamp,
+  revoked timestamp
+);
+CREATE INDEX IF NOT EXISTS agent_keys_agent_id_idx ON agent_keys (agent_id);
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS jwks_url text DEFAULT '';
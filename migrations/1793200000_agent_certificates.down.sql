@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS agents_cert_subject_idx;
+DROP INDEX IF EXISTS agents_cert_spki_idx;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS cert_spki;
+ALTER TABLE IF EXISTS agents DROP COLUMN IF EXISTS cert_subject;
@@ -0,0 +1,4 @@
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS cert_subject text DEFAULT '';
+ALTER TABLE IF EXISTS agents ADD COLUMN IF NOT EXISTS cert_spki text DEFAULT '';
+CREATE INDEX IF NOT EXISTS agents_cert_spki_idx ON agents (cert_spki) WHERE cert_spki != '';
+CREATE INDEX IF NOT EXISTS agents_cert_subject_idx ON agents (cert_subject) WHERE cert_subject != '';
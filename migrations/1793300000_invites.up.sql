@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS invites (
+  id bigserial PRIMARY KEY,
+  token_hash text NOT NULL UNIQUE,
+  created_by text NOT NULL,
+  note text DEFAULT '',
+  max_uses integer DEFAULT 1,
+  uses integer DEFAULT 0,
+  expires timestamp,
+  created timestamp DEFAULT current_timestamp,
+  revoked timestamp
+);
+CREATE INDEX IF NOT EXISTS invites_created_by_idx ON invites (created_by);
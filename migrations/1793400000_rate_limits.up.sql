@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS rate_limits (
+  key text PRIMARY KEY,
+  tokens double precision NOT NULL,
+  updated timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS rate_limits_updated_idx ON rate_limits (updated);
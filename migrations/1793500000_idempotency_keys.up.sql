@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  key text PRIMARY KEY,
+  request_hash text NOT NULL,
+  status integer,
+  content_type text,
+  body bytea,
+  created timestamp DEFAULT current_timestamp
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created);
@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore DROP COLUMN IF EXISTS envelope_kek;
+ALTER TABLE IF EXISTS agent_secrets DROP COLUMN IF EXISTS envelope_kek;
@@ -0,0 +1,2 @@
+ALTER TABLE IF EXISTS didstore ADD COLUMN IF NOT EXISTS envelope_kek text DEFAULT '';
+ALTER TABLE IF EXISTS agent_secrets ADD COLUMN IF NOT EXISTS envelope_kek text DEFAULT '';
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS agent_keys_active_kid_idx;
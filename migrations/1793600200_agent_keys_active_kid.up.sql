@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS agent_keys_active_kid_idx ON agent_keys (agent_id, kid) WHERE revoked IS NULL;
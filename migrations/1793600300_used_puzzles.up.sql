@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS used_puzzles (
+  id text PRIMARY KEY,
+  expires timestamp NOT NULL
+);
+CREATE INDEX IF NOT EXISTS used_puzzles_expires_idx ON used_puzzles (expires);
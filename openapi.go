@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi"
+)
+
+// apiOperation describes a /v2 route in the OpenAPI document. Its bodies are described by the
+// types the handler decodes and responds with.
+type apiOperation struct {
+	Method    string
+	Path      string
+	ID        string
+	Summary   string
+	Tag       string
+	Params    []apiParameter
+	Request   interface{}
+	Responses []apiResponse
+	AgentAuth bool
+}
+
+type apiParameter struct {
+	Name     string
+	In       string // path or query
+	Schema   openAPISchema
+	Required bool
+}
+
+// apiResponse is a successful response. A nil Body means no content.
+type apiResponse struct {
+	Status      int
+	Description string
+	Body        interface{}
+}
+
+var (
+	didParam      = apiParameter{Name: "DID", In: "path", Schema: openAPISchema{Type: "string"}, Required: true}
+	inviteIDParam = apiParameter{Name: "inviteID", In: "path", Schema: openAPISchema{Type: "integer"}, Required: true}
+	dryRunParam   = apiParameter{Name: "dryRun", In: "query", Schema: openAPISchema{Type: "boolean"}}
+)
+
+// apiOperations lists every route served by v2Router
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/", ID: "getMasterPublicKey", Summary: "Get the master public key to encrypt registration secrets to", Tag: "dids",
+		Responses: []apiResponse{{200, "the master public key", v2IndexResponse{}}}},
+	{Method: "GET", Path: "/pow", ID: "getPoWPuzzle", Summary: "Get a proof of work puzzle for register or supersede", Tag: "dids",
+		Responses: []apiResponse{{200, "a puzzle", v2PuzzleResponse{}}}},
+	{Method: "GET", Path: "/dids/{DID}", ID: "resolve", Summary: "Resolve a DID to its document, or to the DID that superseded it", Tag: "dids",
+		Params: []apiParameter{didParam}, Responses: []apiResponse{{200, "the DID", v2ResolveResponse{}}}},
+	{Method: "GET", Path: "/dids/{DID}/root", ID: "resolveRoot", Summary: "Resolve the root of a chain to its latest DID", Tag: "dids",
+		Params: []apiParameter{didParam}, Responses: []apiResponse{{200, "the latest DID", v2ResolveResponse{}}}},
+	{Method: "GET", Path: "/dids/{DID}/history", ID: "history", Summary: "List every DID in a DID's chain, oldest first", Tag: "dids",
+		Params: []apiParameter{didParam}, Responses: []apiResponse{{200, "the chain", v2HistoryResponse{}}}},
+	{Method: "POST", Path: "/validate", ID: "validate", Summary: "Check a registration, or a supersede, without recording it", Tag: "dids",
+		Request: v2ValidateRequest{}, Responses: []apiResponse{{200, "every error in the registration", v2ValidateResponse{}}}},
+	{Method: "POST", Path: "/register", ID: "register", Summary: "Register a DID, to be confirmed by signing the challenge", Tag: "dids",
+		Params: []apiParameter{dryRunParam}, Request: v2RegisterRequest{},
+		Responses: []apiResponse{{201, "the registration's challenge", v2ChallengeResponse{}}, {200, "a valid dry run", v2ValidateResponse{}}}},
+	{Method: "POST", Path: "/confirm", ID: "confirm", Summary: "Confirm a registration with the signed challenge", Tag: "dids",
+		Request: v2ConfirmRequest{}, Responses: []apiResponse{{200, "the verified DID", v2DIDStatusResponse{}}}},
+	{Method: "POST", Path: "/supersede", ID: "supersede", Summary: "Register a DID superseding an active one", Tag: "dids",
+		Params: []apiParameter{dryRunParam}, Request: v2SupersedeRequest{},
+		Responses: []apiResponse{{201, "the registration's challenge", v2ChallengeResponse{}}, {200, "a valid dry run", v2ValidateResponse{}}}},
+	{Method: "POST", Path: "/confirmSupersede", ID: "confirmSupersede", Summary: "Confirm a supersede with the signed challenge", Tag: "dids",
+		Request: v2ConfirmRequest{}, Responses: []apiResponse{{200, "the verified DID", v2DIDStatusResponse{}}}},
+	{Method: "POST", Path: "/revoke", ID: "revoke", Summary: "Revoke a DID", Tag: "dids",
+		Request: v2RevokeRequest{}, Responses: []apiResponse{{200, "the revoked DID", v2DIDStatusResponse{}}}},
+	{Method: "POST", Path: "/rotateSecret", ID: "rotateSecret", Summary: "Replace the registration secret of a chain", Tag: "dids",
+		Request: v2RotateSecretRequest{}, Responses: []apiResponse{{200, "the chain's root", v2RotateSecretResponse{}}}},
+	{Method: "POST", Path: "/selfCustody", ID: "selfCustody", Summary: "Opt a chain out of, or back into, agent supersede and revoke", Tag: "dids",
+		Request: v2SelfCustodyRequest{}, Responses: []apiResponse{{200, "the chain's self custody", v2SelfCustodyResponse{}}}},
+	{Method: "POST", Path: "/agent/register", ID: "agentRegister", Summary: "Register a DID on behalf of an agent's user", Tag: "agents",
+		Request: v2AgentRegisterRequest{}, Responses: []apiResponse{{201, "the verified DID", v2DIDStatusResponse{}}}},
+	{Method: "POST", Path: "/agent/registerBatch", ID: "agentRegisterBatch", Summary: "Register many DIDs for an agent at once", Tag: "agents",
+		Request:   v2AgentRegisterBatchRequest{},
+		Responses: []apiResponse{{200, "the outcome of each registration", v2BatchResponse{}}, {201, "an atomic batch, recorded", v2BatchResponse{}}}},
+	{Method: "POST", Path: "/agent/supersede", ID: "agentSupersede", Summary: "Supersede a DID in the agent's custody", Tag: "agents",
+		Request: v2AgentSupersedeRequest{}, Responses: []apiResponse{{201, "the verified DID", v2DIDStatusResponse{}}}},
+	{Method: "POST", Path: "/agent/revoke", ID: "agentRevoke", Summary: "Revoke a DID in the agent's custody", Tag: "agents",
+		Request: v2AgentRevokeRequest{}, Responses: []apiResponse{{200, "the revoked DID", v2DIDStatusResponse{}}}},
+	{Method: "GET", Path: "/agent/dids", ID: "agentListDIDs", Summary: "List the DIDs the agent registered, a page at a time", Tag: "agents", AgentAuth: true,
+		Params: []apiParameter{
+			{Name: "status", In: "query", Schema: openAPISchema{Type: "string", Enum: []string{"init", "verified", "superseded", "revoked"}}},
+			{Name: "createdAfter", In: "query", Schema: openAPISchema{Type: "string", Format: "date-time"}},
+			{Name: "createdBefore", In: "query", Schema: openAPISchema{Type: "string", Format: "date-time"}},
+			{Name: "cursor", In: "query", Schema: openAPISchema{Type: "string"}},
+			{Name: "limit", In: "query", Schema: openAPISchema{Type: "integer"}},
+		},
+		Responses: []apiResponse{{200, "a page of DIDs", v2DIDListResponse{}}}},
+	{Method: "GET", Path: "/agent/invites", ID: "agentListInvites", Summary: "List the agent's invites", Tag: "agents", AgentAuth: true,
+		Responses: []apiResponse{{200, "the invites", v2InviteListResponse{}}}},
+	{Method: "POST", Path: "/agent/invites", ID: "agentCreateInvite", Summary: "Issue an invite", Tag: "agents", AgentAuth: true,
+		Request: v2InviteRequest{}, Responses: []apiResponse{{201, "the invite", v2InviteResponse{}}}},
+	{Method: "DELETE", Path: "/agent/invites/{inviteID}", ID: "agentRevokeInvite", Summary: "Revoke an invite", Tag: "agents", AgentAuth: true,
+		Params: []apiParameter{inviteIDParam}, Responses: []apiResponse{{204, "revoked", nil}}},
+}
+
+// openAPISchema is a JSON schema as OpenAPI 3.0 has them
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *bool                     `json:"additionalProperties,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+}
+
+// openAPISchemas builds the schemas of the named types in the document
+type openAPISchemas map[string]*openAPISchema
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaName is the name of a type's schema, its Go name without the v2 prefix
+func schemaName(t reflect.Type) string {
+	name := []rune(strings.TrimPrefix(t.Name(), "v2"))
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// schemaFor describes a Go type, adding the structs it holds to the components. Fields without
+// omitempty are required, and request structs are strict, as decodeV2 is.
+func (s openAPISchemas) schemaFor(t reflect.Type, strict bool) *openAPISchema {
+	switch {
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t == rawType:
+		return &openAPISchema{Type: "object"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schemaFor(t.Elem(), strict)
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.Slice:
+		return &openAPISchema{Type: "array", Items: s.schemaFor(t.Elem(), strict)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := s[name]; !ok {
+			schema := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+			if strict {
+				schema.AdditionalProperties = new(bool)
+			}
+			s[name] = schema
+			for i := 0; i < t.NumField(); i++ {
+				tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+				if tag[0] == "" || tag[0] == "-" {
+					continue
+				}
+				schema.Properties[tag[0]] = s.schemaFor(t.Field(i).Type, strict)
+				if len(tag) == 1 || tag[1] != "omitempty" {
+					schema.Required = append(schema.Required, tag[0])
+				}
+			}
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	}
+	// anything else, like the interface{} holding a DID in its history
+	return &openAPISchema{}
+}
+
+// resolve follows a schema's reference
+func (s openAPISchemas) resolve(schema *openAPISchema) *openAPISchema {
+	if schema.Ref != "" {
+		return s[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// apiSpec is the OpenAPI document without its servers, which come from the config, and the
+// schemas requests are checked against
+type apiSpec struct {
+	doc     map[string]interface{}
+	schemas openAPISchemas
+	bodies  map[string]*openAPISchema // request body schemas by method and path
+}
+
+var (
+	apiSpecOnce sync.Once
+	theAPISpec  *apiSpec
+)
+
+// openAPISpec builds the document from apiOperations the first time it's needed
+func openAPISpec() *apiSpec {
+	apiSpecOnce.Do(func() {
+		theAPISpec = newAPISpec(apiOperations)
+	})
+	return theAPISpec
+}
+
+func newAPISpec(operations []apiOperation) *apiSpec {
+	spec := &apiSpec{schemas: openAPISchemas{}, bodies: map[string]*openAPISchema{}}
+	problemSchema := spec.schemas.schemaFor(reflect.TypeOf(problem{}), false)
+
+	paths := map[string]map[string]interface{}{}
+	for _, op := range operations {
+		operation := map[string]interface{}{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+		}
+
+		var params []map[string]interface{}
+		for _, p := range op.Params {
+			schema := p.Schema
+			params = append(params, map[string]interface{}{"name": p.Name, "in": p.In, "required": p.Required, "schema": &schema})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			body := spec.schemas.schemaFor(reflect.TypeOf(op.Request), true)
+			spec.bodies[op.Method+" "+op.Path] = body
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": body}},
+			}
+		}
+
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{
+				"description": "a problem, see the code",
+				"content":     map[string]interface{}{"application/problem+json": map[string]interface{}{"schema": problemSchema}},
+			},
+		}
+		for _, res := range op.Responses {
+			response := map[string]interface{}{"description": res.Description}
+			if res.Body != nil {
+				response["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": spec.schemas.schemaFor(reflect.TypeOf(res.Body), false)},
+				}
+			}
+			responses[strconv.Itoa(res.Status)] = response
+		}
+		operation["responses"] = responses
+
+		if op.AgentAuth {
+			operation["security"] = []map[string][]string{{"agentJWT": {}}}
+		}
+
+		path := "/v2" + op.Path
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	spec.doc = map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "DID Server",
+			"version":     "2",
+			"description": "Registers and resolves JLINC DIDs. Errors are RFC 7807 problems with a stable code. Agents may authenticate with a client certificate instead of an agentkey.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": spec.schemas,
+			"securitySchemes": map[string]interface{}{
+				"agentJWT": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+	return spec
+}
+
+// Serve the OpenAPI document for the /v2 API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	doc := map[string]interface{}{}
+	for k, v := range openAPISpec().doc {
+		doc[k] = v
+	}
+	doc["servers"] = []map[string]string{{"url": Conf.App.URL}}
+
+	jsn, _ := json.Marshal(doc)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsn)
+}
+
+// validateRequests checks /v2 requests against the OpenAPI document when [openapi] validate is
+// on, refusing those that don't match before they reach the handler
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Conf.OpenAPI.Validate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := openAPISpec().check(r); err != nil {
+			writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check matches a request's parameters and body against its operation
+func (spec *apiSpec) check(r *http.Request) error {
+	pattern := strings.TrimPrefix(chi.RouteContext(r.Context()).RoutePattern(), "/v2")
+	for _, op := range apiOperations {
+		if op.Method != r.Method || op.Path != pattern {
+			continue
+		}
+		for _, p := range op.Params {
+			value := r.URL.Query().Get(p.Name)
+			if p.In == "path" {
+				value = chi.URLParam(r, p.Name)
+			}
+			if value == "" {
+				continue
+			}
+			if err := p.Schema.checkParam(value); err != nil {
+				return fmt.Errorf("%s %s", p.Name, err)
+			}
+		}
+
+		body := spec.bodies[op.Method+" "+op.Path]
+		if body == nil || r.Body == nil {
+			return nil
+		}
+		// bodies over the limit are left for the handler to refuse
+		bodyBytes, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxV2BatchBody+1))
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), r.Body))
+		if len(bodyBytes) > maxV2BatchBody {
+			return nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(bodyBytes))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			// the handler answers bodies that aren't JSON
+			return nil
+		}
+		return spec.schemas.check(body, v, "")
+	}
+	return nil
+}
+
+// checkParam checks a path or query parameter's value
+func (schema openAPISchema) checkParam(value string) error {
+	switch schema.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+	}
+	return schema.checkString(value)
+}
+
+func (schema openAPISchema) checkString(value string) error {
+	if schema.Format == "date-time" {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return fmt.Errorf("must be in RFC3339 format")
+		}
+	}
+	if len(schema.Enum) > 0 {
+		for _, e := range schema.Enum {
+			if value == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(schema.Enum, ", "))
+	}
+	return nil
+}
+
+// check matches a decoded JSON value against a schema, at names where it is in the body
+func (s openAPISchemas) check(schema *openAPISchema, v interface{}, at string) error {
+	schema = s.resolve(schema)
+	name := strings.TrimPrefix(at, ".")
+	if name == "" {
+		name = "request body"
+	}
+	switch schema.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		for _, field := range schema.Required {
+			if _, ok := obj[field]; !ok {
+				return fmt.Errorf("%s is required", strings.TrimPrefix(at+"."+field, "."))
+			}
+		}
+		fields := make([]string, 0, len(obj))
+		for field := range obj {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			value := obj[field]
+			prop, ok := schema.Properties[field]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("unknown field %q", strings.TrimPrefix(at+"."+field, "."))
+				}
+				continue
+			}
+			if value == nil {
+				continue
+			}
+			if err := s.check(prop, value, at+"."+field); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		for i, item := range arr {
+			if err := s.check(schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		if err := schema.checkString(str); err != nil {
+			return fmt.Errorf("%s %s", name, err)
+		}
+	case "integer":
+		if n, ok := v.(json.Number); !ok || strings.ContainsAny(n.String(), ".eE") {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+	case "number":
+		if _, ok := v.(json.Number); !ok {
+			return fmt.Errorf("%s must be a number", name)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s must be true or false", name)
+		}
+	}
+	return nil
+}
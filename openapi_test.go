@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestAPIOperationsRouted(t *testing.T) {
+	routed := map[string]bool{}
+	chi.Walk(v2Router().(chi.Routes), func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		return nil
+	})
+
+	described := map[string]bool{}
+	for _, op := range apiOperations {
+		described[op.Method+" "+op.Path] = true
+		if !routed[op.Method+" "+op.Path] {
+			t.Errorf("%s %s is described but not routed", op.Method, op.Path)
+		}
+	}
+	for route := range routed {
+		if !described[route] {
+			t.Errorf("%s is routed but not described", route)
+		}
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	defer func(url string) { Conf.App.URL = url }(Conf.App.URL)
+	Conf.App.URL = "https://did.example.com"
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(serveOpenAPI).ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]openAPISchema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != Conf.App.URL {
+		t.Errorf("unexpected document header: %s %v", doc.OpenAPI, doc.Servers)
+	}
+	if _, ok := doc.Paths["/v2/dids/{DID}/history"]["get"]; !ok {
+		t.Errorf("history path missing")
+	}
+
+	register := doc.Components.Schemas["RegisterRequest"]
+	if strings.Join(register.Required, ",") != "did,signature,secret" {
+		t.Errorf("register request required: got %v", register.Required)
+	}
+	if register.AdditionalProperties == nil || *register.AdditionalProperties {
+		t.Errorf("register request should refuse unknown fields")
+	}
+	if ref := register.Properties["secret"].Ref; ref != "#/components/schemas/Secret" {
+		t.Errorf("register request secret: got %q", ref)
+	}
+	if _, ok := doc.Components.Schemas["Problem"]; !ok {
+		t.Errorf("problem schema missing")
+	}
+}
+
+func TestValidateRequests(t *testing.T) {
+	defer func(validate bool) { Conf.OpenAPI.Validate = validate }(Conf.OpenAPI.Validate)
+	Conf.OpenAPI.Validate = true
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		detail string
+	}{
+		{"GET", "/v2/agent/dids?status=closed", "", "status must be one of init, verified, superseded, revoked"},
+		{"GET", "/v2/agent/dids?limit=ten", "", "limit must be an integer"},
+		{"GET", "/v2/agent/dids?createdAfter=yesterday", "", "createdAfter must be in RFC3339 format"},
+		{"DELETE", "/v2/agent/invites/first", "", "inviteID must be an integer"},
+		{"POST", "/v2/register?dryRun=maybe", `{}`, "dryRun must be true or false"},
+		{"POST", "/v2/register", `{"signature":"s", "secret":{"cyphertext":"c"}}`, "did is required"},
+		{"POST", "/v2/register", `{"did":{}, "signature":"s", "secret":{"nonce":"n"}}`, "secret.cyphertext is required"},
+		{"POST", "/v2/register", `{"did":{}, "signature":"s", "secret":{"cyphertext":"c"}, "pow":{"puzzle":1, "nonce":"n"}}`, "pow.puzzle must be a string"},
+		{"POST", "/v2/agent/registerBatch", `{"registrations":["a", 2]}`, "registrations[1] must be a string"},
+		{"POST", "/v2/agent/invites", `{"maxUses":1.5}`, "maxUses must be an integer"},
+		{"POST", "/v2/agent/invites", `{"expires":"soon"}`, "expires must be in RFC3339 format"},
+		{"POST", "/v2/confirm", `{"challengeResponse":"x", "id":"y"}`, `unknown field "id"`},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		v2Server().ServeHTTP(rr, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if expected := problemJSON(http.StatusBadRequest, codeInvalidRequest, test.detail); rr.Code != http.StatusBadRequest || rr.Body.String() != expected {
+			t.Errorf("%s %s: got %v %s want %s", test.method, test.path, rr.Code, rr.Body.String(), expected)
+		}
+	}
+
+	// a request that matches goes on to the handler
+	rr := httptest.NewRecorder()
+	v2Server().ServeHTTP(rr, httptest.NewRequest("POST", "/v2/confirm", strings.NewReader(`{"challengeResponse":"x"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("matching request: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
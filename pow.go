@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// puzzles must be solved and used within this long of being issued
+const powPuzzleTime = 5 * time.Minute
+
+// powSolution is a solved puzzle sent along with a registration or supersede
+type powSolution struct {
+	Puzzle string `json:"puzzle"`
+	Nonce  string `json:"nonce"`
+}
+
+// powError is a solution that doesn't check out, as opposed to a failure checking it
+type powError string
+
+func (e powError) Error() string {
+	return string(e)
+}
+
+var (
+	errPoWRequired = errors.New("proof of work required, get a puzzle from /pow")
+	errPuzzleUsed  = powError("proof of work puzzle already used")
+
+	// puzzles issued in the current minute, which sets the difficulty of the next ones
+	powMu          sync.Mutex
+	powWindowStart time.Time
+	powIssued      int
+
+	// when expired puzzles were last cleared from used_puzzles
+	usedPuzzlesPruned time.Time
+)
+
+// powKey derives the key that authenticates puzzles from the current master secret key,
+// so that any server sharing the master key accepts them
+func powKey() ([]byte, error) {
+	sk, err := keyProvider().SecretKey(Conf.Keys.Public)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sk)
+	mac.Write([]byte("didserver proof of work key"))
+	return mac.Sum(nil), nil
+}
+
+func puzzleMAC(key []byte, puzzle string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(puzzle))
+	return b64Encode(mac.Sum(nil))
+}
+
+// powDifficulty counts a new puzzle against the current minute and returns its difficulty in
+// leading zero bits, one more for each doubling of the puzzles issued beyond the target
+func powDifficulty(now time.Time) int {
+	powMu.Lock()
+	defer powMu.Unlock()
+	if now.Sub(powWindowStart) >= time.Minute {
+		powWindowStart, powIssued = now, 0
+	}
+	powIssued++
+
+	difficulty := Conf.PoW.Difficulty
+	if Conf.PoW.TargetPerMinute > 0 {
+		for limit := Conf.PoW.TargetPerMinute; powIssued > limit; limit *= 2 {
+			difficulty++
+		}
+	}
+	if Conf.PoW.MaxDifficulty > 0 && difficulty > Conf.PoW.MaxDifficulty {
+		difficulty = Conf.PoW.MaxDifficulty
+	}
+	return difficulty
+}
+
+// newPuzzle issues a puzzle of the given difficulty, as random.difficulty.expiry.mac
+func newPuzzle(difficulty int, expires time.Time) (string, error) {
+	key, err := powKey()
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return "", err
+	}
+	puzzle := fmt.Sprintf("%s.%d.%d", b64Encode(random), difficulty, expires.Unix())
+	return puzzle + "." + puzzleMAC(key, puzzle), nil
+}
+
+// hasLeadingZeroBits checks the first bits of a hash
+func hasLeadingZeroBits(h []byte, bits int) bool {
+	if bits > len(h)*8 {
+		return false
+	}
+	if !zeroPrefixed(h, bits/8) {
+		return false
+	}
+	return bits%8 == 0 || h[bits/8]>>(8-bits%8) == 0
+}
+
+// powHash is the hash a solution's nonce must give enough leading zero bits, bound to the DID id
+func powHash(puzzle string, id string, nonce string) []byte {
+	return getHash(puzzle + "." + id + "." + nonce)
+}
+
+// checkPoW checks that a solution is to an unexpired puzzle issued by this server and meets
+// the puzzle's difficulty for the DID id, returning the puzzle's id and expiry. A solution that
+// doesn't is a powError.
+func checkPoW(s *powSolution, id string, now time.Time) (string, time.Time, error) {
+	if s == nil || s.Puzzle == "" {
+		return "", time.Time{}, errPoWRequired
+	}
+	parts := strings.Split(s.Puzzle, ".")
+	if len(parts) != 4 {
+		return "", time.Time{}, powError("proof of work puzzle is not valid")
+	}
+	key, err := powKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	puzzle := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(puzzleMAC(key, puzzle))) {
+		return "", time.Time{}, powError("proof of work puzzle is not valid")
+	}
+	difficulty, _ := strconv.Atoi(parts[1])
+	expiry, _ := strconv.ParseInt(parts[2], 10, 64)
+	expires := time.Unix(expiry, 0)
+	if now.After(expires) {
+		return "", time.Time{}, powError("proof of work puzzle expired")
+	}
+	if !hasLeadingZeroBits(powHash(s.Puzzle, id, s.Nonce), difficulty) {
+		return "", time.Time{}, powError(fmt.Sprintf("proof of work does not have %d leading zero bits", difficulty))
+	}
+	return parts[0], expires, nil
+}
+
+// usePuzzle records a puzzle as used in used_puzzles until it expires, so that no server
+// sharing the database accepts it again. It returns errPuzzleUsed when it already was.
+func usePuzzle(puzzleID string, expires time.Time, now time.Time) error {
+	// forget expired puzzles, now and then
+	powMu.Lock()
+	prune := now.Sub(usedPuzzlesPruned) > time.Minute
+	if prune {
+		usedPuzzlesPruned = now
+	}
+	powMu.Unlock()
+	if prune {
+		if _, err := DB.Exec("DELETE FROM used_puzzles WHERE expires < $1", now.UTC()); err != nil {
+			log.Printf("used puzzles: %v", err)
+		}
+	}
+
+	result, err := DB.Exec("INSERT INTO used_puzzles (id, expires) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", puzzleID, expires.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return errPuzzleUsed
+	}
+	return nil
+}
+
+// powProblem is the problem with a request's solution when proof of work is on and it doesn't
+// check out, or nil
+func powProblem(s *powSolution, id string) *problem {
+	if !Conf.PoW.Enabled {
+		return nil
+	}
+	now := time.Now()
+	puzzleID, expires, err := checkPoW(s, id, now)
+	if err == nil {
+		err = usePuzzle(puzzleID, expires, now)
+	}
+	_, isPoWError := err.(powError)
+	switch {
+	case err == nil:
+		return nil
+	case err == errPoWRequired:
+		return newProblem(http.StatusPreconditionRequired, codePoWRequired, err.Error())
+	case isPoWError:
+		return newProblem(http.StatusBadRequest, codePoWInvalid, err.Error())
+	case puzzleID == "":
+		// the puzzle key couldn't be had from the key provider
+		log.Printf("proof of work: %v", err)
+		return newProblem(http.StatusInternalServerError, codeInternalError, "puzzle error")
+	default:
+		return databaseProblem("pow")
+	}
+}
+
+// Issue a proof of work puzzle for /register or /supersede
+func powPuzzle(w http.ResponseWriter, r *http.Request) {
+	if !Conf.PoW.Enabled {
+		writeProblem(w, http.StatusNotFound, codePoWDisabled, "proof of work is not required")
+		return
+	}
+
+	puzzle, difficulty, expires, err := issuePuzzle()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternalError, "puzzle error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"puzzle":%q, "difficulty":%d, "expires":%q}`, puzzle, difficulty, expires.UTC().Format(time.RFC3339))
+}
+
+// issuePuzzle makes a puzzle at the current difficulty, returning it with its difficulty and
+// expiry
+func issuePuzzle() (string, int, time.Time, error) {
+	now := time.Now()
+	difficulty := powDifficulty(now)
+	expires := now.Add(powPuzzleTime)
+	puzzle, err := newPuzzle(difficulty, expires)
+	return puzzle, difficulty, expires, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// solvePoW finds a nonce giving the puzzle's difficulty for a DID id
+func solvePoW(puzzle string, id string, difficulty int) string {
+	for n := 0; ; n++ {
+		nonce := strconv.Itoa(n)
+		if hasLeadingZeroBits(powHash(puzzle, id, nonce), difficulty) {
+			return nonce
+		}
+	}
+}
+
+func TestHasLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		hash []byte
+		bits int
+		want bool
+	}{
+		{[]byte{0x00, 0x00, 0xff}, 16, true},
+		{[]byte{0x00, 0x00, 0xff}, 17, false},
+		{[]byte{0x00, 0x0f, 0xff}, 12, true},
+		{[]byte{0x00, 0x0f, 0xff}, 13, false},
+		{[]byte{0x7f}, 1, true},
+		{[]byte{0xff}, 0, true},
+		{[]byte{0x00}, 9, false},
+	}
+	for _, test := range tests {
+		if got := hasLeadingZeroBits(test.hash, test.bits); got != test.want {
+			t.Errorf("hasLeadingZeroBits(%x, %d) = %v want %v", test.hash, test.bits, got, test.want)
+		}
+	}
+}
+
+func TestPoWDifficulty(t *testing.T) {
+	Conf.PoW = pow{Enabled: true, Difficulty: 10, MaxDifficulty: 13, TargetPerMinute: 2}
+	defer func() { Conf.PoW = pow{} }()
+	now := time.Now()
+	powWindowStart = time.Time{}
+
+	var got []int
+	for i := 0; i < 20; i++ {
+		got = append(got, powDifficulty(now))
+	}
+	want := []int{10, 10, 11, 11, 12, 12, 12, 12, 13, 13, 13, 13, 13, 13, 13, 13, 13, 13, 13, 13}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("difficulty did not adapt to load: got %v want %v", got, want)
+	}
+
+	// a new minute starts over
+	if d := powDifficulty(now.Add(time.Minute)); d != 10 {
+		t.Errorf("got difficulty %d in a new minute want 10", d)
+	}
+}
+
+func TestCheckPoW(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	id := "did:jlinc:a-DID-id"
+	puzzle, err := newPuzzle(8, now.Add(powPuzzleTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := solvePoW(puzzle, id, 8)
+
+	// the solution is bound to the DID id
+	other := "did:jlinc:another-id"
+	if !hasLeadingZeroBits(powHash(puzzle, other, nonce), 8) {
+		if _, _, err = checkPoW(&powSolution{Puzzle: puzzle, Nonce: nonce}, other, now); err == nil {
+			t.Errorf("solution accepted for another DID id")
+		}
+	}
+	puzzleID, expires, err := checkPoW(&powSolution{Puzzle: puzzle, Nonce: nonce}, id, now)
+	if err != nil {
+		t.Errorf("solution refused: %v", err)
+	}
+	if puzzleID != strings.Split(puzzle, ".")[0] || expires.Unix() != now.Add(powPuzzleTime).Unix() {
+		t.Errorf("got puzzle %q expiring %v", puzzleID, expires)
+	}
+
+	// the difficulty can't be lowered
+	parts := strings.Split(puzzle, ".")
+	easier := strings.Join([]string{parts[0], "0", parts[2], parts[3]}, ".")
+	if _, _, err = checkPoW(&powSolution{Puzzle: easier, Nonce: "0"}, id, now); err == nil || err.Error() != "proof of work puzzle is not valid" {
+		t.Errorf("got error %v with a changed difficulty", err)
+	}
+
+	expired, _ := newPuzzle(0, now.Add(-time.Second))
+	if _, _, err = checkPoW(&powSolution{Puzzle: expired, Nonce: "0"}, id, now); err == nil || err.Error() != "proof of work puzzle expired" {
+		t.Errorf("got error %v with an expired puzzle", err)
+	}
+	if _, _, err = checkPoW(nil, id, now); err != errPoWRequired {
+		t.Errorf("got error %v without a solution", err)
+	}
+}
+
+func TestUsePuzzle(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	DB, err = sql.Open("postgres", Conf.Database.ConnectionString)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer DB.Close()
+
+	// a puzzle is used once, by any server sharing the database
+	now := time.Now()
+	if err = usePuzzle("a-puzzle", now.Add(powPuzzleTime), now); err != nil {
+		t.Fatalf("puzzle refused: %v", err)
+	}
+	if err = usePuzzle("a-puzzle", now.Add(powPuzzleTime), now); err != errPuzzleUsed {
+		t.Errorf("got error %v reusing a puzzle", err)
+	}
+
+	// expired puzzles are forgotten
+	later := now.Add(powPuzzleTime + time.Minute)
+	usedPuzzlesPruned = time.Time{}
+	if err = usePuzzle("another-puzzle", later.Add(powPuzzleTime), later); err != nil {
+		t.Fatalf("puzzle refused: %v", err)
+	}
+	var remaining int
+	DB.QueryRow("SELECT COUNT(*) FROM used_puzzles WHERE id = 'a-puzzle'").Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("expired puzzle not pruned")
+	}
+
+	// delete previous entries from the test database
+	if _, err = DB.Exec("DELETE FROM used_puzzles"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterRequiresPoW(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(powPuzzle).ServeHTTP(rr, httptest.NewRequest("GET", "/pow", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("puzzle issued with proof of work off: got %v", rr.Code)
+	}
+
+	Conf.PoW = pow{Enabled: true, Difficulty: 4}
+	defer func() { Conf.PoW = pow{} }()
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(powPuzzle).ServeHTTP(rr, httptest.NewRequest("GET", "/pow", nil))
+	var issued struct {
+		Puzzle     string `json:"puzzle"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &issued); err != nil || rr.Code != http.StatusOK || issued.Difficulty != 4 {
+		t.Fatalf("puzzle not issued: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	id := "did:jlinc:a-DID-id"
+	tests := []struct {
+		name     string
+		endpoint string
+		handler  http.HandlerFunc
+		pow      string
+		status   int
+	}{
+		{"register without a solution", "/register", registerDID, "", http.StatusPreconditionRequired},
+		{"supersede without a solution", "/supersede", supersedeDID, "", http.StatusPreconditionRequired},
+		{"register with a bad puzzle", "/register", registerDID, `,"pow":{"puzzle":"not.a.puzzle","nonce":"1"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		body := fmt.Sprintf(`{"did":{"id":%q}%s}`, id, test.pow)
+		rr = httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, httptest.NewRequest("POST", test.endpoint, strings.NewReader(body)))
+		if rr.Code != test.status {
+			t.Errorf("%s: got %v %s want %v", test.name, rr.Code, rr.Body.String(), test.status)
+		}
+	}
+
+	// a bad solution is the client's fault, but not having the puzzle key isn't
+	solution := &powSolution{Puzzle: issued.Puzzle, Nonce: "1"}
+	if p := powProblem(&powSolution{Puzzle: "not.a.puzzle", Nonce: "1"}, id); p == nil || p.Status != http.StatusBadRequest {
+		t.Errorf("bad puzzle: got %+v", p)
+	}
+	Conf.Keys.Secret = ""
+	if p := powProblem(solution, id); p == nil || p.Status != http.StatusInternalServerError {
+		t.Errorf("without the master secret key: got %+v", p)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// problem types are this prefix followed by the problem's code
+const problemTypeBase = "urn:didserver:problem:"
+
+// problem codes, which clients can rely on not to change
+const (
+	codeInvalidJSON           = "invalid_json"
+	codeInvalidRequest        = "invalid_request"
+	codeValidationFailed      = "validation_failed"
+	codeUnauthorized          = "unauthorized"
+	codeJWTInvalid            = "jwt_invalid"
+	codeSignatureInvalid      = "signature_invalid"
+	codeForbidden             = "forbidden"
+	codeNotFound              = "not_found"
+	codeConflict              = "conflict"
+	codeTooLarge              = "too_large"
+	codeDIDNotFound           = "did_not_found"
+	codeDIDRevoked            = "did_revoked"
+	codeDIDNotActive          = "did_not_active"
+	codeDIDSuperseded         = "did_superseded"
+	codeSupersedesNotFound    = "supersedes_not_found"
+	codeSupersedesNotActive   = "supersedes_not_active"
+	codeSecretInvalid         = "secret_invalid"
+	codeRecordFailed          = "record_failed"
+	codeRotationStale         = "rotation_stale"
+	codeRegistrationClosed    = "registration_closed"
+	codeInviteInvalid         = "invite_invalid"
+	codePoWRequired           = "pow_required"
+	codePoWInvalid            = "pow_invalid"
+	codePoWDisabled           = "pow_disabled"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeBatchNotRecorded      = "batch_not_recorded"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeDatabaseError         = "database_error"
+	codeInternalError         = "internal_error"
+)
+
+// problem is an RFC 7807 problem details body. success and error are extensions that keep the
+// shape error responses had before, for older clients: success is always false, and error
+// repeats the detail.
+type problem struct {
+	Type    string            `json:"type"`
+	Title   string            `json:"title"`
+	Status  int               `json:"status"`
+	Detail  string            `json:"detail,omitempty"`
+	Code    string            `json:"code"`
+	Errors  []validationError `json:"errors,omitempty"`
+	Results []batchResult     `json:"results,omitempty"`
+	Success bool              `json:"success"`
+	Error   string            `json:"error,omitempty"`
+
+	// RetryAfter is sent as the Retry-After header, in seconds, when set
+	RetryAfter int `json:"-"`
+}
+
+func newProblem(status int, code string, detail string) *problem {
+	return &problem{
+		Type:   problemTypeBase + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+		Error:  detail,
+	}
+}
+
+func (p *problem) write(w http.ResponseWriter) {
+	jsn, _ := json.Marshal(p)
+	if p.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(p.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(jsn)
+}
+
+// writeProblem responds with an application/problem+json error
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	newProblem(status, code, detail).write(w)
+}
+
+// validationProblem lists the errors in a validation result, each with its code
+func validationProblem(status int, result *multierror.Error) *problem {
+	result.ErrorFormat = formatErrors
+	p := newProblem(status, codeValidationFailed, result.Error())
+	p.Errors = validationErrors(result)
+	return p
+}
+
+func writeValidationProblem(w http.ResponseWriter, status int, result *multierror.Error) {
+	validationProblem(status, result).write(w)
+}
+
+// databaseProblem is the problem with a failed query, where says which one
+func databaseProblem(where string) *problem {
+	return newProblem(http.StatusInternalServerError, codeDatabaseError, "database error-"+where)
+}
+
+func writeDatabaseProblem(w http.ResponseWriter, where string) {
+	databaseProblem(where).write(w)
+}
+
+// writeJSONProblem responds to a request body that isn't valid JSON
+func writeJSONProblem(w http.ResponseWriter) {
+	writeProblem(w, http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
+}
+
+// writeBodyProblem responds to a request body that couldn't be decoded, which may be because
+// http.MaxBytesReader cut it off at limit bytes
+func writeBodyProblem(w http.ResponseWriter, err error, limit int64) {
+	// the error http.MaxBytesReader returns has no type of its own to check for
+	if strings.Contains(err.Error(), "request body too large") {
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("request body is limited to %d bytes", limit))
+		return
+	}
+	writeJSONProblem(w)
+}
+
+// statusProblemCode is the code for an error known only by its status
+func statusProblemCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusRequestEntityTooLarge:
+		return codeTooLarge
+	case http.StatusUnprocessableEntity:
+		return codeInvalidJSON
+	}
+	return codeInternalError
+}
+
+// notFound and methodNotAllowed answer requests the router has no route for
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusNotFound, codeNotFound, "no such endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, http.StatusMethodNotAllowed, codeInvalidRequest, r.Method+" is not allowed here")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// problemJSON is the body of a problem response
+func problemJSON(status int, code string, detail string) string {
+	jsn, _ := json.Marshal(newProblem(status, code, detail))
+	return string(jsn)
+}
+
+func TestWriteProblem(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeProblem(rr, http.StatusNotFound, codeDIDNotFound, "DID not found")
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
+	}
+	expected := `{"type":"urn:didserver:problem:did_not_found","title":"Not Found","status":404,"detail":"DID not found","code":"did_not_found","success":false,"error":"DID not found"}`
+	if rr.Body.String() != expected {
+		t.Errorf("unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestWriteValidationProblem(t *testing.T) {
+	var result *multierror.Error
+	result = multierror.Append(result, invalid("context_invalid", "@context missing or incorrect"))
+	result = multierror.Append(result, errors.New("not coded"))
+
+	rr := httptest.NewRecorder()
+	writeValidationProblem(rr, http.StatusBadRequest, result)
+	expected := `{"type":"urn:didserver:problem:validation_failed","title":"Bad Request","status":400,"detail":"request contained 2 errors: @context missing or incorrect, not coded","code":"validation_failed","errors":[{"code":"context_invalid","message":"@context missing or incorrect"},{"code":"invalid","message":"not coded"}],"success":false,"error":"request contained 2 errors: @context missing or incorrect, not coded"}`
+	if rr.Code != http.StatusBadRequest || rr.Body.String() != expected {
+		t.Errorf("unexpected response: got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+}
+
+func TestStatusProblemCode(t *testing.T) {
+	tests := map[int]string{
+		http.StatusBadRequest:          codeInvalidRequest,
+		http.StatusNotFound:            codeNotFound,
+		http.StatusConflict:            codeConflict,
+		http.StatusInternalServerError: codeInternalError,
+		http.StatusServiceUnavailable:  codeInternalError,
+	}
+	for status, code := range tests {
+		if got := statusProblemCode(status); got != code {
+			t.Errorf("statusProblemCode(%d) = %q want %q", status, got, code)
+		}
+	}
+}
+
+// validationProblemJSON is the body of a validation problem response with the given errors
+func validationProblemJSON(status int, errs ...error) string {
+	var result *multierror.Error
+	for _, err := range errs {
+		result = multierror.Append(result, err)
+	}
+	jsn, _ := json.Marshal(validationProblem(status, result))
+	return string(jsn)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// quotaError is returned when an agent is over one of its quotas
+type quotaError struct {
+	quota      string
+	limit      int
+	retryAfter int // seconds until the quota allows another request, 0 when waiting won't help
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota of %d %s exceeded", e.limit, e.quota)
+}
+
+// reserveRegistrations counts n registrations against an agent's quotas for today and for active
+// DIDs, refusing them if they don't fit. db is the transaction that the registrations are then
+// recorded in: the agent's row stays locked until it ends, so that concurrent requests can't both
+// take the last of a quota, and rolling it back releases the reservation.
+func reserveRegistrations(db dbtx, agentkey string, n int) error {
+	var q agentQuotas
+	err := db.QueryRow("SELECT quota_registrations_per_day, quota_active_dids FROM agents WHERE id = $1 FOR UPDATE", agentkey).
+		Scan(&q.RegistrationsPerDay, &q.ActiveDIDs)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if q.ActiveDIDs > 0 {
+		var active int
+		if err = db.QueryRow("SELECT COUNT(*) FROM didstore WHERE agent_id = $1 AND status = 'verified'", agentkey).Scan(&active); err != nil {
+			return err
+		}
+		if active+n > q.ActiveDIDs {
+			return &quotaError{quota: "active DIDs", limit: q.ActiveDIDs}
+		}
+	}
+
+	// today's count only goes up while it stays within the quota
+	var registered int
+	err = db.QueryRow(`INSERT INTO agent_usage (agent_id, day, operation, count) SELECT $1::text, current_date, $2::text, $3::integer WHERE $4::integer = 0 OR $3 <= $4
+		ON CONFLICT (agent_id, day, operation) DO UPDATE SET count = agent_usage.count + $3 WHERE $4 = 0 OR agent_usage.count + $3 <= $4
+		RETURNING count`, agentkey, usageRegister, n, q.RegistrationsPerDay).Scan(&registered)
+	if err == sql.ErrNoRows {
+		var untilTomorrow int
+		if err = db.QueryRow(`SELECT CEIL(EXTRACT(EPOCH FROM (date_trunc('day', NOW()) + interval '1 day' - NOW())))::integer`).Scan(&untilTomorrow); err != nil {
+			return err
+		}
+		return &quotaError{quota: "registrations per day", limit: q.RegistrationsPerDay, retryAfter: untilTomorrow}
+	}
+	return err
+}
+
+// checkSupersedeQuota checks how often an agent has superseded DIDs in a chain during the quota
+// period. db is the transaction that the supersede is then recorded in, which holds the agent's
+// row locked as reserveRegistrations does, so that concurrent supersedes are counted one by one.
+func checkSupersedeQuota(db dbtx, agentkey string, root string) error {
+	var q agentQuotas
+	err := db.QueryRow("SELECT quota_supersedes_per_did, quota_supersede_period_hours FROM agents WHERE id = $1 FOR UPDATE", agentkey).
+		Scan(&q.SupersedesPerDID, &q.SupersedePeriodHours)
+	if err == sql.ErrNoRows || (err == nil && q.SupersedesPerDID == 0) {
+		// agents in [api_auth] have no quotas
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var superseded, retryAfter int
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(CEIL(EXTRACT(EPOCH FROM (MIN(created) + $3 * interval '1 hour' - NOW())))::integer, 0)
+		FROM didstore WHERE root = $1 AND agent_id = $2 AND supersedes != '' AND created > NOW() - $3 * interval '1 hour'`,
+		root, agentkey, q.SupersedePeriodHours).Scan(&superseded, &retryAfter)
+	if err != nil {
+		return err
+	}
+	if superseded >= q.SupersedesPerDID {
+		return &quotaError{quota: fmt.Sprintf("supersedes per DID in %d hours", q.SupersedePeriodHours), limit: q.SupersedesPerDID, retryAfter: retryAfter}
+	}
+	return nil
+}
+
+// quotaProblem is the problem with a request over quota, or with a failure checking it
+func quotaProblem(err error) *problem {
+	if qe, ok := err.(*quotaError); ok {
+		p := newProblem(http.StatusTooManyRequests, codeQuotaExceeded, qe.Error())
+		p.RetryAfter = qe.retryAfter
+		return p
+	}
+	return databaseProblem("quota")
+}
+
+// operations metered in agent_usage
+const (
+	usageRegister  = "register"
+	usageSupersede = "supersede"
+	usageRevoke    = "revoke"
+)
+
+// recordUsage counts an operation by an agent against today. Registrations are counted by
+// reserveRegistrations instead.
+func recordUsage(agentkey string, operation string) {
+	_, err := DB.Exec(`INSERT INTO agent_usage (agent_id, day, operation, count) VALUES ($1, current_date, $2, 1)
+		ON CONFLICT (agent_id, day, operation) DO UPDATE SET count = agent_usage.count + 1`, agentkey, operation)
+	if err != nil {
+		log.Printf("agent %s usage: %v", agentkey, err)
+	}
+}
+
+// usage is an agent's count of an operation on a day
+type usage struct {
+	AgentID   string `json:"agent"`
+	Day       string `json:"day"`
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+}
+
+// usageReport returns usage from the from day up to but not including the to day,
+// for one agent or for every agent when agentkey is empty
+func usageReport(agentkey string, from time.Time, to time.Time) ([]usage, error) {
+	rows, err := DB.Query(`SELECT agent_id, to_char(day, 'YYYY-MM-DD'), operation, count FROM agent_usage
+		WHERE ($1 = '' OR agent_id = $1) AND day >= $2 AND day < $3 ORDER BY agent_id, day, operation`,
+		agentkey, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []usage{}
+	for rows.Next() {
+		var u usage
+		if err = rows.Scan(&u.AgentID, &u.Day, &u.Operation, &u.Count); err != nil {
+			return nil, err
+		}
+		report = append(report, u)
+	}
+	return report, rows.Err()
+}
+
+// usagePeriod parses a report period from YYYY-MM-DD days, defaulting to the current month
+func usagePeriod(from string, to string) (time.Time, time.Time, error) {
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	var err error
+	if from != "" {
+		if start, err = time.Parse("2006-01-02", from); err != nil {
+			return start, end, fmt.Errorf("from must be a YYYY-MM-DD date")
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse("2006-01-02", to); err != nil {
+			return start, end, fmt.Errorf("to must be a YYYY-MM-DD date")
+		}
+	}
+	return start, end, nil
+}
+
+// writeUsageCSV writes a usage report with a header row
+func writeUsageCSV(out io.Writer, report []usage) error {
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"agent", "day", "operation", "count"})
+	for _, u := range report {
+		cw.Write([]string{u.AgentID, u.Day, u.Operation, fmt.Sprint(u.Count)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+)
+
+func TestUsagePeriod(t *testing.T) {
+	from, to, err := usagePeriod("2026-09-01", "2026-10-01")
+	if err != nil || from.Format("2006-01-02") != "2026-09-01" || to.Format("2006-01-02") != "2026-10-01" {
+		t.Errorf("period not parsed: got %v %v %v", from, to, err)
+	}
+
+	// the current month by default
+	from, to, err = usagePeriod("", "")
+	if err != nil || from.Day() != 1 || to != from.AddDate(0, 1, 0) || time.Now().Before(from) || !time.Now().Before(to) {
+		t.Errorf("default period not the current month: got %v %v %v", from, to, err)
+	}
+
+	if _, _, err = usagePeriod("September", ""); err == nil {
+		t.Errorf("period with a bad date parsed")
+	}
+}
+
+func TestQuotaProblem(t *testing.T) {
+	// handlers write the problem quotaProblem makes of a quota check's error
+	rr := httptest.NewRecorder()
+	quotaProblem(&quotaError{quota: "registrations per day", limit: 10, retryAfter: 3600}).write(rr)
+
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "3600" {
+		t.Errorf("wrong Retry-After: got %q want %q", retry, "3600")
+	}
+	expected := problemJSON(http.StatusTooManyRequests, codeQuotaExceeded, "quota of 10 registrations per day exceeded")
+	if rr.Body.String() != expected {
+		t.Errorf("unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// failing to check a quota isn't the agent's fault
+	rr = httptest.NewRecorder()
+	quotaProblem(errors.New("connection refused")).write(rr)
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+}
+
+func TestAgentQuotas(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	agentkey := "a-metered-agent"
+	err = createAgent(agentkey, "", agentScopes, agentQuotas{RegistrationsPerDay: 2, ActiveDIDs: 3, SupersedesPerDID: 1, SupersedePeriodHours: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// registrations per day
+	for i := 0; i < 2; i++ {
+		if err = reserveRegistrations(DB, agentkey, 1); err != nil {
+			t.Errorf("registration %d refused: %v", i, err)
+		}
+	}
+	qe, ok := reserveRegistrations(DB, agentkey, 1).(*quotaError)
+	if !ok || qe.retryAfter < 1 || qe.retryAfter > 24*60*60 {
+		t.Errorf("registrations per day not limited: got %+v", qe)
+	}
+
+	// active DIDs, which waiting won't help
+	DB.Exec("DELETE FROM agent_usage")
+	for _, id := range []string{"did:jlinc:first", "did:jlinc:second", "did:jlinc:third"} {
+		insertAgentDID(t, id, agentkey)
+	}
+	qe, ok = reserveRegistrations(DB, agentkey, 1).(*quotaError)
+	if !ok || qe.quota != "active DIDs" || qe.retryAfter != 0 {
+		t.Errorf("active DIDs not limited: got %+v", qe)
+	}
+
+	// supersedes per DID
+	if err = checkSupersedeQuota(DB, agentkey, "did:jlinc:first"); err != nil {
+		t.Errorf("first supersede refused: %v", err)
+	}
+	_, err = DB.Exec(`INSERT INTO didstore (id, root, agent_id, supersedes, status) VALUES ('did:jlinc:fourth', 'did:jlinc:first', $1, 'did:jlinc:first', 'verified')`, agentkey)
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+	qe, ok = checkSupersedeQuota(DB, agentkey, "did:jlinc:first").(*quotaError)
+	if !ok || qe.retryAfter < 1 {
+		t.Errorf("supersedes per DID not limited: got %+v", qe)
+	}
+
+	// agents in [api_auth] have no quotas
+	if err = reserveRegistrations(DB, testAgentKey, 1); err != nil {
+		t.Errorf("config agent limited: %v", err)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+	stmt, _ = DB.Prepare("DELETE FROM agents")
+	stmt.Exec()
+}
+
+func TestUsageReport(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	Conf.Admin.Tokens = []string{testAdminToken}
+
+	_, err = DB.Exec(`INSERT INTO agent_usage (agent_id, day, operation, count) VALUES
+		('agent-a', '2026-09-30', 'register', 5), ('agent-a', '2026-10-01', 'register', 7),
+		('agent-a', '2026-10-01', 'revoke', 1), ('agent-b', '2026-10-02', 'register', 2)`)
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+
+	from, to, _ := usagePeriod("2026-10-01", "2026-11-01")
+	report, err := usageReport("agent-a", from, to)
+	if err != nil || len(report) != 2 || report[0] != (usage{"agent-a", "2026-10-01", "register", 7}) {
+		t.Errorf("usage report not as expected: got %+v with error %v", report, err)
+	}
+
+	var csv bytes.Buffer
+	report, _ = usageReport("", from, to)
+	writeUsageCSV(&csv, report)
+	expected := "agent,day,operation,count\nagent-a,2026-10-01,register,7\nagent-a,2026-10-01,revoke,1\nagent-b,2026-10-02,register,2\n"
+	if csv.String() != expected {
+		t.Errorf("usage CSV not as expected: got %q want %q", csv.String(), expected)
+	}
+
+	rr := adminRequest(t, "GET", "/usage?from=2026-10-01&to=2026-11-01&format=csv", "")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "text/csv" || rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected CSV: got %v %q", ctype, rr.Body.String())
+	}
+	rr = adminRequest(t, "GET", "/usage?agent=agent-b&from=2026-10-01&to=2026-11-01", "")
+	expected = `{"from":"2026-10-01", "to":"2026-11-01", "usage":[{"agent":"agent-b","day":"2026-10-02","operation":"register","count":2}]}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+	if rr = adminRequest(t, "GET", "/usage?from=October", ""); !strings.Contains(rr.Body.String(), "YYYY-MM-DD") {
+		t.Errorf("bad period accepted: got %v", rr.Body.String())
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM agent_usage")
+	stmt.Exec()
+}
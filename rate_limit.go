@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+// what requests are counted by, falling back to the client IP when a request doesn't have one
+const (
+	rateKeyIP    = "ip"
+	rateKeyAgent = "agent"
+	rateKeyDID   = "did"
+)
+
+func validRateLimitKey(key string) bool {
+	switch key {
+	case "", rateKeyIP, rateKeyAgent, rateKeyDID:
+		return true
+	}
+	return false
+}
+
+// group returns the limit for a route group: resolve, write or agent
+func (l rateLimits) group(name string) rateLimit {
+	switch name {
+	case "resolve":
+		return l.Resolve
+	case "write":
+		return l.Write
+	case "agent":
+		return l.Agent
+	}
+	return rateLimit{}
+}
+
+// rateLimited limits the requests to a route group with a token bucket per client IP, agent or
+// DID, as set in [rate_limits]. Refused requests get a 429 with a Retry-After header.
+func rateLimited(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := Conf.RateLimits.group(group)
+			if l.Rate <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			for _, key := range rateLimitKeys(w, r, l.Key) {
+				key = group + ":" + key
+				var allowed bool
+				var remaining float64
+				var err error
+				if Conf.RateLimits.Shared {
+					allowed, remaining, err = takeSharedToken(key, l)
+				} else {
+					allowed, remaining = takeToken(key, l, time.Now())
+				}
+				if err != nil {
+					// a broken limiter shouldn't take the server down with it
+					log.Printf("rate limit %s: %v", key, err)
+					allowed = true
+				}
+				if !allowed {
+					w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil((1-remaining)/l.Rate))))
+					writeProblem(w, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKeys returns the buckets a request is counted in: its verified agent's, or else its
+// client IP's. Anyone can name a DID, so a request counted by DID is counted by its client IP
+// as well, and naming a new DID can't get it a fresh bucket.
+func rateLimitKeys(w http.ResponseWriter, r *http.Request, by string) []string {
+	ip := "ip:" + clientIP(r)
+	switch by {
+	case rateKeyAgent:
+		if agentkey := requestAgentKey(w, r); agentkey != "" {
+			return []string{"agent:" + agentkey}
+		}
+	case rateKeyDID:
+		if id := requestDIDID(w, r); id != "" {
+			return []string{ip, "did:" + id}
+		}
+	}
+	return []string{ip}
+}
+
+// clientIP is the request's remote address, which middleware.RealIP sets from X-Forwarded-For or X-Real-IP
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requestAgentKey finds the agent a request is verifiably from: its client certificate, the
+// iss of a bearer JWT signed by that agent, or the agentkey in its body when the JWT in the body
+// is signed by that agent. A request naming an agent it can't prove it's from has none, so that
+// it can't take from another agent's bucket or get a fresh one by naming another agent.
+func requestAgentKey(w http.ResponseWriter, r *http.Request) string {
+	if agentkey := certAgentFrom(r.Context()); agentkey != "" {
+		return agentkey
+	}
+
+	if tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); tokenString != "" {
+		var claims jwt.StandardClaims
+		if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, &claims); err == nil && agentSigned(tokenString, claims.Issuer) {
+			return claims.Issuer
+		}
+		return ""
+	}
+
+	var body struct {
+		AgentKey      string   `json:"agentkey"`
+		Registration  string   `json:"registration"`
+		Registrations []string `json:"registrations"`
+		Supersede     string   `json:"supersede"`
+		RevokeRequest string   `json:"revokeRequest"`
+	}
+	peekBody(w, r, &body)
+	for _, tokenString := range append([]string{body.Registration, body.Supersede, body.RevokeRequest}, body.Registrations...) {
+		if tokenString != "" {
+			if agentSigned(tokenString, body.AgentKey) {
+				return body.AgentKey
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// requestDIDID finds the DID a request is about, in its path or body
+func requestDIDID(w http.ResponseWriter, r *http.Request) string {
+	if id := chi.URLParam(r, "DID"); id != "" {
+		return id
+	}
+	var body struct {
+		ID  string `json:"id"`
+		DID struct {
+			ID string `json:"id"`
+		} `json:"did"`
+	}
+	peekBody(w, r, &body)
+	if body.ID != "" {
+		return body.ID
+	}
+	return body.DID.ID
+}
+
+// maxPeekBody is as much of a request body as peekBody reads, the most any rate limited route accepts
+const maxPeekBody = maxV2BatchBody
+
+// peekBody decodes a JSON request body without using it up, as getRawDID does. A body too large
+// to peek at is left for the handler to refuse.
+func peekBody(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if r.Body == nil {
+		return
+	}
+	bodyBytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPeekBody))
+	if err != nil {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(bodyBytes), errReader{err}))
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+	json.Unmarshal(bodyBytes, v)
+}
+
+// errReader fails every read with its error
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// bucket is a token bucket, refilled at the limit's rate up to its burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+	refill time.Duration // how long an empty bucket takes to fill
+}
+
+var (
+	buckets       = map[string]*bucket{}
+	bucketsMu     sync.Mutex
+	bucketsPruned time.Time
+	sharedPruned  time.Time
+)
+
+// burst is the size of a limit's bucket, at least one request
+func (l rateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// takeToken takes a token from the in-memory bucket for key if it has one, returning whether
+// it did and the tokens left
+func takeToken(key string, l rateLimit, now time.Time) (bool, float64) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+
+	// forget buckets that have refilled, now and then
+	if now.Sub(bucketsPruned) > time.Minute {
+		for k, b := range buckets {
+			if now.Sub(b.last) > b.refill {
+				delete(buckets, k)
+			}
+		}
+		bucketsPruned = now
+	}
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst(), last: now, refill: time.Duration(l.burst() / l.Rate * float64(time.Second))}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst(), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
+
+// takeSharedToken takes a token from the bucket for key in the rate_limits table, so that every
+// server shares it. A refused request leaves the bucket at most one token in debt, rather than
+// taking a token it doesn't have.
+func takeSharedToken(key string, l rateLimit) (bool, float64, error) {
+	// forget buckets that have long since refilled, now and then
+	bucketsMu.Lock()
+	prune := time.Since(sharedPruned) > time.Hour
+	if prune {
+		sharedPruned = time.Now()
+	}
+	bucketsMu.Unlock()
+	if prune {
+		if _, err := DB.Exec("DELETE FROM rate_limits WHERE updated < NOW() - interval '1 day'"); err != nil {
+			log.Printf("rate limits: %v", err)
+		}
+	}
+
+	var tokens float64
+	err := DB.QueryRow(`INSERT INTO rate_limits (key, tokens, updated) VALUES ($1, $2 - 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+		tokens = GREATEST(LEAST($2, rate_limits.tokens + EXTRACT(EPOCH FROM NOW() - rate_limits.updated) * $3) - 1, -1),
+		updated = NOW()
+		RETURNING tokens`, key, l.burst(), l.Rate).Scan(&tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	if tokens < 0 {
+		return false, tokens + 1, nil
+	}
+	return true, tokens, nil
+}
@@ -1,11 +1,41 @@
 package main
 
 import (
+	"database/sql"
+
 	_ "github.com/lib/pq"
 )
 
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so that records can be written inside a transaction
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func recordDID(d *Registration) error {
-	stmt, err := DB.Prepare(`INSERT INTO didstore(
+	return recordDIDWith(DB, d)
+}
+
+// recordDIDWith inserts a registration using db, which may be a transaction
+func recordDIDWith(db dbtx, d *Registration) error {
+	cypher, nonce, challenge := d.Secret.Cyphertext, d.Secret.Nonce, d.Challenge
+
+	// seal the sensitive columns when envelope encryption is on
+	var env *envelope
+	var err error
+	if Conf.Keys.Envelope {
+		if env, err = newEnvelope(); err != nil {
+			return err
+		}
+	}
+	if err = env.sealValues(&cypher, &nonce, &challenge); err != nil {
+		return err
+	}
+	envelopeKey, envelopeKEK, envelopeMaster := env.stored()
+
+	stmt, err := db.Prepare(`INSERT INTO didstore(
     id,
     root,
     did,
@@ -13,12 +43,16 @@ func recordDID(d *Registration) error {
     encrypting_pubkey,
     secret_cypher,
     secret_nonce,
+    secret_format,
     secret_master,
     challenge,
     status,
 		agent_id,
 		supersedes,
-    superseded_by) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`)
+    superseded_by,
+    envelope_key,
+    envelope_kek,
+    envelope_master) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`)
 	if err != nil {
 		return err
 	}
@@ -31,14 +65,18 @@ func recordDID(d *Registration) error {
 		d.Raw,
 		d.SigningKey,
 		d.EncryptingKey,
-		d.Secret.Cyphertext,
-		d.Secret.Nonce,
+		cypher,
+		nonce,
+		d.Secret.Format,
 		d.Secret.MasterKey,
-		d.Challenge,
+		challenge,
 		d.Status,
 		d.AgentID,
 		d.Supersedes,
-		d.SupersededBy)
+		d.SupersededBy,
+		envelopeKey,
+		envelopeKEK,
+		envelopeMaster)
 	if err != nil {
 		return err
 	}
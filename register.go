@@ -14,67 +14,88 @@ import (
 func registerDID(w http.ResponseWriter, r *http.Request) {
 	rawDID, err := getRawDID(r)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, err.Error())
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 		return
 	}
 
 	var registration Registration
 	if err = json.NewDecoder(r.Body).Decode(&registration); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
-	// master key that the secret is encrypted with
-	registration.Secret.MasterKey = Conf.Keys.Public
+	// a dry run reports every error without recording anything, or needing proof of work
+	if dryRun(r) {
+		writeValidation(w, &registration, false, true)
+		return
+	}
+
+	registration.Raw = rawDID
+	if p := newRegistration(&registration); p != nil {
+		p.write(w)
+		return
+	}
+
+	//return the challenge
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":%q, "challenge":%q}`, registration.DID.ID, registration.Challenge)
+}
+
+// newRegistration checks a registration and records it for confirmation, setting the challenge
+// to sign. It returns the problem when the registration isn't recorded.
+func newRegistration(registration *Registration) *problem {
+	// a solved puzzle must come first when proof of work is on
+	if p := powProblem(registration.PoW, registration.DID.ID); p != nil {
+		return p
+	}
+
+	// closed deployments need an invite, or take registrations only from agents. The invite's
+	// use is given back if the registration isn't recorded.
+	inviteID, p := admitRegistration(registration.Invite)
+	if p != nil {
+		return p
+	}
+	recorded := false
+	defer func() {
+		if inviteID != 0 && !recorded {
+			releaseInvite(inviteID)
+		}
+	}()
 
 	// validate the registration
 	var errResult *multierror.Error
-	if err = validateDIDparams(&registration); err != nil {
+	if err := validateDIDparams(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
-	if err = getDIDkeys(&registration); err != nil {
+	if err := getDIDkeys(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
-	if err = validateDIDsignature(&registration); err != nil {
+	if err := validateDIDsignature(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
-	if err = validateDIDsecret(&registration); err != nil {
+	if err := validateDIDsecret(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
 
 	if errResult.ErrorOrNil() != nil {
-		errResult.ErrorFormat = formatErrors
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, errResult.Error())
-		return
+		return validationProblem(http.StatusBadRequest, errResult)
 	}
 
 	// add in some local values
-	registration.Raw = rawDID
 	registration.Root = registration.DID.ID
 	registration.Status = "init"
 
 	// instantiate the challenge
 	challenge := make([]byte, 32)
-	_, err = rand.Read(challenge)
-	if err != nil {
-		http.Error(w, "Error creating challenge", 500)
-		return
+	if _, err := rand.Read(challenge); err != nil {
+		return newProblem(http.StatusInternalServerError, codeInternalError, "Error creating challenge")
 	}
 	registration.Challenge = hex.EncodeToString(challenge)
 
 	// record the DID
-	if err = recordDID(&registration); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, err.Error())
-		return
+	if err := recordDID(registration); err != nil {
+		return newProblem(http.StatusBadRequest, codeRecordFailed, err.Error())
 	}
-
-	//return the challenge
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"id":%q, "challenge":%q}`, registration.DID.ID, registration.Challenge)
+	recorded = true
+	return nil
 }
@@ -31,12 +31,11 @@ func TestNoRegisterInput(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
 	}
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "text/plain; charset=utf-8")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
-	expected := `Not valid JSON
-`
+	expected := problemJSON(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -62,15 +61,19 @@ func TestBadRegisterInput(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 
-	expected := `{"success":false,"error":"request contained 4 errors: @context missing or incorrect, id must be did:jlinc:{base64 encoded string}, signing public key missing or size incorrect, encrypting public key missing or size incorrect"}`
+	expected := validationProblemJSON(http.StatusBadRequest,
+		invalid("context_invalid", "@context missing or incorrect"),
+		invalid("id_invalid", "id must be did:jlinc:{base64 encoded string}"),
+		invalid("signing_key_invalid", "signing public key missing or size incorrect"),
+		invalid("encrypting_key_invalid", "encrypting public key missing or size incorrect"))
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -9,52 +9,59 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// resolution is a verified DID's document, or the latest DID in the chain that superseded it
+type resolution struct {
+	DID          string
+	SupersededBy string
+	URL          string
+}
+
 func resolve(w http.ResponseWriter, r *http.Request) {
-	DIDstr := chi.URLParam(r, "DID")
-	if _, ok := getValidID(DIDstr); !ok {
-		w.Header().Set("Content-Type", "application/ld+json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"cannot parse request"}`))
+	res, p := resolveDID(chi.URLParam(r, "DID"))
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	if res.SupersededBy != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", res.URL)
+		w.WriteHeader(http.StatusSeeOther)
+		fmt.Fprintf(w, `{"supersededBy":%q}`, res.SupersededBy)
 		return
 	}
+	w.Header().Set("Content-Type", "application/ld+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(res.DID))
+}
+
+// resolveDID looks up a DID by id, returning the problem when it can't be resolved
+func resolveDID(DIDstr string) (*resolution, *problem) {
+	if _, ok := getValidID(DIDstr); !ok {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidRequest, "cannot parse request")
+	}
 
 	stmt, err := DB.Prepare("SELECT did, status, root FROM didstore WHERE id = $1")
 	defer stmt.Close()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-st"`)
-		return
+		return nil, databaseProblem("st")
 	}
 	var did, status, root string
 	err = stmt.QueryRow(DIDstr).Scan(&did, &status, &root)
 	switch {
 	case err == sql.ErrNoRows: //didn't find it
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"status":"not found"}`))
+		return nil, newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	case err != nil: // query error!
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-q}"`)
+		return nil, databaseProblem("q")
 	case status == "revoked":
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusGone)
-		w.Write([]byte(`{"status":"revoked"}`))
+		return nil, newProblem(http.StatusGone, codeDIDRevoked, "DID revoked")
 	case status == "superseded":
 		superID, superURL := getSupersededBy(root)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Location", superURL)
-		w.WriteHeader(http.StatusSeeOther)
-		fmt.Fprintf(w, `{"supersededBy":%q}`, superID)
+		return &resolution{SupersededBy: superID, URL: superURL}, nil
 	case status == "verified": //success
-		w.Header().Set("Content-Type", "application/ld+json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(did))
+		return &resolution{DID: did}, nil
 	default:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"status":"not found"}`))
+		return nil, newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	}
 }
 
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -10,44 +9,40 @@ import (
 )
 
 func resolveRoot(w http.ResponseWriter, r *http.Request) {
-	DIDstr := chi.URLParam(r, "DID")
-	if _, ok := getValidID(DIDstr); !ok {
-		w.Header().Set("Content-Type", "application/ld+json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error":"cannot parse request"}`))
+	did, p := resolveRootDID(chi.URLParam(r, "DID"))
+	if p != nil {
+		p.write(w)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/ld+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(did))
+}
+
+// resolveRootDID looks up the latest DID in the chain with the given root
+func resolveRootDID(DIDstr string) (string, *problem) {
+	if _, ok := getValidID(DIDstr); !ok {
+		return "", newProblem(http.StatusBadRequest, codeInvalidRequest, "cannot parse request")
+	}
+
 	stmt, err := DB.Prepare("SELECT did, status, root FROM didstore WHERE root = $1 ORDER BY created DESC LIMIT 1")
 	defer stmt.Close()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-st"`)
-		return
+		return "", databaseProblem("st")
 	}
 	var did, status, root string
 	err = stmt.QueryRow(DIDstr).Scan(&did, &status, &root)
 	switch {
 	case err == sql.ErrNoRows: //didn't find it
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"status":"not found"}`))
+		return "", newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	case err != nil: // query error!
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-q}"`)
+		return "", databaseProblem("q")
 	case status == "revoked":
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusGone)
-		w.Write([]byte(`{"status":"revoked"}`))
+		return "", newProblem(http.StatusGone, codeDIDRevoked, "DID revoked")
 	case status == "verified": //success
-		w.Header().Set("Content-Type", "application/ld+json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(did))
+		return did, nil
 	default:
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"status":"not found"}`))
+		return "", newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	}
 }
@@ -130,15 +130,15 @@ func TestResolveRootUnverified(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusNotFound {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 	}
 
-	expected := `{"status":"not found"}`
+	expected := problemJSON(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	got := rr.Body.String()
 
 	if got != expected {
@@ -178,15 +178,15 @@ func TestResolveRootUnknown(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusNotFound {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 	}
 
-	expected := `{"status":"not found"}`
+	expected := problemJSON(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	got := rr.Body.String()
 
 	if got != expected {
@@ -268,15 +268,15 @@ func TestResolveRootSuperseded(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusGone {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusGone)
 	}
 
-	expected := `{"status":"revoked"}`
+	expected := problemJSON(http.StatusGone, codeDIDRevoked, "DID revoked")
 	got := rr.Body.String()
 
 	if got != expected {
@@ -130,15 +130,15 @@ func TestResolveUnverified(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusNotFound {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 	}
 
-	expected := `{"status":"not found"}`
+	expected := problemJSON(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	got := rr.Body.String()
 
 	if got != expected {
@@ -178,15 +178,15 @@ func TestResolveUnknown(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusNotFound {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 	}
 
-	expected := `{"status":"not found"}`
+	expected := problemJSON(http.StatusNotFound, codeDIDNotFound, "DID not found")
 	got := rr.Body.String()
 
 	if got != expected {
@@ -339,15 +339,15 @@ func TestResolveRevoked(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusGone {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusGone)
 	}
 
-	expected := `{"status":"revoked"}`
+	expected := problemJSON(http.StatusGone, codeDIDRevoked, "DID revoked")
 	got := rr.Body.String()
 
 	if got != expected {
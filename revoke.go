@@ -15,16 +15,31 @@ func revoke(w http.ResponseWriter, r *http.Request) {
 	}
 	var revokeRequest RevokeRequest
 	if err := json.NewDecoder(r.Body).Decode(&revokeRequest); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
+	didID, p := revokeDID(revokeRequest.TokenString)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	// return success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "revoked":%q}`, didID)
+}
+
+// revokeDID checks a revoke request signed with the registration secret and revokes its DID,
+// returning the DID's id
+func revokeDID(tokenString string) (string, *problem) {
 	type ConfirmClaims struct {
 		ID string `json:"id"`
 		jwt.StandardClaims
 	}
 	//parse the JWT
-	token, err := jwt.ParseWithClaims(revokeRequest.TokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ConfirmClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
@@ -36,42 +51,26 @@ func revoke(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"%s"}`, err)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, err.Error())
 	}
 
 	// check that the JWT is valid
 	if _, ok := token.Claims.(*ConfirmClaims); !ok || !token.Valid {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, `{"success":"false", "error":"JWT invalid"}`)
-		return
+		return "", newProblem(http.StatusUnauthorized, codeJWTInvalid, "JWT invalid")
 	}
 
 	// everything checks, set DB status to revoked
 	didID := token.Claims.(*ConfirmClaims).ID
 	stmt, err := DB.Prepare(`UPDATE didstore SET status = 'revoked', modified = NOW() WHERE id = $1 AND status != 'superseded'`)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-p"`)
-		return
+		return "", databaseProblem("p")
 	}
 
 	defer stmt.Close()
 
 	_, err = stmt.Exec(didID)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-e"`)
-		return
+		return "", databaseProblem("e")
 	}
-
-	// return success
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"success":"true", "revoked":%q}`, didID)
+	return didID, nil
 }
@@ -88,15 +88,15 @@ func TestBadRevoke(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusUnauthorized {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
 	}
 
-	expected := fmt.Sprintf(`{"success":"false", "error":"signature is invalid"}`)
+	expected := problemJSON(http.StatusUnauthorized, codeJWTInvalid, "signature is invalid")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: want %s got %s", expected, rr.Body.String())
 	}
@@ -204,7 +204,7 @@ func TestGoodRevoke(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	expected := fmt.Sprintf(`{"success":"true", "revoked":%q}`, didID)
+	expected := fmt.Sprintf(`{"success":true, "revoked":%q}`, didID)
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: want %s got %s", expected, rr.Body.String())
 	}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Replace the registration secret on the root of a DID chain, authorized by the signing key of a verified DID in the chain
+func rotateSecret(w http.ResponseWriter, r *http.Request) {
+	type RotateRequest struct {
+		ID        string `json:"id"`
+		Created   string `json:"created"`
+		Secret    secret `json:"secret"`
+		Signature string `json:"signature"`
+	}
+	var rotateRequest RotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&rotateRequest); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+
+	root, p := rotateRootSecret(rotateRequest.ID, rotateRequest.Created, rotateRequest.Secret, rotateRequest.Signature)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	// return success
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "rotated":%q}`, root)
+}
+
+// rotateRootSecret checks a secret rotation signed at created by the DID id and replaces the
+// secret on the root of its chain, returning the root's id
+func rotateRootSecret(id string, created string, newSecret secret, signature string) (string, *problem) {
+	// validate the request
+	var errResult *multierror.Error
+	if _, ok := getValidID(id); !ok {
+		errResult = multierror.Append(errResult, invalid("id_invalid", "id must be did:jlinc:{base64 encoded string}"))
+	}
+	if !Conf.IsTest {
+		if err := validateTimestamp(created); err != nil {
+			errResult = multierror.Append(errResult, err)
+		}
+	}
+	if errResult.ErrorOrNil() != nil {
+		return "", validationProblem(http.StatusBadRequest, errResult)
+	}
+
+	// get the DID making the request and the time its root secret was last rotated
+	var root, status, signingPubkey, encryptingPubkey, envelopeKey, envelopeKEK, envelopeMaster string
+	var rotated pq.NullTime
+	err := DB.QueryRow("SELECT s.root, s.status, s.signing_pubkey, s.encrypting_pubkey, r.secret_rotated, r.envelope_key, r.envelope_kek, r.envelope_master FROM didstore AS s JOIN didstore AS r ON s.root = r.id WHERE s.id = $1", id).Scan(&root, &status, &signingPubkey, &encryptingPubkey, &rotated, &envelopeKey, &envelopeKEK, &envelopeMaster)
+	switch {
+	case err == sql.ErrNoRows: //didn't find it
+		return "", newProblem(http.StatusNotFound, codeDIDNotFound, "DID not found")
+	case err != nil: // query error!
+		return "", databaseProblem("q")
+	case status != "verified": //must be an active DID
+		return "", newProblem(http.StatusConflict, codeDIDNotActive, "DID not active")
+	}
+
+	// check the signature over the id, timestamp and new secret
+	signed := id + "." + created + "." + newSecret.Cyphertext + "." + newSecret.Nonce
+	signedHashed := getHash(signed)
+	sig := b64Decode(signature)
+	if sigVerified := ed25519.Verify(b64Decode(signingPubkey), signedHashed, sig); !sigVerified {
+		return "", newProblem(http.StatusUnauthorized, codeSignatureInvalid, "signature does not verify")
+	}
+
+	// a replayed older rotation must not restore a previous secret
+	createdAt, _ := time.Parse(time.RFC3339, created)
+	if rotated.Valid && !createdAt.After(rotated.Time) {
+		return "", newProblem(http.StatusConflict, codeRotationStale, "rotation is older than the current secret")
+	}
+
+	// the new secret must decrypt with the requesting DID's encrypting key
+	_, master, ok := openRegSecret(newSecret.Cyphertext, newSecret.Nonce, newSecret.Format, encryptingPubkey, "")
+	if !ok || !validSecretFormat(newSecret.Format) {
+		return "", newProblem(http.StatusBadRequest, codeSecretInvalid, "secret did not decrypt correctly")
+	}
+
+	// seal the new secret with the root's envelope, or a new one when envelope encryption is on
+	cypher, nonce := newSecret.Cyphertext, newSecret.Nonce
+	env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+	if err == nil && env == nil && Conf.Keys.Envelope {
+		env, err = newEnvelope()
+	}
+	if err == nil {
+		err = env.sealValues(&cypher, &nonce)
+	}
+	if err != nil {
+		return "", newProblem(http.StatusInternalServerError, codeInternalError, "envelope error")
+	}
+	envelopeKey, envelopeKEK, envelopeMaster = env.stored()
+
+	// everything checks, replace the root's secret
+	stmt, err := DB.Prepare(`UPDATE didstore SET secret_cypher = $1, secret_nonce = $2, secret_format = $3, secret_master = $4, secret_pubkey = $5, secret_rotated = $6, envelope_key = $7, envelope_kek = $8, envelope_master = $9, modified = NOW() WHERE id = $10 AND (secret_rotated IS NULL OR secret_rotated < $6)`)
+	if err != nil {
+		return "", databaseProblem("p")
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.Exec(cypher, nonce, newSecret.Format, master, encryptingPubkey, createdAt.UTC(), envelopeKey, envelopeKEK, envelopeMaster, root)
+	if err != nil {
+		return "", databaseProblem("e")
+	}
+	return root, nil
+}
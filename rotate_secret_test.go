@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	_ "github.com/lib/pq"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestNoRotateSecretInput(t *testing.T) {
+	input := strings.NewReader("")
+
+	req, err := http.NewRequest("POST", "/rotateSecret", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(rotateSecret)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+
+	expected := problemJSON(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+// rotationRequest builds a signed rotation request for a new secret encrypted to the master key
+func rotationRequest(id string, created string, signingKey ed25519.PrivateKey, encryptingKey *[32]byte, newSecret []byte) string {
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	var masterKey [32]byte
+	copy(masterKey[:], b64Decode(Conf.Keys.Public))
+	cyphertext := b64Encode(box.Seal(nil, newSecret, &nonce, &masterKey, encryptingKey))
+
+	signed := id + "." + created + "." + cyphertext + "." + b64Encode(nonce[:])
+	sig := b64Encode(ed25519.Sign(signingKey, getHash(signed)))
+
+	return fmt.Sprintf(`{"id":%q,"created":%q,"secret":{"cyphertext":%q,"nonce":%q},"signature":%q}`, id, created, cyphertext, b64Encode(nonce[:]), sig)
+}
+
+func TestRotateSecret(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	// keys for the superseding DID, which does the rotation
+	signingKey := ed25519.NewKeyFromSeed(getHash("didserver rotate test key"))
+	encryptingPub, encryptingKey, _ := box.GenerateKey(rand.Reader)
+	rootID := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	didID := "did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"
+
+	// enter test data in the DB
+	stmt, err := DB.Prepare(`INSERT INTO didstore (id,
+                                              root,
+                                              signing_pubkey,
+                                              encrypting_pubkey,
+                                              secret_cypher,
+                                              secret_nonce,
+                                              status) VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	_, err = stmt.Exec(rootID,
+		rootID,
+		"xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
+		"Vk3kVIvGFV4Ew5m3xJ43N8T5WNFX7qjMOSrJ3Gu4m3E",
+		"AAAAAAAAAAAAAAAAAAAAAJNdfP98pEJQ0M1RpLehjw2798z5FfbAeJErbmYxrYxJwiNqX1laQbmxp5gC2KOPgKw2KY7qHLfvdxBO_yV8b4gviwO3CODi-FQ2E7Q55fCf",
+		"Q2CMu1V6RK9YyvV-ExJD1UVIQt20qVGO",
+		"superseded")
+	if err != nil {
+		t.Errorf("Insert into db error-r: %q", err)
+	}
+	_, err = stmt.Exec(didID,
+		rootID,
+		b64Encode(signingKey.Public().(ed25519.PublicKey)),
+		b64Encode(encryptingPub[:]),
+		"",
+		"",
+		"verified")
+	if err != nil {
+		t.Errorf("Insert into db error-s: %q", err)
+	}
+
+	newSecret := []byte("a new registration secret")
+	created := time.Now().UTC().Format(time.RFC3339)
+
+	// a request signed by some other key is refused
+	otherKey := ed25519.NewKeyFromSeed(getHash("some other key"))
+	req, _ := http.NewRequest("POST", "/rotateSecret", strings.NewReader(rotationRequest(didID, created, otherKey, encryptingKey, newSecret)))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rotateSecret).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	// a correctly signed request replaces the root's secret
+	req, _ = http.NewRequest("POST", "/rotateSecret", strings.NewReader(rotationRequest(didID, created, signingKey, encryptingKey, newSecret)))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rotateSecret).ServeHTTP(rr, req)
+
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	}
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	expected := fmt.Sprintf(`{"success":true, "rotated":%q}`, rootID)
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	secret, err := getRootJwtSecret(didID)
+	if err != nil || string(secret) != string(newSecret) {
+		t.Errorf("root secret was not rotated: got %q with error %v", secret, err)
+	}
+
+	// replaying the same rotation is refused
+	req, _ = http.NewRequest("POST", "/rotateSecret", strings.NewReader(rotationRequest(didID, created, signingKey, encryptingKey, []byte("replayed"))))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rotateSecret).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ = DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+// Opt a DID chain out of (or back into) agent supersede and revoke, authorized by the registration secret
+func selfCustody(w http.ResponseWriter, r *http.Request) {
+	type SelfCustodyRequest struct {
+		TokenString string `json:"selfCustodyRequest"`
+	}
+	var selfCustodyRequest SelfCustodyRequest
+	if err := json.NewDecoder(r.Body).Decode(&selfCustodyRequest); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+
+	id, custody, p := setSelfCustody(selfCustodyRequest.TokenString)
+	if p != nil {
+		p.write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "id":%q, "selfCustody":%t}`, id, custody)
+}
+
+// a self custody request is good for this long after its iat
+const selfCustodyLifetime = 10 * time.Minute
+
+// setSelfCustody checks a self custody request signed with the registration secret and sets
+// the flag on its chain, returning the DID's id and the flag
+func setSelfCustody(tokenString string) (string, bool, *problem) {
+	type SelfCustodyClaims struct {
+		ID          string `json:"id"`
+		SelfCustody bool   `json:"selfCustody"`
+		jwt.StandardClaims
+	}
+	//parse the JWT
+	token, err := jwt.ParseWithClaims(tokenString, &SelfCustodyClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		hmacSecret, err := getRootJwtSecret(token.Claims.(*SelfCustodyClaims).ID)
+		if err != nil {
+			return nil, err
+		}
+		return hmacSecret, nil
+	})
+
+	if err != nil {
+		return "", false, newProblem(http.StatusUnauthorized, codeJWTInvalid, err.Error())
+	}
+
+	// check that the JWT is valid
+	claims, ok := token.Claims.(*SelfCustodyClaims)
+	if !ok || !token.Valid {
+		return "", false, newProblem(http.StatusUnauthorized, codeJWTInvalid, "JWT invalid")
+	}
+	if err = checkSelfCustodyTimes(claims.StandardClaims); err != nil {
+		return "", false, newProblem(http.StatusUnauthorized, codeJWTInvalid, fmt.Sprintf("JWT-%s", err))
+	}
+
+	// the flag is kept on the root of the chain, along with the iat of the request that set it,
+	// so that a replayed or older request can't undo a newer one
+	issued := time.Unix(claims.IssuedAt, 0).UTC()
+	result, err := DB.Exec(`UPDATE didstore SET self_custody = $1, self_custody_changed = $2 WHERE id = (SELECT root FROM didstore WHERE id = $3) AND (self_custody_changed IS NULL OR self_custody_changed < $2)`,
+		claims.SelfCustody, issued, claims.ID)
+	if err != nil {
+		return "", false, databaseProblem("e")
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return "", false, newProblem(http.StatusConflict, codeConflict, "self custody request is not newer than the last one")
+	}
+	return claims.ID, claims.SelfCustody, nil
+}
+
+// checkSelfCustodyTimes requires a self custody request to carry iat and exp, and to be recent
+func checkSelfCustodyTimes(claims jwt.StandardClaims) error {
+	if claims.IssuedAt == 0 || claims.ExpiresAt == 0 {
+		return errors.New("iat and exp are required")
+	}
+	issued, expires := time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0)
+	if !expires.After(issued) || expires.Sub(issued) > selfCustodyLifetime {
+		return fmt.Errorf("exp must be after iat and within %v of it", selfCustodyLifetime)
+	}
+	// allow a minute for clock error, as for agent JWTs
+	if time.Since(issued) > selfCustodyLifetime || time.Until(issued) > time.Minute {
+		return errors.New("iat is out of bounds")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	jwt "github.com/dgrijalva/jwt-go"
+	_ "github.com/lib/pq"
+)
+
+func TestSelfCustody(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	rootID := "did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"
+	didID := "did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"
+	cypher, nonce, sender := sealToMaster([]byte("registration secret"), Conf.Keys.Public)
+	_, err = DB.Exec(`INSERT INTO didstore (id, root, encrypting_pubkey, secret_cypher, secret_nonce, agent_id, status) VALUES ($1, $1, $2, $3, $4, $5, 'superseded')`,
+		rootID, sender, cypher, nonce, testAgentKey)
+	if err != nil {
+		t.Errorf("Insert into db error-r: %q", err)
+	}
+	_, err = DB.Exec(`INSERT INTO didstore (id, root, agent_id, status) VALUES ($1, $2, $3, 'verified')`, didID, rootID, testAgentKey)
+	if err != nil {
+		t.Errorf("Insert into db error-s: %q", err)
+	}
+
+	now := time.Now().Unix()
+	claims := jwt.MapClaims{"id": didID, "selfCustody": true, "iat": now, "exp": now + 300}
+	for _, tc := range []struct {
+		secret string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"not the secret", claims, http.StatusUnauthorized},
+		{"registration secret", jwt.MapClaims{"id": didID, "selfCustody": true}, http.StatusUnauthorized},
+		{"registration secret", claims, http.StatusOK},
+		// the same request again is a replay
+		{"registration secret", claims, http.StatusConflict},
+	} {
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, tc.claims).SignedString([]byte(tc.secret))
+		req, err := http.NewRequest("POST", "/selfCustody", strings.NewReader(fmt.Sprintf(`{"selfCustodyRequest":%q}`, signed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(selfCustody).ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.status {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, tc.status)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		expected := fmt.Sprintf(`{"success":true, "id":%q, "selfCustody":true}`, didID)
+		if rr.Body.String() != expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+		}
+	}
+
+	// the flag is set on the root, which takes the chain out of the agent's custody
+	if _, _, err := agentCustody(testAgentKey, didID); err != errSelfCustody {
+		t.Errorf("agent still has custody: got error %v", err)
+	}
+
+	// delete previous entries from the test database
+	stmt, _ := DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
+
+func TestCheckSelfCustodyTimes(t *testing.T) {
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		iat, exp int64
+		ok       bool
+	}{
+		{now, now + 300, true},
+		{0, now + 300, false},
+		{now, 0, false},
+		{now, now - 1, false},
+		{now, now + 3600, false},
+		{now - 3600, now - 3300, false},
+		{now + 3600, now + 3900, false},
+	} {
+		err := checkSelfCustodyTimes(jwt.StandardClaims{IssuedAt: tc.iat, ExpiresAt: tc.exp})
+		if (err == nil) != tc.ok {
+			t.Errorf("iat %d exp %d: got error %v", tc.iat-now, tc.exp-now, err)
+		}
+	}
+}
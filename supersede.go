@@ -15,92 +15,93 @@ import (
 func supersedeDID(w http.ResponseWriter, r *http.Request) {
 	rawDID, err := getRawDID(r)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, err.Error())
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 		return
 	}
 
 	var registration Registration
 	if err = json.NewDecoder(r.Body).Decode(&registration); err != nil {
-		http.Error(w, "Not valid JSON", 422)
+		writeJSONProblem(w)
 		return
 	}
 
+	// a dry run reports every error without recording anything, or needing proof of work
+	if dryRun(r) {
+		writeValidation(w, &registration, true, true)
+		return
+	}
+
+	registration.Raw = rawDID
+	if p := newSupersede(&registration); p != nil {
+		p.write(w)
+		return
+	}
+
+	//return the challenge
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":%q, "challenge":%q}`, registration.DID.ID, registration.Challenge)
+}
+
+// newSupersede checks a registration superseding an active DID and records it for confirmation,
+// setting the challenge to sign. It returns the problem when the registration isn't recorded.
+func newSupersede(registration *Registration) *problem {
+	// a solved puzzle must come first when proof of work is on
+	if p := powProblem(registration.PoW, registration.DID.ID); p != nil {
+		return p
+	}
+
 	// validate the registration
 	var errResult *multierror.Error
-	if err = validateDIDparams(&registration); err != nil {
+	if err := validateDIDparams(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
-	if err = getDIDkeys(&registration); err != nil {
+	if err := getDIDkeys(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
-	if err = validateDIDsignature(&registration); err != nil {
+	if err := validateDIDsignature(registration); err != nil {
 		errResult = multierror.Append(errResult, err)
 	}
 
 	if errResult.ErrorOrNil() != nil {
-		errResult.ErrorFormat = formatErrors
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, errResult.Error())
-		return
+		return validationProblem(http.StatusBadRequest, errResult)
 	}
 
-	//spew.Fdump(w, registration)
-
 	// check that the supersedes key is an existing active DID
-	stmt, err := DB.Prepare("SELECT root, status FROM didstore WHERE id = $1")
+	stmt, err := DB.Prepare("SELECT root, status, signing_pubkey FROM didstore WHERE id = $1")
 	defer stmt.Close()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-st"`)
-		return
+		return databaseProblem("st")
 	}
-	var root, status string
-	err = stmt.QueryRow(registration.Supersedes).Scan(&root, &status)
+	var root, status, supersededSigningKey string
+	err = stmt.QueryRow(registration.Supersedes).Scan(&root, &status, &supersededSigningKey)
 	switch {
 	case err == sql.ErrNoRows: //didn't find it
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"status":"item to supersede not found"}`))
-		return
+		return newProblem(http.StatusBadRequest, codeSupersedesNotFound, "item to supersede not found")
 	case err != nil: // query error!
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, `{"success":"false", "error":"database error-q"`)
-		return
+		return databaseProblem("q")
 	case status != "verified": //must be an active DID
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		w.Write([]byte(`{"status":"item to supersede not active"}`))
-		return
+		return newProblem(http.StatusConflict, codeSupersedesNotActive, "item to supersede not active")
+	}
+
+	// the request must also be signed by the superseded DID's signing key
+	if errResult = validateSupersedesSignature(registration, supersededSigningKey); errResult.ErrorOrNil() != nil {
+		return validationProblem(http.StatusUnauthorized, errResult)
 	}
 
 	// add in some local values
-	registration.Raw = rawDID
 	registration.Root = root
 	registration.Status = "init"
 
 	// instantiate the challenge
 	challenge := make([]byte, 32)
-	_, err = rand.Read(challenge)
-	if err != nil {
-		http.Error(w, "Error creating challenge", 500)
-		return
+	if _, err = rand.Read(challenge); err != nil {
+		return newProblem(http.StatusInternalServerError, codeInternalError, "Error creating challenge")
 	}
 	registration.Challenge = hex.EncodeToString(challenge)
 
 	// record the DID
-	if err = recordDID(&registration); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, `{"success":false,"error":%q}`, err.Error())
-		return
+	if err = recordDID(registration); err != nil {
+		return newProblem(http.StatusBadRequest, codeRecordFailed, err.Error())
 	}
-
-	//return the challenge
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"id":%q, "challenge":%q}`, registration.DID.ID, registration.Challenge)
+	return nil
 }
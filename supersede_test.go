@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -12,8 +13,17 @@ import (
 
 	"github.com/BurntSushi/toml"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/ed25519"
 )
 
+// the superseded DIDs in these tests use this signing key so that the
+// supersedesSignature can be produced here
+var testSupersededKey = ed25519.NewKeyFromSeed(getHash("didserver supersede test key"))
+
+func testSupersedesSignature(newID string) string {
+	return b64Encode(ed25519.Sign(testSupersededKey, getHash(newID)))
+}
+
 func TestNoSupersedeInput(t *testing.T) {
 	input := strings.NewReader("")
 
@@ -31,12 +41,11 @@ func TestNoSupersedeInput(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
 	}
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "text/plain; charset=utf-8")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
-	expected := `Not valid JSON
-`
+	expected := problemJSON(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -96,15 +105,15 @@ func TestBadSupersedeNoSupersedee(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusBadRequest {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
 	}
 
-	expected := `{"status":"item to supersede not found"}`
+	expected := problemJSON(http.StatusBadRequest, codeSupersedesNotFound, "item to supersede not found")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -168,15 +177,15 @@ func TestBadSupersedeStatus(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
-		t.Errorf("content type header does not match: got %v want %v", ctype, "application/json")
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
 	}
 
 	if status := rr.Code; status != http.StatusConflict {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
 	}
 
-	expected := `{"status":"item to supersede not active"}`
+	expected := problemJSON(http.StatusConflict, codeSupersedesNotActive, "item to supersede not active")
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -217,7 +226,7 @@ func TestGoodSupersedeInput(t *testing.T) {
 	}
 	_, err = stmt.Exec("did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
 		"did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
-		"xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
+		b64Encode(testSupersededKey.Public().(ed25519.PublicKey)),
 		"Vk3kVIvGFV4Ew5m3xJ43N8T5WNFX7qjMOSrJ3Gu4m3E",
 		"AAAAAAAAAAAAAAAAAAAAAJNdfP98pEJQ0M1RpLehjw2798z5FfbAeJErbmYxrYxJwiNqX1laQbmxp5gC2KOPgKw2KY7qHLfvdxBO_yV8b4gviwO3CODi-FQ2E7Q55fCf",
 		"Q2CMu1V6RK9YyvV-ExJD1UVIQt20qVGO",
@@ -227,7 +236,7 @@ func TestGoodSupersedeInput(t *testing.T) {
 		t.Errorf("Insert into db error: %q", err)
 	}
 
-	input := `{"did":{"@context":"https://w3id.org/did/v1","id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","created":"2018-11-25T21:51:16.366Z","publicKey":[{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#signing","type":"ed25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"},{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#encrypting","type":"curve25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"HdwpfwsfaldCWH0wtNEjQInXawQ0sHBIfKsrVufzvFc"}]},"signature":"dO0MyxqfSXbgczRjt5FbkL6dYwh7x11LqKuJ2auORECDspJte5XyhoVpJo8tIo3L2pxPhky_mvNrTM7wsW5-BA","supersedes":"did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"}`
+	input := fmt.Sprintf(`{"did":{"@context":"https://w3id.org/did/v1","id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","created":"2018-11-25T21:51:16.366Z","publicKey":[{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#signing","type":"ed25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"},{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#encrypting","type":"curve25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"HdwpfwsfaldCWH0wtNEjQInXawQ0sHBIfKsrVufzvFc"}]},"signature":"dO0MyxqfSXbgczRjt5FbkL6dYwh7x11LqKuJ2auORECDspJte5XyhoVpJo8tIo3L2pxPhky_mvNrTM7wsW5-BA","supersedes":"did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI","supersedesSignature":%q}`, testSupersedesSignature("did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"))
 	inputReader := strings.NewReader(input)
 
 	req, err := http.NewRequest("POST", "/supersede", inputReader)
@@ -317,7 +326,7 @@ func TestGoodV2SupersedeInput(t *testing.T) {
 	}
 	_, err = stmt.Exec("did:jlinc:KgHfLVmijrWnntRVyPa_wYqDsMXggfNm9GgOlvZ8KsU",
 		"did:jlinc:KgHfLVmijrWnntRVyPa_wYqDsMXggfNm9GgOlvZ8KsU",
-		"KgHfLVmijrWnntRVyPa_wYqDsMXggfNm9GgOlvZ8KsU",
+		b64Encode(testSupersededKey.Public().(ed25519.PublicKey)),
 		"S3ky3CA3Vn_eBEZOzm98uhKnFlXWkH-dloik6sM0n34",
 		"AAAAAAAAAAAAAAAAAAAAADPOpTfniiymYRnvPco7dRKZPWH3DJAUhHAk7z9_rrSJqHZ6pKqfp746AHkP6pPsvgZ9tSbUgg_KSKNha1fSF2x7W2pn1y_9y4nzKmhaewwZ",
 		"BcidY31oPepaxmga2jmg80RL4IxC_Y7k",
@@ -327,7 +336,7 @@ func TestGoodV2SupersedeInput(t *testing.T) {
 		t.Errorf("Insert into db error: %q", err)
 	}
 
-	input := `{"did":{"@context":"https://www.w3.org/ns/did/v1","id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","created":"2020-10-06T01:41:16.341Z","publicKey":[{"id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM#signing","type":"Ed25519VerificationKey2018","controller":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","publicKeyBase58":"ECMEboYvi4kPgv6HAV4i3mGQcAUtq6ZGA6tFSj7VFJ5Q"},{"id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM#encrypting","type":"X25519KeyAgreementKey2019","controller":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","publicKeyBase58":"AV8mXppUYDpFqtwz6Zrf7vecRFJUgSLmFX88A2ZQWVjT"}]},"signature":"tWwu-by7jo6h6T1hzcmK-nF4xWCoYHskn4tx3TlgwQ14xlPLTqDPE-Qgk_DfFCKR_UtqqetBqdNml46hZzT8Aw","supersedes":"did:jlinc:KgHfLVmijrWnntRVyPa_wYqDsMXggfNm9GgOlvZ8KsU"}`
+	input := fmt.Sprintf(`{"did":{"@context":"https://www.w3.org/ns/did/v1","id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","created":"2020-10-06T01:41:16.341Z","publicKey":[{"id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM#signing","type":"Ed25519VerificationKey2018","controller":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","publicKeyBase58":"ECMEboYvi4kPgv6HAV4i3mGQcAUtq6ZGA6tFSj7VFJ5Q"},{"id":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM#encrypting","type":"X25519KeyAgreementKey2019","controller":"did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM","publicKeyBase58":"AV8mXppUYDpFqtwz6Zrf7vecRFJUgSLmFX88A2ZQWVjT"}]},"signature":"tWwu-by7jo6h6T1hzcmK-nF4xWCoYHskn4tx3TlgwQ14xlPLTqDPE-Qgk_DfFCKR_UtqqetBqdNml46hZzT8Aw","supersedes":"did:jlinc:KgHfLVmijrWnntRVyPa_wYqDsMXggfNm9GgOlvZ8KsU","supersedesSignature":%q}`, testSupersedesSignature("did:jlinc:xBAyubAeZq33R1SFlM9WPBCmaRN4hgtCSc3pnE91kxM"))
 	inputReader := strings.NewReader(input)
 
 	req, err := http.NewRequest("POST", "/supersede", inputReader)
@@ -385,3 +394,83 @@ func TestGoodV2SupersedeInput(t *testing.T) {
 	stmt, _ = DB.Prepare("DELETE FROM didstore")
 	stmt.Exec()
 }
+
+func TestBadSupersedeSignature(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	// enter test data in the DB
+	stmt, err := DB.Prepare(`INSERT INTO didstore (id,
+                                              root,
+                                              signing_pubkey,
+                                              encrypting_pubkey,
+                                              secret_cypher,
+                                              secret_nonce,
+                                              challenge,
+                                              status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	_, err = stmt.Exec("did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
+		"did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI",
+		b64Encode(testSupersededKey.Public().(ed25519.PublicKey)),
+		"Vk3kVIvGFV4Ew5m3xJ43N8T5WNFX7qjMOSrJ3Gu4m3E",
+		"AAAAAAAAAAAAAAAAAAAAAJNdfP98pEJQ0M1RpLehjw2798z5FfbAeJErbmYxrYxJwiNqX1laQbmxp5gC2KOPgKw2KY7qHLfvdxBO_yV8b4gviwO3CODi-FQ2E7Q55fCf",
+		"Q2CMu1V6RK9YyvV-ExJD1UVIQt20qVGO",
+		"e36f5aac97038c79fe1352d6c81e930885267601c133f3b3bf94e54a4df4db5d",
+		"verified")
+	if err != nil {
+		t.Errorf("Insert into db error: %q", err)
+	}
+
+	// supersedesSignature is over the wrong DID id
+	input := fmt.Sprintf(`{"did":{"@context":"https://w3id.org/did/v1","id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","created":"2018-11-25T21:51:16.366Z","publicKey":[{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#signing","type":"ed25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic"},{"id":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic#encrypting","type":"curve25519","owner":"did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic","publicKeyBase64":"HdwpfwsfaldCWH0wtNEjQInXawQ0sHBIfKsrVufzvFc"}]},"signature":"dO0MyxqfSXbgczRjt5FbkL6dYwh7x11LqKuJ2auORECDspJte5XyhoVpJo8tIo3L2pxPhky_mvNrTM7wsW5-BA","supersedes":"did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI","supersedesSignature":%q}`, testSupersedesSignature("did:jlinc:xsavxziATze7ycvEqFJuWp7u7J2M_AUWiQcRFs8EAZI"))
+	inputReader := strings.NewReader(input)
+
+	req, err := http.NewRequest("POST", "/supersede", inputReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(supersedeDID)
+
+	handler.ServeHTTP(rr, req)
+
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/problem+json" {
+		t.Errorf("content type header does not match: got %v want %v", ctype, "application/problem+json")
+	}
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	expected := validationProblemJSON(http.StatusUnauthorized, invalid("supersedes_signature_invalid", "supersedes signature did not verify"))
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+
+	// nothing should have been recorded for the superseder
+	var count int
+	DB.QueryRow("SELECT count(*) FROM didstore WHERE id = $1", "did:jlinc:jXjy7N3NK3MboZjhAGgZPJRqKr13TPtrLY0Bsz7Cyic").Scan(&count)
+	if count != 0 {
+		t.Errorf("database contains unexpected superseder record")
+	}
+
+	// delete previous entries from the test database
+	stmt, _ = DB.Prepare("DELETE FROM didstore")
+	stmt.Exec()
+}
@@ -44,15 +44,66 @@ type pageContextKey string
 
 var pageKey = pageContextKey("page")
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is a page of results ordered by sequence, starting after the sequence number in its cursor
+type page struct {
+	After int64
+	Limit int
+}
+
+// paginate reads the cursor and limit query parameters into the request context
 func paginate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		unsafePageStr := strings.Join(r.URL.Query()["page"], "")
-		sanitizedPageInt, _ := strconv.Atoi(unsafePageStr)
-		ctx := context.WithValue(r.Context(), pageKey, sanitizedPageInt)
+		p := page{Limit: defaultPageLimit}
+		if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+			after, err := cursorSequence(cursor)
+			if err != nil {
+				writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "cursor is not valid")
+				return
+			}
+			p.After = after
+		}
+		if limit := r.URL.Query().Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 1 {
+				writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "limit must be a positive number")
+				return
+			}
+			if n > maxPageLimit {
+				n = maxPageLimit
+			}
+			p.Limit = n
+		}
+		ctx := context.WithValue(r.Context(), pageKey, p)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// pageFrom returns the page set by paginate, or the first page
+func pageFrom(ctx context.Context) page {
+	if p, ok := ctx.Value(pageKey).(page); ok {
+		return p
+	}
+	return page{Limit: defaultPageLimit}
+}
+
+// nextCursor returns the cursor for the page after the given sequence number
+func nextCursor(sequence int64) string {
+	return b64Encode([]byte(strconv.FormatInt(sequence, 10)))
+}
+
+func cursorSequence(cursor string) (int64, error) {
+	sequence, err := strconv.ParseInt(string(b64Decode(cursor)), 10, 64)
+	if err == nil && sequence < 0 {
+		err = fmt.Errorf("negative sequence in cursor")
+	}
+	return sequence, err
+}
+
 func joinStringSlice(strs []string) string {
 	var sb strings.Builder
 	for _, str := range strs {
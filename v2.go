@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// request bodies larger than these are refused before they're decoded
+const (
+	maxV2Body      = 64 << 10
+	maxV2BatchBody = 8 << 20
+)
+
+// v2Router serves the /v2 API. It offers every operation of the original routes, with typed
+// request and response bodies that are decoded strictly.
+func v2Router() http.Handler {
+	r := chi.NewRouter()
+	r.NotFound(notFound)
+	r.MethodNotAllowed(methodNotAllowed)
+
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("resolve"), validateRequests)
+		r.Get("/", v2Index)
+		r.Get("/pow", v2PoWPuzzle)
+		r.Get("/dids/{DID}", v2Resolve)
+		r.Get("/dids/{DID}/root", v2ResolveRoot)
+		r.Get("/dids/{DID}/history", v2History)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("write"), idempotent, validateRequests)
+		r.Post("/validate", v2Validate)
+		r.Post("/register", v2Register)
+		r.Post("/confirm", v2Confirm)
+		r.Post("/supersede", v2Supersede)
+		r.Post("/confirmSupersede", v2ConfirmSupersede)
+		r.Post("/revoke", v2Revoke)
+		r.Post("/rotateSecret", v2RotateSecret)
+		r.Post("/selfCustody", v2SelfCustody)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(rateLimited("agent"), idempotent, validateRequests)
+		r.Post("/agent/register", v2AgentRegister)
+		r.Post("/agent/registerBatch", v2AgentRegisterBatch)
+		r.Post("/agent/supersede", v2AgentSupersede)
+		r.Post("/agent/revoke", v2AgentRevoke)
+		r.With(agentAuth(scopeRead), paginate).Get("/agent/dids", v2AgentListDIDs)
+		r.With(agentAuth(scopeInvite)).Get("/agent/invites", v2AgentListInvites)
+		r.With(agentAuth(scopeInvite)).Post("/agent/invites", v2AgentCreateInvite)
+		r.With(agentAuth(scopeInvite)).Delete("/agent/invites/{inviteID}", v2AgentRevokeInvite)
+	})
+	return r
+}
+
+// decodeV2 decodes a request body of at most limit bytes into v, refusing unknown fields,
+// trailing data and missing required fields. It responds with the problem and returns false
+// when the body won't do.
+func decodeV2(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "request body could not be read")
+		return false
+	}
+	if int64(len(body)) > limit {
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("request body is limited to %d bytes", limit))
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(v); err != nil {
+		decodeProblem(err).write(w)
+		return false
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "request body must hold a single JSON object")
+		return false
+	}
+	if field := missingField(reflect.ValueOf(v).Elem(), ""); field != "" {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, field+" is required")
+		return false
+	}
+	return true
+}
+
+// decodeProblem is the problem with a request body that didn't decode
+func decodeProblem(err error) *problem {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == io.EOF:
+		return newProblem(http.StatusBadRequest, codeInvalidRequest, "request body is empty")
+	case errors.As(err, &typeErr):
+		return newProblem(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("%s must not be a %s", typeErr.Field, typeErr.Value))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return newProblem(http.StatusBadRequest, codeInvalidRequest, strings.TrimPrefix(err.Error(), "json: "))
+	default:
+		return newProblem(http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON")
+	}
+}
+
+// missingField names the first required field of a request struct left empty. Fields are
+// required unless their json tag has omitempty.
+func missingField(v reflect.Value, prefix string) string {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		if tag[0] == "" || tag[0] == "-" || len(tag) > 1 && tag[1] == "omitempty" {
+			continue
+		}
+		field := v.Field(i)
+		if field.IsZero() {
+			return prefix + tag[0]
+		}
+		if field.Kind() == reflect.Struct {
+			if name := missingField(field, prefix+tag[0]+"."); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// writeV2 responds with a /v2 response body
+func writeV2(w http.ResponseWriter, status int, v interface{}) {
+	jsn, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsn)
+}
+
+// v2Registration is the registration for a DID document sent to /v2, stored as /register
+// stores it
+func v2Registration(doc json.RawMessage, signature string) (*Registration, *problem) {
+	var registration Registration
+	var parsed interface{}
+	if err := json.Unmarshal(doc, &registration.DID); err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidRequest, "did must be a DID document")
+	}
+	json.Unmarshal(doc, &parsed)
+	raw, err := rawDIDFrom(parsed)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidRequest, "did must be a DID document")
+	}
+	registration.Raw = raw
+	registration.Signature = signature
+	return &registration, nil
+}
+
+// writeV2Validation responds with every error in a registration, or with the validation
+// problem for a dry run with errors
+func writeV2Validation(w http.ResponseWriter, registration *Registration, supersede bool, isDryRun bool) {
+	errs, p := validation(registration, supersede, isDryRun)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2ValidateResponse{ID: registration.DID.ID, Valid: len(errs) == 0, Errors: errs})
+}
+
+// The master public key to encrypt registration secrets to
+func v2Index(w http.ResponseWriter, r *http.Request) {
+	writeV2(w, http.StatusOK, v2IndexResponse{MasterPublicKey: Conf.Keys.Public})
+}
+
+// Issue a proof of work puzzle for /v2/register or /v2/supersede
+func v2PoWPuzzle(w http.ResponseWriter, r *http.Request) {
+	if !Conf.PoW.Enabled {
+		writeProblem(w, http.StatusNotFound, codePoWDisabled, "proof of work is not required")
+		return
+	}
+	puzzle, difficulty, expires, err := issuePuzzle()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, codeInternalError, "puzzle error")
+		return
+	}
+	writeV2(w, http.StatusOK, v2PuzzleResponse{Puzzle: puzzle, Difficulty: difficulty, Expires: expires.UTC()})
+}
+
+// Resolve a DID to its document, or to the DID that superseded it
+func v2Resolve(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "DID")
+	res, p := resolveDID(id)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	if res.SupersededBy != "" {
+		writeV2(w, http.StatusOK, v2ResolveResponse{ID: id, Status: "superseded", SupersededBy: res.SupersededBy})
+		return
+	}
+	writeV2(w, http.StatusOK, v2ResolveResponse{ID: id, Status: "verified", DID: didDocument(res.DID)})
+}
+
+// Resolve a chain's root to its latest DID
+func v2ResolveRoot(w http.ResponseWriter, r *http.Request) {
+	raw, p := resolveRootDID(chi.URLParam(r, "DID"))
+	if p != nil {
+		p.write(w)
+		return
+	}
+	doc := didDocument(raw)
+	var latest did
+	json.Unmarshal(doc, &latest)
+	writeV2(w, http.StatusOK, v2ResolveResponse{ID: latest.ID, Status: "verified", DID: doc})
+}
+
+func v2History(w http.ResponseWriter, r *http.Request) {
+	entries, p := didHistory(chi.URLParam(r, "DID"))
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2HistoryResponse{History: entries})
+}
+
+// Validate a registration, or a supersede when it has a supersedes id, without recording it
+func v2Validate(w http.ResponseWriter, r *http.Request) {
+	var req v2ValidateRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	registration, p := v2Registration(req.DID, req.Signature)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	if req.Secret != nil {
+		registration.Secret = req.Secret.secret()
+	}
+	registration.Supersedes = req.Supersedes
+	registration.SupersedesSignature = req.SupersedesSignature
+	writeV2Validation(w, registration, req.Supersedes != "", false)
+}
+
+func v2Register(w http.ResponseWriter, r *http.Request) {
+	var req v2RegisterRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	registration, p := v2Registration(req.DID, req.Signature)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	registration.Secret = req.Secret.secret()
+	registration.PoW = req.PoW
+	registration.Invite = req.Invite
+
+	if dryRun(r) {
+		writeV2Validation(w, registration, false, true)
+		return
+	}
+	if p = newRegistration(registration); p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusCreated, v2ChallengeResponse{ID: registration.DID.ID, Challenge: registration.Challenge})
+}
+
+func v2Supersede(w http.ResponseWriter, r *http.Request) {
+	var req v2SupersedeRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	registration, p := v2Registration(req.DID, req.Signature)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	registration.Supersedes = req.Supersedes
+	registration.SupersedesSignature = req.SupersedesSignature
+	registration.PoW = req.PoW
+
+	if dryRun(r) {
+		writeV2Validation(w, registration, true, true)
+		return
+	}
+	if p = newSupersede(registration); p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusCreated, v2ChallengeResponse{ID: registration.DID.ID, Challenge: registration.Challenge})
+}
+
+func v2Confirm(w http.ResponseWriter, r *http.Request) {
+	var req v2ConfirmRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	id, p := confirmRegistration(req.ChallengeResponse)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2DIDStatusResponse{ID: id, Status: "verified"})
+}
+
+func v2ConfirmSupersede(w http.ResponseWriter, r *http.Request) {
+	var req v2ConfirmRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	id, p := confirmSupersession(req.ChallengeResponse)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2DIDStatusResponse{ID: id, Status: "verified"})
+}
+
+func v2Revoke(w http.ResponseWriter, r *http.Request) {
+	var req v2RevokeRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	id, p := revokeDID(req.RevokeRequest)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2DIDStatusResponse{ID: id, Status: "revoked"})
+}
+
+func v2RotateSecret(w http.ResponseWriter, r *http.Request) {
+	var req v2RotateSecretRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	root, p := rotateRootSecret(req.ID, req.Created, req.Secret.secret(), req.Signature)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2RotateSecretResponse{Root: root})
+}
+
+func v2SelfCustody(w http.ResponseWriter, r *http.Request) {
+	var req v2SelfCustodyRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	id, custody, p := setSelfCustody(req.SelfCustodyRequest)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2SelfCustodyResponse{ID: id, SelfCustody: custody})
+}
+
+func v2AgentRegister(w http.ResponseWriter, r *http.Request) {
+	var req v2AgentRegisterRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	agentkey, byCert, err := requestAgent(r, req.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+	id, p := agentRegisterDID(agentkey, byCert, req.Registration)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusCreated, v2DIDStatusResponse{ID: id, Status: "verified"})
+}
+
+func v2AgentRegisterBatch(w http.ResponseWriter, r *http.Request) {
+	var req v2AgentRegisterBatchRequest
+	if !decodeV2(w, r, &req, maxV2BatchBody) {
+		return
+	}
+	switch n := len(req.Registrations); {
+	case n == 0:
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "registrations must not be empty")
+		return
+	case n > maxBatchRegistrations:
+		writeProblem(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("a batch holds at most %d registrations", maxBatchRegistrations))
+		return
+	}
+
+	agentkey, byCert, err := requestAgent(r, req.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+
+	status, results := http.StatusOK, []batchResult(nil)
+	if req.Atomic {
+		var p *problem
+		if results, p = recordBatchAtomic(agentkey, byCert, req.Registrations); p != nil {
+			p.write(w)
+			return
+		}
+		status = http.StatusCreated
+	} else {
+		results = recordBatchEach(agentkey, byCert, req.Registrations)
+	}
+	recorded := batchRecorded(results)
+	writeV2(w, status, v2BatchResponse{Recorded: recorded, Failed: len(results) - recorded, Results: results})
+}
+
+func v2AgentSupersede(w http.ResponseWriter, r *http.Request) {
+	var req v2AgentSupersedeRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	agentkey, byCert, err := requestAgent(r, req.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+	id, p := agentSupersedeDID(agentkey, byCert, req.Supersede)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusCreated, v2DIDStatusResponse{ID: id, Status: "verified"})
+}
+
+func v2AgentRevoke(w http.ResponseWriter, r *http.Request) {
+	var req v2AgentRevokeRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	agentkey, byCert, err := requestAgent(r, req.AgentKey)
+	if err != nil {
+		writeProblem(w, http.StatusForbidden, codeForbidden, err.Error())
+		return
+	}
+	id, p := agentRevokeDID(agentkey, byCert, req.RevokeRequest)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	writeV2(w, http.StatusOK, v2DIDStatusResponse{ID: id, Status: "revoked"})
+}
+
+func v2AgentListDIDs(w http.ResponseWriter, r *http.Request) {
+	f, err := didFilterFrom(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	dids, cursor, err := agentDIDs(agentFrom(r.Context()), f, pageFrom(r.Context()))
+	if err != nil {
+		writeDatabaseProblem(w, "q")
+		return
+	}
+	if dids == nil {
+		dids = []agentDID{}
+	}
+	writeV2(w, http.StatusOK, v2DIDListResponse{DIDs: dids, NextCursor: cursor})
+}
+
+func v2AgentListInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := listInvites(agentFrom(r.Context()))
+	if err != nil {
+		writeDatabaseProblem(w, "q")
+		return
+	}
+	if invites == nil {
+		invites = []invite{}
+	}
+	writeV2(w, http.StatusOK, v2InviteListResponse{Invites: invites})
+}
+
+func v2AgentCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req v2InviteRequest
+	if !decodeV2(w, r, &req, maxV2Body) {
+		return
+	}
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	id, token, err := createInvite(agentFrom(r.Context()), req.Note, maxUses, req.Expires)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	writeV2(w, http.StatusCreated, v2InviteResponse{ID: id, Invite: token})
+}
+
+func v2AgentRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "inviteID"), 10, 64)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, codeInvalidRequest, "invite id must be a number")
+		return
+	}
+	if err = revokeInvite(id, agentFrom(r.Context())); err == errInviteNotFound {
+		writeProblem(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeDatabaseProblem(w, "e")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// v2Server routes requests as the server does, with the v2 API under /v2
+func v2Server() http.Handler {
+	r := chi.NewRouter()
+	r.Mount("/v2", v2Router())
+	return r
+}
+
+func TestV2StrictDecoding(t *testing.T) {
+	tests := []struct {
+		path   string
+		body   string
+		status int
+		code   string
+		detail string
+	}{
+		{"/v2/confirm", ``, http.StatusBadRequest, codeInvalidRequest, "request body is empty"},
+		{"/v2/confirm", `{"challengeResponse":`, http.StatusUnprocessableEntity, codeInvalidJSON, "Not valid JSON"},
+		{"/v2/confirm", `{"challengeResponse":"x", "id":"y"}`, http.StatusBadRequest, codeInvalidRequest, `unknown field "id"`},
+		{"/v2/confirm", `{"challengeResponse":1}`, http.StatusBadRequest, codeInvalidRequest, "challengeResponse must not be a number"},
+		{"/v2/confirm", `{"challengeResponse":"x"} {}`, http.StatusBadRequest, codeInvalidRequest, "request body must hold a single JSON object"},
+		{"/v2/confirm", `{}`, http.StatusBadRequest, codeInvalidRequest, "challengeResponse is required"},
+		{"/v2/confirm", `{"challengeResponse":"` + strings.Repeat("x", maxV2Body) + `"}`, http.StatusRequestEntityTooLarge, codeTooLarge, "request body is limited to 65536 bytes"},
+		{"/v2/rotateSecret", `{"id":"a", "created":"b", "signature":"c", "secret":{"nonce":"d"}}`, http.StatusBadRequest, codeInvalidRequest, "secret.cyphertext is required"},
+		{"/v2/agent/registerBatch", `{"registrations":[]}`, http.StatusBadRequest, codeInvalidRequest, "registrations must not be empty"},
+		{"/v2/confirm", `{"challengeResponse":"x"}`, http.StatusUnauthorized, codeJWTInvalid, "JWT-token contains an invalid number of segments"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		v2Server().ServeHTTP(rr, httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		if rr.Code != test.status {
+			t.Errorf("%s %.40s: got status %v want %v", test.path, test.body, rr.Code, test.status)
+		}
+		if expected := problemJSON(test.status, test.code, test.detail); rr.Body.String() != expected {
+			t.Errorf("%s %.40s: got %s want %s", test.path, test.body, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestMissingField(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		missing string
+	}{
+		{&v2RegisterRequest{}, "did"},
+		{&v2RegisterRequest{DID: []byte(`{}`), Signature: "s"}, "secret"},
+		{&v2RegisterRequest{DID: []byte(`{}`), Signature: "s", Secret: v2Secret{Nonce: "n"}}, "secret.cyphertext"},
+		{&v2RegisterRequest{DID: []byte(`{}`), Signature: "s", Secret: v2Secret{Cyphertext: "c"}}, ""},
+		{&v2AgentRegisterRequest{Registration: "jwt"}, ""},
+		{&v2AgentSupersedeRequest{Supersede: "jwt"}, ""},
+		{&v2AgentRevokeRequest{RevokeRequest: "jwt"}, ""},
+		{&v2InviteRequest{}, ""},
+	}
+	for _, test := range tests {
+		if missing := missingField(reflect.ValueOf(test.v).Elem(), ""); missing != test.missing {
+			t.Errorf("%T: got %q missing want %q", test.v, missing, test.missing)
+		}
+	}
+}
+
+func TestV2Index(t *testing.T) {
+	defer func(public string) { Conf.Keys.Public = public }(Conf.Keys.Public)
+	Conf.Keys.Public = "a-master-public-key"
+
+	for _, path := range []string{"/v2", "/v2/"} {
+		rr := httptest.NewRecorder()
+		v2Server().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if expected := `{"masterPublicKey":"a-master-public-key"}`; rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != expected {
+			t.Errorf("%s: got %v %s want %s", path, rr.Code, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestV2BadID(t *testing.T) {
+	for _, path := range []string{"/v2/dids/nope", "/v2/dids/nope/root", "/v2/dids/nope/history"} {
+		rr := httptest.NewRecorder()
+		v2Server().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if expected := problemJSON(http.StatusBadRequest, codeInvalidRequest, "cannot parse request"); rr.Code != http.StatusBadRequest || rr.Body.String() != expected {
+			t.Errorf("%s: got %v %s want %s", path, rr.Code, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestDIDDocument(t *testing.T) {
+	doc := `{"@context":"https://w3id.org/did/v1","id":"did:jlinc:x"}`
+	if got := string(didDocument(`{"did":` + doc + `}`)); got != doc {
+		t.Errorf("wrapped document: got %s want %s", got, doc)
+	}
+	if got := string(didDocument(doc)); got != doc {
+		t.Errorf("agent document: got %s want %s", got, doc)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The request and response bodies of the /v2 API. A request field is required unless its json
+// tag has omitempty, and a request holding any field not listed here is refused.
+
+// v2Secret is the registration secret, encrypted to the server's master public key
+type v2Secret struct {
+	Cyphertext string `json:"cyphertext"`
+	Nonce      string `json:"nonce,omitempty"`
+	Format     string `json:"format,omitempty"`
+}
+
+func (s v2Secret) secret() secret {
+	return secret{Cyphertext: s.Cyphertext, Nonce: s.Nonce, Format: s.Format}
+}
+
+// v2RegisterRequest registers a new DID, to be confirmed with the signed challenge
+type v2RegisterRequest struct {
+	DID       json.RawMessage `json:"did"`
+	Signature string          `json:"signature"`
+	Secret    v2Secret        `json:"secret"`
+	PoW       *powSolution    `json:"pow,omitempty"`
+	Invite    string          `json:"invite,omitempty"`
+}
+
+// v2SupersedeRequest registers a DID superseding an active one, signed by both DIDs' keys
+type v2SupersedeRequest struct {
+	DID                 json.RawMessage `json:"did"`
+	Signature           string          `json:"signature"`
+	Supersedes          string          `json:"supersedes"`
+	SupersedesSignature string          `json:"supersedesSignature"`
+	PoW                 *powSolution    `json:"pow,omitempty"`
+}
+
+// v2ValidateRequest is a registration, or a supersede when it has supersedes, to check without
+// recording it
+type v2ValidateRequest struct {
+	DID                 json.RawMessage `json:"did"`
+	Signature           string          `json:"signature"`
+	Secret              *v2Secret       `json:"secret,omitempty"`
+	Supersedes          string          `json:"supersedes,omitempty"`
+	SupersedesSignature string          `json:"supersedesSignature,omitempty"`
+}
+
+// v2ConfirmRequest confirms a registration or supersede with a JWT holding the id and the
+// signature over its challenge
+type v2ConfirmRequest struct {
+	ChallengeResponse string `json:"challengeResponse"`
+}
+
+// v2RevokeRequest revokes a DID with a JWT signed with the registration secret
+type v2RevokeRequest struct {
+	RevokeRequest string `json:"revokeRequest"`
+}
+
+// v2SelfCustodyRequest sets a chain's self custody with a JWT signed with the registration secret
+type v2SelfCustodyRequest struct {
+	SelfCustodyRequest string `json:"selfCustodyRequest"`
+}
+
+// v2RotateSecretRequest replaces the registration secret, signed by a verified DID in the chain
+type v2RotateSecretRequest struct {
+	ID        string   `json:"id"`
+	Created   string   `json:"created"`
+	Secret    v2Secret `json:"secret"`
+	Signature string   `json:"signature"`
+}
+
+// v2AgentRegisterRequest registers a DID on behalf of an agent's user. The agentkey may be left
+// out when the agent presents its client certificate.
+type v2AgentRegisterRequest struct {
+	AgentKey     string `json:"agentkey,omitempty"`
+	Registration string `json:"registration"`
+}
+
+// v2AgentRegisterBatchRequest registers many DIDs for an agent at once
+type v2AgentRegisterBatchRequest struct {
+	AgentKey      string   `json:"agentkey,omitempty"`
+	Registrations []string `json:"registrations"`
+	Atomic        bool     `json:"atomic,omitempty"`
+}
+
+// v2AgentSupersedeRequest supersedes a DID in the agent's custody. The agentkey may be left out
+// when the agent presents its client certificate.
+type v2AgentSupersedeRequest struct {
+	AgentKey  string `json:"agentkey,omitempty"`
+	Supersede string `json:"supersede"`
+}
+
+// v2AgentRevokeRequest revokes a DID in the agent's custody. The agentkey may be left out when
+// the agent presents its client certificate.
+type v2AgentRevokeRequest struct {
+	AgentKey      string `json:"agentkey,omitempty"`
+	RevokeRequest string `json:"revokeRequest"`
+}
+
+// v2InviteRequest issues an invite, good for one use unless maxUses says otherwise
+type v2InviteRequest struct {
+	Note    string     `json:"note,omitempty"`
+	MaxUses *int       `json:"maxUses,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// v2IndexResponse is the master public key that registration secrets are encrypted to
+type v2IndexResponse struct {
+	MasterPublicKey string `json:"masterPublicKey"`
+}
+
+// v2ChallengeResponse is a recorded registration and the challenge to sign to confirm it
+type v2ChallengeResponse struct {
+	ID        string `json:"id"`
+	Challenge string `json:"challenge"`
+}
+
+// v2DIDStatusResponse is a DID and the status it has after the request
+type v2DIDStatusResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// v2SelfCustodyResponse is the self custody a DID's chain has after the request
+type v2SelfCustodyResponse struct {
+	ID          string `json:"id"`
+	SelfCustody bool   `json:"selfCustody"`
+}
+
+// v2RotateSecretResponse is the root whose secret was replaced
+type v2RotateSecretResponse struct {
+	Root string `json:"root"`
+}
+
+// v2ValidateResponse lists every error in a registration
+type v2ValidateResponse struct {
+	ID     string            `json:"id"`
+	Valid  bool              `json:"valid"`
+	Errors []validationError `json:"errors"`
+}
+
+// v2PuzzleResponse is a proof of work puzzle for /v2/register or /v2/supersede
+type v2PuzzleResponse struct {
+	Puzzle     string    `json:"puzzle"`
+	Difficulty int       `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// v2ResolveResponse is a verified DID's document, or the DID that superseded it
+type v2ResolveResponse struct {
+	ID           string          `json:"id"`
+	Status       string          `json:"status"`
+	DID          json.RawMessage `json:"did,omitempty"`
+	SupersededBy string          `json:"supersededBy,omitempty"`
+}
+
+// v2HistoryResponse is every DID in a chain, oldest first
+type v2HistoryResponse struct {
+	History []historyEntry `json:"history"`
+}
+
+// v2BatchResponse is the outcome of each registration in a batch
+type v2BatchResponse struct {
+	Recorded int           `json:"recorded"`
+	Failed   int           `json:"failed"`
+	Results  []batchResult `json:"results"`
+}
+
+// v2DIDListResponse is a page of an agent's DIDs, with the cursor for the next one
+type v2DIDListResponse struct {
+	DIDs       []agentDID `json:"dids"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// v2InviteResponse is an invite just issued. The token is only ever shown here.
+type v2InviteResponse struct {
+	ID     int64  `json:"id"`
+	Invite string `json:"invite"`
+}
+
+// v2InviteListResponse lists the invites issued by an agent
+type v2InviteListResponse struct {
+	Invites []invite `json:"invites"`
+}
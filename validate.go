@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// validationError is a registration error with a machine-readable code
+type validationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e validationError) Error() string {
+	return e.Message
+}
+
+func invalid(code string, message string) error {
+	return validationError{Code: code, Message: message}
+}
+
+// validationErrors lists the errors in a validation result with their codes
+func validationErrors(result *multierror.Error) []validationError {
+	errs := []validationError{}
+	if result == nil {
+		return errs
+	}
+	for _, err := range result.Errors {
+		if ve, ok := err.(validationError); ok {
+			errs = append(errs, ve)
+		} else {
+			errs = append(errs, validationError{Code: "invalid", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// validateRegistration runs every check /register or /supersede makes, including those against
+// the database, without writing anything
+func validateRegistration(registration *Registration, supersede bool) (*multierror.Error, error) {
+	var result *multierror.Error
+	if err := validateDIDparams(registration); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := getDIDkeys(registration); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := validateDIDsignature(registration); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if !supersede {
+		if err := validateDIDsecret(registration); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	var exists bool
+	if err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM didstore WHERE id = $1)", registration.DID.ID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		result = multierror.Append(result, invalid("id_taken", "a DID with this id is already registered"))
+	}
+
+	if supersede {
+		var status, supersededSigningKey string
+		err := DB.QueryRow("SELECT status, signing_pubkey FROM didstore WHERE id = $1", registration.Supersedes).Scan(&status, &supersededSigningKey)
+		switch {
+		case err == sql.ErrNoRows:
+			result = multierror.Append(result, invalid("supersedes_not_found", "item to supersede not found"))
+		case err != nil:
+			return nil, err
+		case status != "verified":
+			result = multierror.Append(result, invalid("supersedes_not_active", "item to supersede not active"))
+		default:
+			if err := validateSupersedesSignature(registration, supersededSigningKey); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+// validation lists every error in a registration. A dry run with errors fails like the real
+// request would, with a validation problem.
+func validation(registration *Registration, supersede bool, isDryRun bool) ([]validationError, *problem) {
+	result, err := validateRegistration(registration, supersede)
+	if err != nil {
+		return nil, databaseProblem("v")
+	}
+
+	errs := validationErrors(result)
+	if isDryRun && len(errs) > 0 {
+		return nil, validationProblem(http.StatusBadRequest, result)
+	}
+	return errs, nil
+}
+
+// writeValidation responds with every error in a registration
+func writeValidation(w http.ResponseWriter, registration *Registration, supersede bool, isDryRun bool) {
+	errs, p := validation(registration, supersede, isDryRun)
+	if p != nil {
+		p.write(w)
+		return
+	}
+	jsn, _ := json.Marshal(errs)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true, "valid":%t, "id":%q, "errors":%s}`, len(errs) == 0, registration.DID.ID, jsn)
+}
+
+// Validate a registration, or a supersede when it has a supersedes id, without recording it
+func validateDID(w http.ResponseWriter, r *http.Request) {
+	var registration Registration
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		writeJSONProblem(w)
+		return
+	}
+	writeValidation(w, &registration, registration.Supersedes != "", false)
+}
+
+// dryRun is whether a /register or /supersede request only asks for validation
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == "true"
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	multierror "github.com/hashicorp/go-multierror"
+	_ "github.com/lib/pq"
+)
+
+const badRegistration = `{"did":{"@context":"https://w3id.org/did/v2","id":"did:jlincz:3Cza_sxboNZ_NajNVOrEH7YKPRQoD-PK7nq6nhgMy18","created":"2018-11-10T03:10:02.246Z","publicKey":[{"id":"did:jlinc:3Cza_sxboNZ_NajNVOrEH7YKPRQoD-PK7nq6nhgMy18#signing","type":"ed25519","owner":"did:jlinc:3Cza_sxboNZ_NajNVOrEH7YKPRQoD-PK7nq6nhgMy18","publicKeyBase64":"3Cza_sxboNZ_NajNVOrEH7YKPRQoD-PK7nq6nhgMy18"}]},"secret":{"cyphertext":"","nonce":""},"signature":""}`
+
+func TestValidationErrors(t *testing.T) {
+	var result *multierror.Error
+	result = multierror.Append(result, invalid("id_invalid", "id must be did:jlinc:{base64 encoded string}"))
+	result = multierror.Append(result, errors.New("something else"))
+
+	got := validationErrors(result)
+	want := []validationError{
+		{Code: "id_invalid", Message: "id must be did:jlinc:{base64 encoded string}"},
+		{Code: "invalid", Message: "something else"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got = validationErrors(nil); got == nil || len(got) != 0 {
+		t.Errorf("no errors: got %#v", got)
+	}
+
+	// codes don't change the messages the endpoints return
+	result.ErrorFormat = formatErrors
+	if result.Error() != "request contained 2 errors: id must be did:jlinc:{base64 encoded string}, something else" {
+		t.Errorf("unexpected message %q", result.Error())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if _, err := toml.DecodeFile("./test.config.toml", &Conf); err != nil {
+		log.Fatal(err)
+		return
+	}
+	connStr := Conf.Database.ConnectionString
+	var err error
+	DB, err = sql.Open("postgres", connStr)
+	defer DB.Close()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	Conf.IsTest = true //so it doesn't test the timestamp
+
+	type validation struct {
+		Valid  bool              `json:"valid"`
+		Code   string            `json:"code"`
+		Errors []validationError `json:"errors"`
+	}
+	codes := func(v validation) string {
+		var c []string
+		for _, e := range v.Errors {
+			c = append(c, e.Code)
+		}
+		return strings.Join(c, ",")
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+		codes   string
+	}{
+		{"validate", "/validate", validateDID, badRegistration, http.StatusOK,
+			"context_invalid,id_invalid,signing_key_invalid,encrypting_key_invalid"},
+		{"register dry run", "/register?dryRun=true", registerDID, badRegistration, http.StatusBadRequest,
+			"context_invalid,id_invalid,signing_key_invalid,encrypting_key_invalid"},
+		{"supersede dry run", "/supersede?dryRun=true", supersedeDID, strings.Replace(badRegistration, `"signature":""`, `"supersedes":"did:jlinc:not-registered"`, 1), http.StatusBadRequest,
+			"context_invalid,id_invalid,signing_key_invalid,supersedes_not_found"},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		test.handler.ServeHTTP(rr, httptest.NewRequest("POST", test.path, strings.NewReader(test.body)))
+		var v validation
+		if err = json.Unmarshal(rr.Body.Bytes(), &v); err != nil || rr.Code != test.status || v.Valid || codes(v) != test.codes {
+			t.Errorf("%s: got %v %s", test.name, rr.Code, rr.Body.String())
+		}
+		if test.status == http.StatusBadRequest && (v.Code != codeValidationFailed || rr.Header().Get("Content-Type") != "application/problem+json") {
+			t.Errorf("%s: got %v %s", test.name, rr.Code, rr.Body.String())
+		}
+	}
+
+	// nothing is written
+	var n int
+	DB.QueryRow("SELECT COUNT(*) FROM didstore WHERE id LIKE 'did:jlincz:%'").Scan(&n)
+	if n != 0 {
+		t.Errorf("dry run recorded %d DIDs", n)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"strings"
 	"time"
 
@@ -12,27 +11,35 @@ import (
 func validateDIDparams(registration *Registration) *multierror.Error {
 	var result *multierror.Error
 	if checkAtContext(registration.DID.AtContext) < 1 {
-		result = multierror.Append(result, errors.New("@context missing or incorrect"))
+		result = multierror.Append(result, invalid("context_invalid", "@context missing or incorrect"))
 	}
 
 	if _, ok := getValidID(registration.DID.ID); !ok {
-		result = multierror.Append(result, errors.New("id must be did:jlinc:{base64 encoded string}"))
+		result = multierror.Append(result, invalid("id_invalid", "id must be did:jlinc:{base64 encoded string}"))
 	}
 
 	// check the timestamp as long as Conf.IsTest is not true
 	if !Conf.IsTest {
-		t, err := time.Parse(time.RFC3339, registration.DID.CreatedAt)
-		if err != nil {
-			result = multierror.Append(result, errors.New("created must be in valid RFC3339 format"))
-		}
-		// we'll allow the timestamp to be from 10 minutes before now (for latency) to 1 minute after now (for clock error)
-		if time.Since(t) > time.Minute*10 || time.Until(t) > time.Minute {
-			result = multierror.Append(result, errors.New("DID timestamp is out of bounds"))
+		if err := validateTimestamp(registration.DID.CreatedAt); err != nil {
+			result = multierror.Append(result, err)
 		}
 	}
 	return result
 }
 
+func validateTimestamp(created string) *multierror.Error {
+	var result *multierror.Error
+	t, err := time.Parse(time.RFC3339, created)
+	if err != nil {
+		result = multierror.Append(result, invalid("created_invalid", "created must be in valid RFC3339 format"))
+	}
+	// we'll allow the timestamp to be from 10 minutes before now (for latency) to 1 minute after now (for clock error)
+	if time.Since(t) > time.Minute*10 || time.Until(t) > time.Minute {
+		result = multierror.Append(result, invalid("created_out_of_bounds", "DID timestamp is out of bounds"))
+	}
+	return result
+}
+
 func getDIDkeys(registration *Registration) *multierror.Error {
 	// get the signing and encrypting public keys
 	var result *multierror.Error
@@ -43,19 +50,19 @@ func getDIDkeys(registration *Registration) *multierror.Error {
 			if len(idParts) > 1 {
 				if idParts[1] == "signing" {
 					if key.Owner != registration.DID.ID {
-						result = multierror.Append(result, errors.New("Signing key owner incorrect"))
+						result = multierror.Append(result, invalid("signing_key_owner_invalid", "Signing key owner incorrect"))
 					}
 					if key.Type != "ed25519" {
-						result = multierror.Append(result, errors.New("Signing key type incorrect"))
+						result = multierror.Append(result, invalid("signing_key_type_invalid", "Signing key type incorrect"))
 					}
 					registration.SigningKey = key.PublicKeyBase64
 				}
 				if idParts[1] == "encrypting" {
 					if key.Owner != registration.DID.ID {
-						result = multierror.Append(result, errors.New("Encrypting key owner incorrect"))
+						result = multierror.Append(result, invalid("encrypting_key_owner_invalid", "Encrypting key owner incorrect"))
 					}
 					if key.Type != "curve25519" {
-						result = multierror.Append(result, errors.New("Encrypting key type incorrect"))
+						result = multierror.Append(result, invalid("encrypting_key_type_invalid", "Encrypting key type incorrect"))
 					}
 					registration.EncryptingKey = key.PublicKeyBase64
 				}
@@ -65,19 +72,19 @@ func getDIDkeys(registration *Registration) *multierror.Error {
 			if len(idParts) > 1 {
 				if idParts[1] == "signing" {
 					if key.Controller != registration.DID.ID {
-						result = multierror.Append(result, errors.New("Signing key owner incorrect"))
+						result = multierror.Append(result, invalid("signing_key_owner_invalid", "Signing key owner incorrect"))
 					}
 					if key.Type != "Ed25519VerificationKey2018" {
-						result = multierror.Append(result, errors.New("Signing key type incorrect"))
+						result = multierror.Append(result, invalid("signing_key_type_invalid", "Signing key type incorrect"))
 					}
 					registration.SigningKey = b58tob64(key.PublicKeyBase58)
 				}
 				if idParts[1] == "encrypting" {
 					if key.Controller != registration.DID.ID {
-						result = multierror.Append(result, errors.New("Encrypting key owner incorrect"))
+						result = multierror.Append(result, invalid("encrypting_key_owner_invalid", "Encrypting key owner incorrect"))
 					}
 					if key.Type != "X25519KeyAgreementKey2019" {
-						result = multierror.Append(result, errors.New("Encrypting key type incorrect"))
+						result = multierror.Append(result, invalid("encrypting_key_type_invalid", "Encrypting key type incorrect"))
 					}
 					registration.EncryptingKey = b58tob64(key.PublicKeyBase58) // store encrypting key in db as base64
 				}
@@ -91,14 +98,14 @@ func validateDIDsignature(registration *Registration) *multierror.Error {
 	var result *multierror.Error
 	signingPkey := b64Decode(registration.SigningKey)
 	if len(signingPkey) != ed25519.PublicKeySize {
-		result = multierror.Append(result, errors.New("signing public key missing or size incorrect"))
+		result = multierror.Append(result, invalid("signing_key_invalid", "signing public key missing or size incorrect"))
 	} else {
 		//check registration.Signature
 		signed := registration.DID.ID + "." + registration.DID.CreatedAt
 		signedHashed := getHash(signed)
 		sig := b64Decode(registration.Signature)
 		if sigVerified := ed25519.Verify(signingPkey, signedHashed, sig); !sigVerified {
-			result = multierror.Append(result, errors.New("signature did not verify"))
+			result = multierror.Append(result, invalid("signature_invalid", "signature did not verify"))
 		}
 	}
 	return result
@@ -107,12 +114,32 @@ func validateDIDsignature(registration *Registration) *multierror.Error {
 func validateDIDsecret(registration *Registration) *multierror.Error {
 	var result *multierror.Error
 	if len(b64Decode(registration.EncryptingKey)) != 32 {
-		result = multierror.Append(result, errors.New("encrypting public key missing or size incorrect"))
+		result = multierror.Append(result, invalid("encrypting_key_invalid", "encrypting public key missing or size incorrect"))
+	} else if !validSecretFormat(registration.Secret.Format) {
+		result = multierror.Append(result, invalid("secret_format_invalid", "secret format must be crypto_box, crypto_box_easy or crypto_box_seal"))
 	} else {
-		//check that registration.Secret.Cyphertext can be decoded
-		_, ok := decryptRegSecret(registration.Secret.Cyphertext, registration.Secret.Nonce, registration.EncryptingKey, Conf.Keys.Secret)
+		//check that registration.Secret.Cyphertext can be decoded, with the current or a retired master key
+		_, master, ok := openRegSecret(registration.Secret.Cyphertext, registration.Secret.Nonce, registration.Secret.Format, registration.EncryptingKey, "")
 		if !ok {
-			result = multierror.Append(result, errors.New("secret did not decrypt correctly"))
+			result = multierror.Append(result, invalid(codeSecretInvalid, "secret did not decrypt correctly"))
+		}
+		// record the master key that the secret is encrypted with
+		registration.Secret.MasterKey = master
+	}
+	return result
+}
+
+func validateSupersedesSignature(registration *Registration, supersededSigningKey string) *multierror.Error {
+	var result *multierror.Error
+	signingPkey := b64Decode(supersededSigningKey)
+	if len(signingPkey) != ed25519.PublicKeySize {
+		result = multierror.Append(result, invalid("supersedes_signing_key_invalid", "superseded signing public key missing or size incorrect"))
+	} else {
+		// the superseded DID's current signing key must have signed the new DID id
+		signedHashed := getHash(registration.DID.ID)
+		sig := b64Decode(registration.SupersedesSignature)
+		if sigVerified := ed25519.Verify(signingPkey, signedHashed, sig); !sigVerified {
+			result = multierror.Append(result, invalid("supersedes_signature_invalid", "supersedes signature did not verify"))
 		}
 	}
 	return result
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strings"
 
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -18,9 +19,24 @@ func getValidID(id string) (string, bool) {
 	return "", false
 }
 
-func decryptRegSecret(c string, n string, pk string, sk string) ([]byte, bool) {
+// formats of the registration secret, named after the libsodium functions that produce them
+const (
+	secretFormatBox     = "crypto_box"      // NaCl API, prefixed with crypto_box_BOXZEROBYTES zeros
+	secretFormatBoxEasy = "crypto_box_easy" // MAC followed by the encrypted message
+	secretFormatSeal    = "crypto_box_seal" // anonymous, from an ephemeral key with no nonce
+)
+
+func validSecretFormat(format string) bool {
+	switch format {
+	case "", secretFormatBox, secretFormatBoxEasy, secretFormatSeal:
+		return true
+	}
+	return false
+}
+
+func decryptRegSecret(c string, n string, format string, pk string, sk []byte) ([]byte, bool) {
 	cyphertext := b64Decode(c)
-	if len(cyphertext) < 16 {
+	if len(cyphertext) < box.Overhead {
 		return nil, false //guard against empty cyphertext
 	}
 
@@ -30,12 +46,29 @@ func decryptRegSecret(c string, n string, pk string, sk string) ([]byte, bool) {
 	var serverSecret [32]byte
 	copy(nonce[:], b64Decode(n))
 	copy(senderPubkey[:], b64Decode(pk))
-	copy(serverSecret[:], b64Decode(sk))
+	copy(serverSecret[:], sk)
 
-	// node-sodium/libsodium prefixes the cyphertext with 16 bytes of zeros (sodium.crypto_box_BOXZEROBYTES).
-	// box.Open doesn't seem to like this, so we strip them off.
-	if prefixed := zeroPrefixed(cyphertext, 16); prefixed {
+	switch format {
+	case secretFormatSeal:
+		// the sender's ephemeral public key is part of the cyphertext
+		var serverPubkey [32]byte
+		curve25519.ScalarBaseMult(&serverPubkey, &serverSecret)
+		return box.OpenAnonymous(nil, cyphertext, &serverPubkey, &serverSecret)
+	case secretFormatBox:
+		// box.Open expects the crypto_box_easy layout, so strip the zeros off
+		if len(cyphertext) < 16+box.Overhead || !zeroPrefixed(cyphertext, 16) {
+			return nil, false
+		}
 		cyphertext = cyphertext[16:]
+	case secretFormatBoxEasy:
+	case "":
+		// node-sodium/libsodium prefixes the cyphertext with 16 bytes of zeros (sodium.crypto_box_BOXZEROBYTES).
+		// box.Open doesn't seem to like this, so we strip them off.
+		if prefixed := zeroPrefixed(cyphertext, 16); prefixed {
+			cyphertext = cyphertext[16:]
+		}
+	default:
+		return nil, false
 	}
 
 	secret, ok := box.Open(nil, cyphertext, &nonce, &senderPubkey, &serverSecret)
@@ -47,15 +80,31 @@ func getJwtSecret(id string) ([]byte, error) {
 		cypher           string
 		nonce            string
 		encryptingPubkey string
+		master           string
+		format           string
+		envelopeKey      string
+		envelopeKEK      string
+		envelopeMaster   string
 	)
-	err := DB.QueryRow("SELECT secret_cypher, secret_nonce, encrypting_pubkey FROM didstore WHERE id = $1", id).Scan(&cypher, &nonce, &encryptingPubkey)
+	// secret_pubkey is set when the secret has been rotated by a later key in the chain
+	err := DB.QueryRow("SELECT secret_cypher, secret_nonce, COALESCE(NULLIF(secret_pubkey, ''), encrypting_pubkey), secret_master, secret_format, envelope_key, envelope_kek, envelope_master FROM didstore WHERE id = $1", id).Scan(&cypher, &nonce, &encryptingPubkey, &master, &format, &envelopeKey, &envelopeKEK, &envelopeMaster)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("DID does not exist")
 	} else if err != nil {
 		return nil, err
 	}
 
-	secret, ok := decryptRegSecret(cypher, nonce, encryptingPubkey, Conf.Keys.Secret)
+	// open the values if they are sealed at rest
+	env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+	if err == nil {
+		err = env.openValues(&cypher, &nonce)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// secret_master selects the master key the secret was encrypted to
+	secret, _, ok := openRegSecret(cypher, nonce, format, encryptingPubkey, master)
 	if !ok {
 		return nil, fmt.Errorf("Unable to decrypt registration secret")
 	}
@@ -68,16 +117,32 @@ func getRootJwtSecret(id string) ([]byte, error) {
 		cypher           string
 		nonce            string
 		encryptingPubkey string
+		master           string
+		format           string
+		envelopeKey      string
+		envelopeKEK      string
+		envelopeMaster   string
 	)
 	// get the root record
-	err := DB.QueryRow("SELECT r.secret_cypher, r.secret_nonce, r.encrypting_pubkey FROM didstore AS s JOIN didstore AS r ON s.root = r.id WHERE s.id = $1", id).Scan(&cypher, &nonce, &encryptingPubkey)
+	// secret_pubkey is set when the secret has been rotated by a later key in the chain
+	err := DB.QueryRow("SELECT r.secret_cypher, r.secret_nonce, COALESCE(NULLIF(r.secret_pubkey, ''), r.encrypting_pubkey), r.secret_master, r.secret_format, r.envelope_key, r.envelope_kek, r.envelope_master FROM didstore AS s JOIN didstore AS r ON s.root = r.id WHERE s.id = $1", id).Scan(&cypher, &nonce, &encryptingPubkey, &master, &format, &envelopeKey, &envelopeKEK, &envelopeMaster)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("DID does not exist")
 	} else if err != nil {
 		return nil, err
 	}
 
-	secret, ok := decryptRegSecret(cypher, nonce, encryptingPubkey, Conf.Keys.Secret)
+	// open the values if they are sealed at rest
+	env, err := openEnvelope(envelopeKey, envelopeKEK, envelopeMaster)
+	if err == nil {
+		err = env.openValues(&cypher, &nonce)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// secret_master selects the master key the secret was encrypted to
+	secret, _, ok := openRegSecret(cypher, nonce, format, encryptingPubkey, master)
 	if !ok {
 		return nil, fmt.Errorf("Unable to decrypt registration secret")
 	}
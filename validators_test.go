@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestDecryptRegSecretFormats(t *testing.T) {
+	masterPub, masterSecret, _ := box.GenerateKey(rand.Reader)
+	senderPub, senderSecret, _ := box.GenerateKey(rand.Reader)
+	message := []byte("registration secret")
+
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	easy := box.Seal(nil, message, &nonce, masterPub, senderSecret)
+	zeroPadded := append(make([]byte, 16), easy...)
+	sealed, err := box.SealAnonymous(nil, message, masterPub, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cyphertext []byte
+		format     string
+		ok         bool
+	}{
+		{"legacy without format", zeroPadded, "", true},
+		{"easy without format", easy, "", true},
+		{"crypto_box", zeroPadded, secretFormatBox, true},
+		{"crypto_box without zeros", easy, secretFormatBox, false},
+		{"crypto_box_easy", easy, secretFormatBoxEasy, true},
+		{"crypto_box_easy with zeros", zeroPadded, secretFormatBoxEasy, false},
+		{"crypto_box_seal", sealed, secretFormatSeal, true},
+		{"crypto_box_seal as easy", sealed, secretFormatBoxEasy, false},
+		{"unknown format", easy, "crypto_secretbox", false},
+		{"empty", nil, "", false},
+	}
+
+	for _, test := range tests {
+		secret, ok := decryptRegSecret(b64Encode(test.cyphertext), b64Encode(nonce[:]), test.format, b64Encode(senderPub[:]), masterSecret[:])
+		if ok != test.ok || (ok && string(secret) != string(message)) {
+			t.Errorf("%s: got %q, %v want ok %v", test.name, secret, ok, test.ok)
+		}
+	}
+}